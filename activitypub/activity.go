@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -32,56 +33,9 @@ func (activity Activity) AcceptFollow(a Actor) Activity {
 	return accept
 }
 
-func (activity Activity) AddFollowersTo() (Activity, error) {
-	activity.To = append(activity.To, activity.Actor.Id)
-
-	for _, e := range activity.To {
-		reqActivity := Activity{Id: e + "/followers"}
-		aFollowers, err := reqActivity.GetCollection()
-		if err != nil {
-			// Safely fail so we can continue to federate
-			log.Printf("failed to get collection from %s: %v", reqActivity.Id, err)
-			continue
-
-			// return activity, util.WrapError(err)
-		}
-
-		// get followers of activity actor
-		for _, k := range aFollowers.Items {
-			if !util.IsInStringArray(activity.To, k.Id) {
-				activity.To = append(activity.To, k.Id)
-			} else {
-				// We've already been here
-				continue
-			}
-
-			reqActivity := Activity{Id: k.Id + "/followers"}
-
-			bFollowers, err := reqActivity.GetCollection()
-			if err != nil {
-				continue
-			}
-
-			// get followers of activity actor followers
-			for _, j := range bFollowers.Items {
-				if !util.IsInStringArray(activity.To, j.Id) {
-					activity.To = append(activity.To, j.Id)
-				}
-			}
-		}
-	}
-
-	return activity, nil
-}
-
 func (activity Activity) CheckValid() (Collection, bool, error) {
 	var respCollection Collection
 
-	re := regexp.MustCompile(`.+\.onion(.+)?`)
-	if re.MatchString(activity.Id) {
-		activity.Id = strings.Replace(activity.Id, "https", "http", 1)
-	}
-
 	req, err := http.NewRequest("GET", activity.Id, nil)
 	if err != nil {
 		return respCollection, false, util.WrapError(err)
@@ -321,17 +275,40 @@ func (activity Activity) Send() error {
 	// TODO: debug switch
 	log.Println(string(j))
 
-	for _, e := range activity.To {
-		if e != activity.Actor.Id {
-			// TODO: webfinger
-			actor := Actor{Id: e, Inbox: e + "/inbox"}
-			name, instance := GetActorAndInstance(actor.Id)
+	// Finding inboxes may mean asking for actors, which the post shouldn't
+	// wait on.
+	go func() {
+		// Several recipients may share an inbox; it only needs the activity
+		// once.
+		sent := make(map[string]bool)
+
+		for _, e := range activity.To {
+			if e == activity.Actor.Id {
+				continue
+			}
+
+			if name, _ := GetActorAndInstance(e); name == "main" {
+				continue
+			}
+
+			to, err := inbox(e)
+			if err != nil {
+				log.Printf("not sending activity to %s: %v", e, err)
+				continue
+			}
 
-			if name != "main" {
-				go activity.send(actor, j, instance)
+			u, err := url.Parse(to)
+			if err != nil {
+				log.Printf("not sending activity to %s: %v", e, err)
+				continue
+			}
+
+			if !sent[to] {
+				sent[to] = true
+				go activity.send(Actor{Id: e, Inbox: to}, j, u.Host)
 			}
 		}
-	}
+	}()
 
 	return nil
 }
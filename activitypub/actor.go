@@ -15,6 +15,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
@@ -22,7 +23,33 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-var ActorCache = make(map[string]Actor)
+// actorCache holds the remote actors we have looked up, by name@instance.
+// It's used by whatever is handling a request at the time, so it's locked.
+var actorCache = struct {
+	sync.RWMutex
+	m map[string]Actor
+}{m: make(map[string]Actor)}
+
+// CachedActor returns the actor name@instance if we have looked it up before.
+func CachedActor(name, instance string) (Actor, bool) {
+	actorCache.RLock()
+	defer actorCache.RUnlock()
+
+	actor, ok := actorCache.m[name+"@"+instance]
+	return actor, ok && actor.Id != ""
+}
+
+func cacheActor(name, instance string, actor Actor) {
+	actorCache.Lock()
+	actorCache.m[name+"@"+instance] = actor
+	actorCache.Unlock()
+}
+
+func uncacheActor(name, instance string) {
+	actorCache.Lock()
+	delete(actorCache.m, name+"@"+instance)
+	actorCache.Unlock()
+}
 
 func (actor Actor) AddFollower(follower string) error {
 	query := `insert into follower (id, follower) values ($1, $2)`
@@ -74,7 +101,12 @@ accepting your posts from your board from this site. Good luck ;)`)
 
 func (actor Actor) ArchivePosts() error {
 	if actor.Id != "" && actor.Id != config.Domain {
-		col, err := actor.GetAllArchive(165)
+		settings, err := actor.Settings()
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		col, err := actor.GetAllArchive(settings.MaxThreads)
 
 		if err != nil {
 			return util.WrapError(err)
@@ -90,6 +122,11 @@ func (actor Actor) ArchivePosts() error {
 			if err := e.UpdateType("Archive"); err != nil {
 				return util.WrapError(err)
 			}
+
+			query := `insert into archived (id, board) values ($1, $2) on conflict do nothing`
+			if _, err := config.DB.Exec(query, e.Id, actor.Id); err != nil {
+				return util.WrapError(err)
+			}
 		}
 	}
 
@@ -141,22 +178,33 @@ func (actor Actor) AutoFollow() error {
 	return nil
 }
 
+// DeleteCache removes everything cached from a remote actor, including the
+// replies other boards made to its threads.
 func (actor Actor) DeleteCache() error {
-	query := `select id from cacheactivitystream where id in (select id from cacheactivitystream where actor=$1 and id in (select id from replies where inreplyto='')) `
-	rows, err := config.DB.Query(query, actor.Id)
+	if err := purgeThreads(actor.Id); err != nil {
+		return util.WrapError(err)
+	}
 
+	query := `select id from cacheactivitystream where actor=$1 and type in ('Note', 'Archive', 'Held', 'Tombstone')`
+	rows, err := config.DB.Query(query, actor.Id)
 	if err != nil {
 		return util.WrapError(err)
 	}
 
-	defer rows.Close()
+	var posts []ObjectBase
 	for rows.Next() {
 		var obj ObjectBase
 		if err := rows.Scan(&obj.Id); err != nil {
+			rows.Close()
 			return util.WrapError(err)
 		}
 
-		if err := obj.Delete(); err != nil {
+		posts = append(posts, obj)
+	}
+	rows.Close()
+
+	for _, e := range posts {
+		if err := e.deleteCached(); err != nil {
 			return util.WrapError(err)
 		}
 	}
@@ -213,31 +261,40 @@ func (actor Actor) GetCatalogCollection() (Collection, error) {
 	var err error
 	var rows *sql.Rows
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1)) as x order by x.updated desc limit 165`
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0), (select count(id) from replies where inreplyto=x.id), (select count(id) from attachments where id in (select id from replies where inreplyto=x.id)) from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1)) as x order by x.updated desc limit $2`
+
+	settings, err := actor.Settings()
+	if err != nil {
+		return nColl, util.WrapError(err)
+	}
 
-	if rows, err = config.DB.Query(query, actor.Id); err != nil {
+	if rows, err = config.DB.Query(query, actor.Id, settings.MaxThreads); err != nil {
 		return nColl, util.WrapError(err)
 	}
 
 	stickies, _ := actor.GetStickies()
 	result = append(result, stickies.OrderedItems...)
 
+	boards := make(boardSettings)
+
 	defer rows.Close()
 	for rows.Next() {
 		var post ObjectBase
+		var posts, files int
 		var actor Actor
 
 		var attch ObjectBase
 
 		var prev ObjectBase
 
-		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number, &posts, &files)
 
 		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 
 		post.Locked, _ = post.IsLocked()
+		post.BumpLimit, post.ImageLimit = boards.of(actor.Id).threadLimits(posts, files)
 		post.Actor = actor.Id
 
 		post.Replies = &CollectionBase{}
@@ -248,15 +305,12 @@ func (actor Actor) GetCatalogCollection() (Collection, error) {
 			return nColl, util.WrapError(err)
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+		if attch.Id != "" {
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nColl, util.WrapError(err)
 			}
@@ -279,9 +333,14 @@ func (actor Actor) GetCollectionPage(page int) (Collection, error) {
 	var err error
 	var rows *sql.Rows
 
-	query := `select count (x.id) over(), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where id not in (select activity_id from sticky where actor_id=$1) and actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note') as x order by x.updated desc limit $2 offset $3`
+	query := `select count (x.id) over(), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0), (select count(id) from replies where inreplyto=x.id), (select count(id) from attachments where id in (select id from replies where inreplyto=x.id)) from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where id not in (select activity_id from sticky where actor_id=$1) and actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note') as x order by x.updated desc limit $2 offset $3`
+
+	settings, err := actor.Settings()
+	if err != nil {
+		return nColl, util.WrapError(err)
+	}
 
-	limit := 15
+	limit := settings.ThreadsPerPage
 
 	if page == 0 {
 		stickies, _ := actor.GetStickies()
@@ -297,22 +356,26 @@ func (actor Actor) GetCollectionPage(page int) (Collection, error) {
 	}
 
 	var count int
+	boards := make(boardSettings)
+
 	defer rows.Close()
 	for rows.Next() {
 		var post ObjectBase
+		var posts, files int
 		var actor Actor
 
 		var attch ObjectBase
 
 		var prev ObjectBase
 
-		err = rows.Scan(&count, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&count, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number, &posts, &files)
 
 		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 
 		post.Locked, _ = post.IsLocked()
+		post.BumpLimit, post.ImageLimit = boards.of(actor.Id).threadLimits(posts, files)
 		post.Actor = actor.Id
 
 		post.Replies, err = post.GetRepliesLimit(5)
@@ -321,8 +384,12 @@ func (actor Actor) GetCollectionPage(page int) (Collection, error) {
 			return nColl, util.WrapError(err)
 		}
 
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
+		}
+
 		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nColl, util.WrapError(err)
 			}
@@ -332,13 +399,6 @@ func (actor Actor) GetCollectionPage(page int) (Collection, error) {
 			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
 		result = append(result, post)
 	}
 
@@ -355,28 +415,32 @@ func (actor Actor) GetCollection() (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
-	query := `select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' order by updated desc`
+	query := `select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, coalesce(posterid, ''), coalesce((select number from postnumber n where n.id=activitystream.id), 0), (select count(id) from replies where inreplyto=activitystream.id), (select count(id) from attachments where id in (select id from replies where inreplyto=activitystream.id)) from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' order by updated desc`
 	rows, err := config.DB.Query(query, actor.Id)
 
 	if err != nil {
 		return nColl, util.WrapError(err)
 	}
 
+	boards := make(boardSettings)
+
 	defer rows.Close()
 	for rows.Next() {
 		var post ObjectBase
+		var posts, files int
 		var actor Actor
 
 		var attch ObjectBase
 
 		var prev ObjectBase
 
-		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
+		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number, &posts, &files); err != nil {
 			return nColl, util.WrapError(err)
 		}
 
 		post.Sticky, _ = post.IsSticky()
 		post.Locked, _ = post.IsLocked()
+		post.BumpLimit, post.ImageLimit = boards.of(actor.Id).threadLimits(posts, files)
 
 		post.Actor = actor.Id
 
@@ -386,15 +450,12 @@ func (actor Actor) GetCollection() (Collection, error) {
 			return nColl, util.WrapError(err)
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+		if attch.Id != "" {
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nColl, util.WrapError(err)
 			}
@@ -414,7 +475,7 @@ func (actor Actor) GetCollectionType(nType string) (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2) as x order by x.updated desc`
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0) from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2) as x order by x.updated desc`
 	rows, err := config.DB.Query(query, actor.Id, nType)
 	if err != nil {
 		return nColl, util.WrapError(err)
@@ -429,7 +490,7 @@ func (actor Actor) GetCollectionType(nType string) (Collection, error) {
 
 		var prev ObjectBase
 
-		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
+		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number); err != nil {
 			return nColl, util.WrapError(err)
 		}
 
@@ -442,15 +503,12 @@ func (actor Actor) GetCollectionType(nType string) (Collection, error) {
 			return nColl, util.WrapError(err)
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+		if attch.Id != "" {
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nColl, util.WrapError(err)
 			}
@@ -468,7 +526,7 @@ func (actor Actor) GetCollectionTypeLimit(nType string, limit int) (Collection,
 	var nColl Collection
 	var result []ObjectBase
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2) as x order by x.updated desc limit $3`
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0) from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2) as x order by x.updated desc limit $3`
 	rows, err := config.DB.Query(query, actor.Id, nType, limit)
 
 	if err != nil {
@@ -484,7 +542,7 @@ func (actor Actor) GetCollectionTypeLimit(nType string, limit int) (Collection,
 
 		var prev ObjectBase
 
-		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
+		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number); err != nil {
 			return nColl, util.WrapError(err)
 		}
 
@@ -497,15 +555,12 @@ func (actor Actor) GetCollectionTypeLimit(nType string, limit int) (Collection,
 			return nColl, util.WrapError(err)
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			post.Preview, err = post.Preview.GetPreview()
+		if attch.Id != "" {
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nColl, util.WrapError(err)
 			}
@@ -671,6 +726,8 @@ func (actor Actor) GetImgTotal() (int, error) {
 }
 
 func (actor Actor) GetInfoResp(ctx *fiber.Ctx) error {
+	actor.AlsoKnownAs = actor.Aliases()
+
 	enc, _ := json.MarshalIndent(actor, "", "\t")
 	ctx.Response().Header.Set("Content-Type", "application/ld+json; profile=\"https://www.w3.org/ns/activitystreams\"")
 
@@ -745,7 +802,7 @@ func (actor Actor) GetRecentPosts() ([]ObjectBase, error) {
 
 		isOP, _ := nObj.CheckIfOP()
 
-		nObj.Attachment, _ = attachment.GetAttachment()
+		nObj.Attachment, _, _ = nObj.GetAttachments()
 
 		if !isOP {
 			var reply ObjectBase
@@ -1040,7 +1097,12 @@ func (actor Actor) WantToServePage(page int) (Collection, error) {
 	var collection Collection
 	var err error
 
-	if page > config.PostCountPerPage {
+	settings, err := actor.Settings()
+	if err != nil {
+		return collection, util.WrapError(err)
+	}
+
+	if page >= settings.MaxPages {
 		return collection, errors.New("above page limit")
 	}
 
@@ -1070,6 +1132,30 @@ func (actor Actor) ProcessInboxCreate(activity Activity) error {
 				if locked, _ := activity.Object.InReplyTo[0].IsLocked(); locked {
 					return util.WrapError(err)
 				}
+
+				if len(activity.Object.Attachment) > 0 {
+					if _, imageLimit, _ := activity.Object.InReplyTo[0].ThreadLimits(); imageLimit {
+						return nil
+					}
+				}
+			}
+
+			// Remote posts follow the same rules about files as ours do.
+			if len(activity.Object.Attachment) > 0 {
+				settings, err := actor.Settings()
+				if err != nil {
+					return util.WrapError(err)
+				}
+
+				for _, e := range activity.Object.Attachment {
+					if e.Href == "" {
+						continue
+					}
+
+					if !settings.AllowsFiles() || !settings.Accepts(e.MediaType) {
+						return nil
+					}
+				}
 			}
 
 			if wantToCache, err := activity.Object.WantToCache(actor); !wantToCache {
@@ -1080,10 +1166,15 @@ func (actor Actor) ProcessInboxCreate(activity Activity) error {
 				return nil
 			}
 
-			if _, err := activity.Object.WriteCache(); err != nil {
+			// The sizes remote instances give aren't trusted, so what's
+			// counted is what WriteCache found when it fetched the media.
+			cached, err := activity.Object.WriteCache()
+			if err != nil {
 				return util.WrapError(err)
 			}
 
+			countCached(*activity.Actor, cached)
+
 			if err := actor.ArchivePosts(); err != nil {
 				return util.WrapError(err)
 			}
@@ -1105,15 +1196,15 @@ func (actor Actor) GetStickies() (Collection, error) {
 
 	query := `
 select count
-(x.id) over(), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive
+(x.id) over(), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0), (select count(id) from replies where inreplyto=x.id), (select count(id) from attachments where id in (select id from replies where inreplyto=x.id))
 	from
-	 (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream
+	 (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream
 		where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1)
 	union
-		select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream
+		select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream
 		where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1)
 	union
-		select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1)
+		select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where actor in (select following from following where id=$1)
 		and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1)
 ) as x order by x.updated desc limit 15`
 
@@ -1124,16 +1215,19 @@ select count
 	}
 
 	var count int
+	boards := make(boardSettings)
+
 	defer rows.Close()
 	for rows.Next() {
 		var post ObjectBase
+		var posts, files int
 		var actor Actor
 
 		var attch ObjectBase
 
 		var prev ObjectBase
 
-		err = rows.Scan(&count, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&count, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number, &posts, &files)
 
 		if err != nil {
 			return nColl, util.WrapError(err)
@@ -1141,6 +1235,7 @@ select count
 
 		post.Sticky = true
 		post.Locked, _ = post.IsLocked()
+		post.BumpLimit, post.ImageLimit = boards.of(actor.Id).threadLimits(posts, files)
 		post.Actor = actor.Id
 
 		post.Replies, err = post.GetRepliesLimit(5)
@@ -1148,17 +1243,14 @@ select count
 			return nColl, err
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+		if attch.Id != "" {
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
-				return nColl, err
+				return nColl, util.WrapError(err)
 			}
 		}
 
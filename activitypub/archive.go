@@ -0,0 +1,197 @@
+package activitypub
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+const pruneInterval = time.Hour
+
+// PruneRun is a run of PruneArchives that pruned something.
+type PruneRun struct {
+	Ran       time.Time
+	Threads   int
+	Reclaimed int64
+}
+
+// PruneArchives prunes archived threads once they have been kept for as long
+// as their board wants them.
+func PruneArchives() {
+	for {
+		if err := pruneArchives(); err != nil {
+			log.Printf("failed to prune archives: %v", err)
+		}
+
+		time.Sleep(pruneInterval)
+	}
+}
+
+func pruneArchives() error {
+	boards, err := queryIDs(`select distinct board from archived`)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var threads int
+	var reclaimed int64
+
+	for _, board := range boards {
+		// One board failing shouldn't keep the rest from being pruned.
+		n, size, err := pruneBoard(board)
+		if err != nil {
+			log.Printf("failed to prune archive of %s: %v", board, err)
+		}
+
+		threads += n
+		reclaimed += size
+	}
+
+	if threads == 0 {
+		return nil
+	}
+
+	log.Printf("pruned %d archived threads, reclaiming %s", threads, util.ConvertSize(reclaimed))
+
+	query := `insert into archiveprune (threads, reclaimed) values ($1, $2)`
+	_, err = config.DB.Exec(query, threads, reclaimed)
+	return util.WrapError(err)
+}
+
+// pruneBoard prunes the archived threads of a board that are old enough, and
+// returns how many were pruned and how much disk space was reclaimed.
+func pruneBoard(board string) (int, int64, error) {
+	settings, err := Actor{Id: board}.Settings()
+	if err != nil {
+		return 0, 0, util.WrapError(err)
+	}
+
+	if settings.ArchiveRetention <= 0 {
+		return 0, 0, nil
+	}
+
+	ids, err := queryIDs(`select id from archived where board=$1 and archived < $2`, board, time.Now().Add(-settings.ArchiveRetention))
+	if err != nil {
+		return 0, 0, util.WrapError(err)
+	}
+
+	var threads int
+	var reclaimed int64
+
+	for _, id := range ids {
+		size, err := pruneThread(ObjectBase{Id: id}, settings.PurgeArchive)
+		reclaimed += size
+		if err != nil {
+			return threads, reclaimed, util.WrapError(err)
+		}
+
+		threads++
+	}
+
+	return threads, reclaimed, nil
+}
+
+// pruneThread removes the media of a thread, or the entire thread if purge is
+// set, and returns how much disk space was reclaimed.
+func pruneThread(thread ObjectBase, purge bool) (int64, error) {
+	replies, err := queryIDs(`select id from replies where inreplyto=$1`, thread.Id)
+	if err != nil {
+		return 0, util.WrapError(err)
+	}
+
+	var reclaimed int64
+	for _, id := range append(replies, thread.Id) {
+		post := ObjectBase{Id: id}
+
+		files, err := post.mediaFiles()
+		if err != nil {
+			return reclaimed, util.WrapError(err)
+		}
+
+		if purge {
+			err = post.DeleteAll()
+		} else {
+			err = post.pruneMedia()
+		}
+
+		if err != nil {
+			return reclaimed, util.WrapError(err)
+		}
+
+		// Files other posts still use are kept, so only count what's gone.
+		for file, size := range files {
+			if _, err := os.Stat(file); errors.Is(err, fs.ErrNotExist) {
+				reclaimed += size
+			}
+		}
+	}
+
+	query := `delete from archived where id=$1`
+	_, err = config.DB.Exec(query, thread.Id)
+	return reclaimed, util.WrapError(err)
+}
+
+func (obj ObjectBase) pruneMedia() error {
+	if err := obj.DeleteAttachmentFromFile(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := obj.TombstoneAttachment(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := obj.DeletePreviewFromFile(); err != nil {
+		return util.WrapError(err)
+	}
+
+	return obj.TombstonePreview()
+}
+
+// PruneRuns returns the most recent runs of PruneArchives that pruned
+// something.
+func PruneRuns(limit int) ([]PruneRun, error) {
+	query := `select ran, threads, reclaimed from archiveprune order by ran desc limit $1`
+	rows, err := config.DB.Query(query, limit)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+	defer rows.Close()
+
+	var runs []PruneRun
+	for rows.Next() {
+		var run PruneRun
+		if err := rows.Scan(&run.Ran, &run.Threads, &run.Reclaimed); err != nil {
+			return runs, util.WrapError(err)
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// queryIDs returns the first column of every row query returns.
+func queryIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, util.WrapError(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
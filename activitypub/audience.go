@@ -0,0 +1,273 @@
+package activitypub
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// How long a cached followers collection is used before it is fetched again.
+const followersCacheTime = 6 * time.Hour
+
+var (
+	refreshing   = make(map[string]bool)
+	refreshingMu sync.Mutex
+)
+
+// AddAudience addresses activity to everyone who should see it, using only
+// what we already know locally: the followers of the sending actor, the boards
+// already addressed (the thread's origin and any mentioned boards) and the
+// followers those boards had when we last looked.
+func (activity Activity) AddAudience() (Activity, error) {
+	seen := map[string]bool{activity.Actor.Id: true}
+	var audience []string
+
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			audience = append(audience, id)
+		}
+	}
+
+	followers, err := activity.Actor.GetFollower()
+	if err != nil {
+		return activity, util.WrapError(err)
+	}
+
+	for _, e := range followers {
+		add(e.Id)
+	}
+
+	for _, e := range activity.To {
+		add(e)
+
+		if local, _ := (Actor{Id: e}).IsLocal(); local {
+			followers, err := Actor{Id: e}.GetFollower()
+			if err != nil {
+				return activity, util.WrapError(err)
+			}
+
+			for _, k := range followers {
+				add(k.Id)
+			}
+
+			continue
+		}
+
+		followers, err := CachedFollowers(e)
+		if err != nil {
+			// Not knowing who else follows them shouldn't stop the post
+			log.Printf("failed to get cached followers of %s: %v", e, err)
+			continue
+		}
+
+		for _, k := range followers {
+			add(k)
+		}
+	}
+
+	activity.To = audience
+
+	return activity, nil
+}
+
+// CachedFollowers returns the followers of a remote actor as of the last time
+// they were fetched.
+// Unknown or stale collections are refreshed in the background, so the result
+// may be out of date or empty until that finishes.
+func CachedFollowers(id string) ([]string, error) {
+	var updated time.Time
+
+	query := `select updated from cachedcollection where id=$1`
+	err := config.DB.QueryRow(query, id).Scan(&updated)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && time.Since(updated) > followersCacheTime) {
+		go refreshFollowers(id)
+	} else if err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	query = `select follower from cachedfollower where id=$1`
+	rows, err := config.DB.Query(query, id)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+	defer rows.Close()
+
+	var followers []string
+	for rows.Next() {
+		var follower string
+		if err := rows.Scan(&follower); err != nil {
+			return followers, util.WrapError(err)
+		}
+
+		followers = append(followers, follower)
+	}
+
+	return followers, nil
+}
+
+// refreshFollowers is RefreshFollowers, but only one at a time per actor and
+// with errors logged.
+func refreshFollowers(id string) {
+	refreshingMu.Lock()
+	if refreshing[id] {
+		refreshingMu.Unlock()
+		return
+	}
+	refreshing[id] = true
+	refreshingMu.Unlock()
+
+	if err := RefreshFollowers(id); err != nil {
+		log.Printf("failed to refresh followers of %s: %v", id, err)
+	}
+
+	refreshingMu.Lock()
+	delete(refreshing, id)
+	refreshingMu.Unlock()
+}
+
+// RefreshFollowers fetches the followers collection of a remote actor and
+// replaces our cached copy of it.
+func RefreshFollowers(id string) error {
+	actor, err := GetActor(id)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if actor.Followers == "" {
+		return errors.New("actor has no followers collection")
+	}
+
+	coll, err := Activity{Id: actor.Followers}.GetCollection()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if _, err := tx.Exec(`delete from cachedfollower where id=$1`, id); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	for _, e := range append(coll.Items, coll.OrderedItems...) {
+		query := `insert into cachedfollower (id, follower) values ($1, $2) on conflict do nothing`
+		if _, err := tx.Exec(query, id, e.Id); err != nil {
+			tx.Rollback()
+			return util.WrapError(err)
+		}
+	}
+
+	query := `insert into cachedcollection (id, updated) values ($1, $2) on conflict (id) do update set updated=excluded.updated`
+	if _, err := tx.Exec(query, id, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	return util.WrapError(tx.Commit())
+}
+
+// CacheFollowers keeps the followers of every remote actor we deal with
+// cached, so sending a post never has to wait on fetching them.
+func CacheFollowers() {
+	for {
+		query := `select id from cachedcollection union select following from following union select follower from follower`
+		rows, err := config.DB.Query(query)
+		if err != nil {
+			log.Printf("failed to get actors to cache followers of: %v", err)
+			time.Sleep(followersCacheTime)
+			continue
+		}
+
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				log.Printf("failed to get actors to cache followers of: %v", err)
+				break
+			}
+
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if local, _ := (Actor{Id: id}).IsLocal(); local {
+				continue
+			}
+
+			refreshFollowers(id)
+		}
+
+		cacheFollowerActors()
+
+		time.Sleep(followersCacheTime)
+	}
+}
+
+// cacheFollowerActors looks up every remote actor in a cached followers
+// collection we don't know yet, so their inboxes are known before anything
+// is sent to them.
+func cacheFollowerActors() {
+	rows, err := config.DB.Query(`select distinct follower from cachedfollower`)
+	if err != nil {
+		log.Printf("failed to get followers to cache: %v", err)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("failed to get followers to cache: %v", err)
+			break
+		}
+
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if local, _ := (Actor{Id: id}).IsLocal(); local {
+			continue
+		}
+
+		if _, err := GetActor(id); err != nil {
+			log.Printf("failed to cache actor %s: %v", id, err)
+		}
+	}
+}
+
+// inbox returns where activities for the actor id are sent, preferring the
+// shared inbox of their instance.
+// Remote actors we haven't seen yet are looked up.
+func inbox(id string) (string, error) {
+	var actor Actor
+	var err error
+
+	if local, _ := (Actor{Id: id}).IsLocal(); local {
+		actor, err = GetActorFromDB(id)
+	} else {
+		actor, err = GetActor(id)
+	}
+
+	if err != nil {
+		return "", util.WrapError(err)
+	}
+
+	if actor.Endpoints != nil && actor.Endpoints.SharedInbox != "" {
+		return actor.Endpoints.SharedInbox, nil
+	} else if actor.Inbox == "" {
+		return "", errors.New("actor has no inbox")
+	}
+
+	return actor.Inbox, nil
+}
@@ -0,0 +1,112 @@
+package activitypub
+
+import (
+	"strings"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/rx"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Which posts cite which is recorded when they are written, so backlinks can
+// be shown without reading every post in a thread.
+
+// WriteCitations records the posts obj cites.
+func (obj ObjectBase) WriteCitations() error {
+	for _, e := range obj.Cites {
+		if e.Id == "" || e.Id == obj.Id {
+			continue
+		}
+
+		query := `insert into citations (id, cites) values ($1, $2) on conflict do nothing`
+		if _, err := config.DB.Exec(query, obj.Id, e.Id); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// GetBacklinks returns the posts that cite obj, oldest first.
+// Only their IDs and numbers are filled in.
+func (obj ObjectBase) GetBacklinks() ([]ObjectBase, error) {
+	backlinks, err := getBacklinks(`c.cites=$1`, obj.Id)
+	return backlinks[obj.Id], util.WrapError(err)
+}
+
+// setBacklinks fills in the backlinks of a thread and the replies it was
+// read with, reading those of the whole thread at once.
+func (obj *ObjectBase) setBacklinks() error {
+	backlinks, err := getBacklinks(`(c.cites=$1 or c.cites in (select id from replies where inreplyto=$1))`, obj.Id)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	obj.Backlinks = backlinks[obj.Id]
+	if obj.Replies == nil {
+		return nil
+	}
+
+	for i := range obj.Replies.OrderedItems {
+		reply := &obj.Replies.OrderedItems[i]
+		reply.Backlinks = backlinks[reply.Id]
+
+		if reply.Replies == nil {
+			continue
+		}
+
+		for j := range reply.Replies.OrderedItems {
+			e := &reply.Replies.OrderedItems[j]
+			e.Backlinks = backlinks[e.Id]
+		}
+	}
+
+	return nil
+}
+
+// getBacklinks returns the backlinks of the posts cited where cond holds, by
+// the post they cite.
+func getBacklinks(cond, id string) (map[string][]ObjectBase, error) {
+	query := `select c.cites, c.id, coalesce(n.number, 0) from citations c join (select id, published from activitystream where type in ('Note', 'Archive') union select id, published from cacheactivitystream where type in ('Note', 'Archive')) p on p.id = c.id left join postnumber n on n.id = c.id where ` + cond + ` order by p.published asc`
+	rows, err := config.DB.Query(query, id)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+	defer rows.Close()
+
+	backlinks := make(map[string][]ObjectBase)
+	for rows.Next() {
+		var cites string
+		var post ObjectBase
+		if err := rows.Scan(&cites, &post.Id, &post.Number); err != nil {
+			return backlinks, util.WrapError(err)
+		}
+
+		backlinks[cites] = append(backlinks[cites], post)
+	}
+
+	return backlinks, util.WrapError(rows.Err())
+}
+
+// contentCites returns the posts content cites by their full ID.
+// Posts from other instances arrive with their citations already resolved,
+// so this is all they need.
+func contentCites(content string) []ObjectBase {
+	var cites []ObjectBase
+
+	for _, m := range rx.Cite.FindAllStringSubmatch(content, -1) {
+		if m[4] == "" && m[5] == "" {
+			// A board, not a post.
+			continue
+		}
+
+		id := strings.TrimPrefix(m[0], ">>")
+		if i := strings.Index(id, "#"); i >= 0 {
+			id = m[2] + id[i+1:]
+		}
+
+		cites = append(cites, ObjectBase{Id: id})
+	}
+
+	return cites
+}
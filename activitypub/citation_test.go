@@ -0,0 +1,34 @@
+package activitypub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContentCites(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"post", ">>https://example.com/b/ABCD nice", []string{"https://example.com/b/ABCD"}},
+		{"several", ">>https://example.com/b/ABCD\n>>https://other.example/g/EFGH", []string{"https://example.com/b/ABCD", "https://other.example/g/EFGH"}},
+		{"anchor", ">>https://example.com/b/ABCD#EFGH", []string{"https://example.com/b/EFGH"}},
+		{"board", ">>https://example.com/b/", nil},
+		{"number", ">>1234", nil},
+		{"nothing", "hello", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range contentCites(tt.content) {
+				got = append(got, e.Id)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("contentCites(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
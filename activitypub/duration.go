@@ -0,0 +1,72 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Duration is how long media plays for, in seconds.
+// ActivityStreams gives it as an xsd:duration, such as PT3.5S.
+type Duration float64
+
+var xsdDuration = regexp.MustCompile(`^P(?:([0-9.]+)Y)?(?:([0-9.]+)M)?(?:([0-9.]+)W)?(?:([0-9.]+)D)?(?:T(?:([0-9.]+)H)?(?:([0-9.]+)M)?(?:([0-9.]+)S)?)?$`)
+
+// Seconds of each part of an xsd:duration, in the order they're written.
+// Years and months don't have a fixed length, but nothing that plays lasts
+// long enough for that to matter.
+var xsdDurationUnits = []float64{365 * 24 * 3600, 30 * 24 * 3600, 7 * 24 * 3600, 24 * 3600, 3600, 60, 1}
+
+// ParseDuration reads an xsd:duration.
+func ParseDuration(s string) (Duration, bool) {
+	m := xsdDuration.FindStringSubmatch(s)
+	if m == nil || s == "P" || s[len(s)-1] == 'T' {
+		return 0, false
+	}
+
+	var d float64
+	for i, part := range m[1:] {
+		if part == "" {
+			continue
+		}
+
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+
+		d += n * xsdDurationUnits[i]
+	}
+
+	return Duration(d), true
+}
+
+// String returns the duration as an xsd:duration, to the millisecond.
+func (d Duration) String() string {
+	return "PT" + strconv.FormatFloat(math.Round(float64(d)*1000)/1000, 'f', -1, 64) + "S"
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads an xsd:duration, or a number of seconds.
+// Durations that can't be read are left as zero rather than failing the
+// whole object; they're only shown next to the file.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*d, _ = ParseDuration(s)
+		return nil
+	}
+
+	var n float64
+	if err := json.Unmarshal(b, &n); err == nil && n > 0 && !math.IsInf(n, 0) {
+		*d = Duration(n)
+		return nil
+	}
+
+	*d = 0
+	return nil
+}
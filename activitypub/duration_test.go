@@ -0,0 +1,71 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Duration
+		ok   bool
+	}{
+		{"PT3.5S", 3.5, true},
+		{"PT0S", 0, true},
+		{"PT1M30S", 90, true},
+		{"PT1H2M3S", 3723, true},
+		{"P1DT1S", 86401, true},
+		{"P1W", 7 * 24 * 3600, true},
+		{"PT90S", 90, true},
+		{"", 0, false},
+		{"P", 0, false},
+		{"PT", 0, false},
+		{"P1DT", 0, false},
+		{"3.5", 0, false},
+		{"-PT1S", 0, false},
+		{"PT1.2.3S", 0, false},
+		{"PT1S1M", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseDuration(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v, %v", tt.in, float64(got), ok, float64(tt.want), tt.ok)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	tests := []struct {
+		d    Duration
+		want string
+	}{
+		{3.5, `"PT3.5S"`},
+		{90, `"PT90S"`},
+		{1.23456, `"PT1.235S"`},
+	}
+
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.d)
+		if err != nil || string(b) != tt.want {
+			t.Errorf("json.Marshal(%v) = %s, %v, want %s", float64(tt.d), b, err, tt.want)
+		}
+
+		var d Duration
+		if err := json.Unmarshal(b, &d); err != nil || d.String() != tt.d.String() {
+			t.Errorf("json.Unmarshal(%s) = %v, %v", b, float64(d), err)
+		}
+	}
+
+	var obj ObjectBase
+	if err := json.Unmarshal([]byte(`{"type": "Document", "duration": "soon"}`), &obj); err != nil {
+		t.Errorf("bad duration failed the object: %v", err)
+	} else if obj.Duration != 0 || obj.Type != "Document" {
+		t.Errorf("bad duration read as %v", float64(obj.Duration))
+	}
+
+	if b, _ := json.Marshal(ObjectBase{Type: "Document"}); string(b) != `{"type":"Document","published":"0001-01-01T00:00:00Z"}` {
+		t.Errorf("zero duration was written: %s", b)
+	}
+}
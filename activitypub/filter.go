@@ -0,0 +1,488 @@
+package activitypub
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Filters are patterns run over what people write before it's posted.
+// Depending on the action, a post that matches one is refused, has the match
+// replaced, is saged or marked sensitive, or is held until a moderator has
+// looked at it.
+
+const (
+	FilterBlock     = "block"
+	FilterReplace   = "replace"
+	FilterSage      = "sage"
+	FilterSensitive = "sensitive"
+	FilterHold      = "hold"
+)
+
+// FilterActions lists every action, in the order they're offered.
+var FilterActions = []string{FilterBlock, FilterReplace, FilterSage, FilterSensitive, FilterHold}
+
+// Held posts are stored as this type, which keeps them off every page until
+// they are released.
+const heldType = "Held"
+
+const (
+	maxFilterPattern     = 200
+	maxFilterReplacement = 200
+)
+
+var ErrBadFilter = errors.New("bad filter")
+
+// Filter is a pattern matched against the posts of a board, or of every board
+// if Board is empty.
+type Filter struct {
+	ID          int
+	Board       string
+	Pattern     string
+	Action      string
+	Replacement string
+
+	// Which parts of a post are matched.
+	Name    bool
+	Subject bool
+	Comment bool
+
+	Hits    int
+	Created time.Time
+
+	re *regexp.Regexp
+}
+
+// FilterResult is a post after the filters have been run over it.
+type FilterResult struct {
+	Name    string
+	Subject string
+	Comment string
+
+	Block     bool
+	Hold      bool
+	Sage      bool
+	Sensitive bool
+
+	// A replacement made part of the post longer than can be stored.
+	TooLong bool
+
+	// Every filter that matched, in the order they ran.
+	Matched []Filter
+}
+
+// Patterns are compiled when they are saved, so they are never compiled
+// while posting and one that doesn't compile can't be saved.
+var filters struct {
+	sync.RWMutex
+	list []*Filter
+}
+
+// How often the hits of filters are written out.
+const filterHitsInterval = time.Minute
+
+// Hits are counted here as posts are made, and written out by
+// CountFilterHits, so posting never waits on them.
+var filterHits = struct {
+	sync.Mutex
+	m map[int]int
+}{m: make(map[int]int)}
+
+func validAction(action string) bool {
+	for _, e := range FilterActions {
+		if e == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compile checks a filter, and compiles its pattern.
+func (f *Filter) compile() error {
+	if f.Pattern == "" || len(f.Pattern) > maxFilterPattern {
+		return fmt.Errorf("%w: pattern must be 1 to %d characters", ErrBadFilter, maxFilterPattern)
+	} else if len(f.Replacement) > maxFilterReplacement {
+		return fmt.Errorf("%w: replacement can't be longer than %d characters", ErrBadFilter, maxFilterReplacement)
+	} else if !validAction(f.Action) {
+		return fmt.Errorf("%w: unknown action %q", ErrBadFilter, f.Action)
+	} else if !f.Name && !f.Subject && !f.Comment {
+		return fmt.Errorf("%w: it has to match something", ErrBadFilter)
+	}
+
+	re, err := regexp.Compile(f.Pattern)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadFilter, err)
+	}
+
+	f.re = re
+	return nil
+}
+
+// Filters returns every filter, with their hits.
+func Filters() ([]Filter, error) {
+	var list []Filter
+
+	query := `select id, board, pattern, action, replacement, name, subject, comment, hits, created from filters order by board, id`
+	rows, err := config.DB.Query(query)
+	if err != nil {
+		return list, util.WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var f Filter
+		if err := rows.Scan(&f.ID, &f.Board, &f.Pattern, &f.Action, &f.Replacement, &f.Name, &f.Subject, &f.Comment, &f.Hits, &f.Created); err != nil {
+			return list, util.WrapError(err)
+		}
+
+		list = append(list, f)
+	}
+
+	// Including the ones that haven't been written out yet.
+	filterHits.Lock()
+	for i := range list {
+		list[i].Hits += filterHits.m[list[i].ID]
+	}
+	filterHits.Unlock()
+
+	return list, util.WrapError(rows.Err())
+}
+
+// LoadFilters reads the filters from the database, replacing the ones in use.
+func LoadFilters() error {
+	list, err := Filters()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var compiled []*Filter
+	for i := range list {
+		f := &list[i]
+
+		// Patterns are checked when they are saved, but a database from
+		// before then can still have ones that aren't valid.
+		if err := f.compile(); err != nil {
+			log.Printf("skipping filter %d: %v", f.ID, err)
+			continue
+		}
+
+		compiled = append(compiled, f)
+	}
+
+	filters.Lock()
+	filters.list = compiled
+	filters.Unlock()
+
+	return nil
+}
+
+// AddFilter saves a new filter, and starts using it.
+func AddFilter(f Filter) error {
+	if err := f.compile(); err != nil {
+		return err
+	}
+
+	if f.Board != "" {
+		if local, _ := (Actor{Id: f.Board}).IsLocal(); !local {
+			return fmt.Errorf("%w: no such board", ErrBadFilter)
+		}
+	}
+
+	query := `insert into filters (board, pattern, action, replacement, name, subject, comment) values ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := config.DB.Exec(query, f.Board, f.Pattern, f.Action, f.Replacement, f.Name, f.Subject, f.Comment); err != nil {
+		return util.WrapError(err)
+	}
+
+	return LoadFilters()
+}
+
+// DeleteFilter removes a filter.
+func DeleteFilter(id int) error {
+	if _, err := config.DB.Exec(`delete from filters where id=$1`, id); err != nil {
+		return util.WrapError(err)
+	}
+
+	return LoadFilters()
+}
+
+// ApplyFilters runs the filters for every board, and those of boards, over a
+// post, counting a hit for each that matches.
+func ApplyFilters(name, subject, comment string, boards ...string) FilterResult {
+	res := runFilters(name, subject, comment, boards)
+
+	filterHits.Lock()
+	for _, f := range res.Matched {
+		filterHits.m[f.ID]++
+	}
+	filterHits.Unlock()
+
+	return res
+}
+
+// CountFilterHits periodically writes out the hits of filters.
+func CountFilterHits() {
+	for {
+		time.Sleep(filterHitsInterval)
+
+		if err := countFilterHits(); err != nil {
+			log.Printf("failed to count filter hits: %v", err)
+		}
+	}
+}
+
+func countFilterHits() error {
+	filterHits.Lock()
+	hits := filterHits.m
+	filterHits.m = make(map[int]int)
+	filterHits.Unlock()
+
+	for id, n := range hits {
+		if _, err := config.DB.Exec(`update filters set hits = hits + $1 where id=$2`, n, id); err != nil {
+			// Kept for next time.
+			filterHits.Lock()
+			for id, n := range hits {
+				filterHits.m[id] += n
+			}
+			filterHits.Unlock()
+
+			return util.WrapError(err)
+		}
+
+		delete(hits, id)
+	}
+
+	return nil
+}
+
+// TestFilters is ApplyFilters without counting hits, so staff can see what
+// would happen to a post.
+func TestFilters(name, subject, comment string, boards ...string) FilterResult {
+	return runFilters(name, subject, comment, boards)
+}
+
+func runFilters(name, subject, comment string, boards []string) FilterResult {
+	res := FilterResult{Name: name, Subject: subject, Comment: comment}
+
+	filters.RLock()
+	defer filters.RUnlock()
+
+	for _, f := range filters.list {
+		if f.Board != "" && !util.IsInStringArray(boards, f.Board) {
+			continue
+		}
+
+		var matched bool
+		for _, e := range []struct {
+			on    bool
+			field *string
+		}{{f.Name, &res.Name}, {f.Subject, &res.Subject}, {f.Comment, &res.Comment}} {
+			if !e.on || !f.re.MatchString(*e.field) {
+				continue
+			}
+
+			matched = true
+			if f.Action == FilterReplace {
+				*e.field = f.re.ReplaceAllString(*e.field, f.Replacement)
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		res.Matched = append(res.Matched, *f)
+
+		switch f.Action {
+		case FilterBlock:
+			res.Block = true
+		case FilterHold:
+			res.Hold = true
+		case FilterSage:
+			res.Sage = true
+		case FilterSensitive:
+			res.Sensitive = true
+		}
+	}
+
+	res.TooLong = len(res.Name) > maxNameLen || len(res.Subject) > maxNameLen || len(res.Comment) > maxCommentLen
+
+	return res
+}
+
+// truncate shortens s to at most n bytes, without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// boardsShowing returns the local boards that a post made to board is shown
+// on, which is board itself if it's local.
+func boardsShowing(board string) []string {
+	boards := []string{board}
+
+	rows, err := config.DB.Query(`select id from following where following=$1`, board)
+	if err != nil {
+		log.Printf("failed to find followers of %s: %v", board, err)
+		return boards
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			boards = append(boards, id)
+		}
+	}
+
+	return boards
+}
+
+// Hold keeps a post from being shown until it is released.
+// It must be called before the post is written.
+func (obj *ObjectBase) Hold() {
+	obj.Type = heldType
+}
+
+// IsHeld reports whether a post is waiting to be looked at.
+func (obj ObjectBase) IsHeld() bool {
+	return obj.Type == heldType
+}
+
+// KeepHeld remembers who a held local post is addressed to and how it was
+// posted, which isn't stored with posts, so that it can be published as it
+// would have been once it's released.
+func (obj ObjectBase) KeepHeld() error {
+	query := `insert into held (id, recipients, cc, options) values ($1, $2, $3, $4) on conflict (id) do update set recipients=$2, cc=$3, options=$4`
+	_, err := config.DB.Exec(query, obj.Id, strings.Join(obj.To, ","), strings.Join(obj.Cc, ","), strings.Join(obj.Option, ","))
+	return util.WrapError(err)
+}
+
+// Release shows a held post, bumping its thread as it would have when it was
+// posted, and returns it as it was posted.
+func (obj ObjectBase) Release() (ObjectBase, error) {
+	query := `update activitystream set type='Note' where id=$1 and type=$2`
+	if _, err := config.DB.Exec(query, obj.Id, heldType); err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	query = `update cacheactivitystream set type='Note' where id=$1 and type=$2`
+	if _, err := config.DB.Exec(query, obj.Id, heldType); err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	post, err := obj.GetPost()
+	if err != nil {
+		return post, util.WrapError(err)
+	}
+
+	if post.InReplyTo, err = post.GetInReplyTo(); err != nil {
+		return post, util.WrapError(err)
+	}
+
+	// Only local posts are kept.
+	var to, cc, options string
+	query = `select recipients, cc, options from held where id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&to, &cc, &options); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return post, util.WrapError(err)
+	}
+
+	post.To, post.Cc, post.Option = splitList(to), splitList(cc), splitList(options)
+
+	if _, err := config.DB.Exec(`delete from held where id=$1`, obj.Id); err != nil {
+		return post, util.WrapError(err)
+	}
+
+	if util.IsInStringArray(post.Option, "sage") || util.IsInStringArray(post.Option, "nokosage") {
+		return post, nil
+	}
+
+	for _, e := range post.InReplyTo {
+		if e.Id == "" {
+			continue
+		}
+
+		if bumpLimit, _, err := e.ThreadLimits(); err != nil {
+			return post, util.WrapError(err)
+		} else if !bumpLimit {
+			if err := e.WriteUpdate(time.Now().UTC()); err != nil {
+				return post, util.WrapError(err)
+			}
+		}
+	}
+
+	return post, nil
+}
+
+// Reject removes a held post without it ever being shown.
+func (obj ObjectBase) Reject() error {
+	if _, err := config.DB.Exec(`delete from held where id=$1`, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	if isOP, _ := obj.CheckIfOP(); isOP {
+		return obj.TombstoneReplies()
+	}
+
+	return obj.Tombstone()
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+
+	return strings.Split(list, ",")
+}
+
+// HeldPosts returns every post waiting to be looked at, oldest first.
+func HeldPosts() ([]ObjectBase, error) {
+	var posts []ObjectBase
+
+	query := `select x.id, x.name, x.content, x.attributedto, x.actor, x.published from (select id, name, content, attributedto, actor, published from activitystream where type=$1 union select id, name, content, attributedto, actor, published from cacheactivitystream where type=$1) as x order by x.published asc`
+	rows, err := config.DB.Query(query, heldType)
+	if err != nil {
+		return posts, util.WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		post := ObjectBase{Type: heldType}
+		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.AttributedTo, &post.Actor, &post.Published); err != nil {
+			return posts, util.WrapError(err)
+		}
+
+		posts = append(posts, post)
+	}
+
+	return posts, util.WrapError(rows.Err())
+}
+
+// GetHeldPost returns a held post, for it to be released.
+func GetHeldPost(id string) (ObjectBase, error) {
+	var post ObjectBase
+
+	query := `select x.id, x.actor from (select id, actor from activitystream where id=$1 and type=$2 union select id, actor from cacheactivitystream where id=$1 and type=$2) as x`
+	if err := config.DB.QueryRow(query, id, heldType).Scan(&post.Id, &post.Actor); err != nil {
+		return post, util.WrapError(err)
+	}
+
+	post.Type = heldType
+	return post, nil
+}
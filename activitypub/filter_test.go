@@ -0,0 +1,142 @@
+package activitypub
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// withFilters sets the filters in use for the duration of a test.
+func withFilters(t *testing.T, list ...Filter) {
+	var compiled []*Filter
+	for i := range list {
+		f := &list[i]
+		if err := f.compile(); err != nil {
+			t.Fatalf("compile(%q) = %v", f.Pattern, err)
+		}
+
+		compiled = append(compiled, f)
+	}
+
+	filters.Lock()
+	old := filters.list
+	filters.list = compiled
+	filters.Unlock()
+
+	t.Cleanup(func() {
+		filters.Lock()
+		filters.list = old
+		filters.Unlock()
+	})
+}
+
+func TestFilterCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		f    Filter
+		ok   bool
+	}{
+		{"valid", Filter{Pattern: "spam", Action: FilterBlock, Comment: true}, true},
+		{"empty pattern", Filter{Action: FilterBlock, Comment: true}, false},
+		{"long pattern", Filter{Pattern: strings.Repeat("a", maxFilterPattern+1), Action: FilterBlock, Comment: true}, false},
+		{"long replacement", Filter{Pattern: "a", Action: FilterReplace, Replacement: strings.Repeat("b", maxFilterReplacement+1), Comment: true}, false},
+		{"unknown action", Filter{Pattern: "a", Action: "ban", Comment: true}, false},
+		{"matches nothing", Filter{Pattern: "a", Action: FilterBlock}, false},
+		{"bad pattern", Filter{Pattern: "(a", Action: FilterBlock, Comment: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.f.compile()
+			if tt.ok && err != nil {
+				t.Errorf("compile() = %v, want nil", err)
+			} else if !tt.ok && !errors.Is(err, ErrBadFilter) {
+				t.Errorf("compile() = %v, want ErrBadFilter", err)
+			}
+		})
+	}
+}
+
+func TestRunFilters(t *testing.T) {
+	withFilters(t,
+		Filter{ID: 1, Pattern: "(?i)spam", Action: FilterBlock, Comment: true},
+		Filter{ID: 2, Pattern: "foo", Action: FilterReplace, Replacement: "bar", Name: true, Comment: true},
+		Filter{ID: 3, Pattern: "^sage$", Action: FilterSage, Subject: true},
+		Filter{ID: 4, Pattern: "hold me", Action: FilterHold, Comment: true},
+		Filter{ID: 5, Pattern: "board", Action: FilterSensitive, Board: "https://example.com/a", Comment: true},
+		Filter{ID: 6, Pattern: "grow", Action: FilterReplace, Replacement: strings.Repeat("x", 200), Comment: true},
+	)
+
+	tests := []struct {
+		name    string
+		in      [3]string
+		board   string
+		out     [3]string
+		block   bool
+		sage    bool
+		hold    bool
+		sens    bool
+		tooLong bool
+		matched []int
+	}{
+		{"nothing", [3]string{"Anonymous", "hi", "hello"}, "", [3]string{"Anonymous", "hi", "hello"}, false, false, false, false, false, nil},
+		{"block", [3]string{"", "", "buy SPAM"}, "", [3]string{"", "", "buy SPAM"}, true, false, false, false, false, []int{1}},
+		{"replace", [3]string{"foo", "foo", "foo foo"}, "", [3]string{"bar", "foo", "bar bar"}, false, false, false, false, false, []int{2}},
+		{"sage", [3]string{"", "sage", "sage"}, "", [3]string{"", "sage", "sage"}, false, true, false, false, false, []int{3}},
+		{"hold", [3]string{"", "", "please hold me"}, "", [3]string{"", "", "please hold me"}, false, false, true, false, false, []int{4}},
+		{"board", [3]string{"", "", "board"}, "https://example.com/a", [3]string{"", "", "board"}, false, false, false, true, false, []int{5}},
+		{"other board", [3]string{"", "", "board"}, "https://example.com/b", [3]string{"", "", "board"}, false, false, false, false, false, nil},
+		{"too long", [3]string{"", "", strings.Repeat("grow", 30)}, "", [3]string{"", "", strings.Repeat(strings.Repeat("x", 200), 30)}, false, false, false, false, true, []int{6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := runFilters(tt.in[0], tt.in[1], tt.in[2], []string{tt.board})
+
+			if out := [3]string{res.Name, res.Subject, res.Comment}; out != tt.out {
+				t.Errorf("runFilters() = %q, want %q", out, tt.out)
+			}
+
+			if res.Block != tt.block || res.Sage != tt.sage || res.Hold != tt.hold || res.Sensitive != tt.sens || res.TooLong != tt.tooLong {
+				t.Errorf("runFilters() block, sage, hold, sensitive, too long = %v, %v, %v, %v, %v, want %v, %v, %v, %v, %v",
+					res.Block, res.Sage, res.Hold, res.Sensitive, res.TooLong, tt.block, tt.sage, tt.hold, tt.sens, tt.tooLong)
+			}
+
+			var matched []int
+			for _, f := range res.Matched {
+				matched = append(matched, f.ID)
+			}
+
+			if len(matched) != len(tt.matched) {
+				t.Fatalf("matched %v, want %v", matched, tt.matched)
+			}
+
+			for i := range matched {
+				if matched[i] != tt.matched[i] {
+					t.Errorf("matched %v, want %v", matched, tt.matched)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"", 0, ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
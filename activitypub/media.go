@@ -0,0 +1,308 @@
+package activitypub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// How far into a video its preview is taken from, unless it's shorter.
+const previewOffset = 3.0
+
+// How long fetching remote media to check it may take, unless it's routed
+// through a proxy with its own timeout.
+const remoteMediaTimeout = 30 * time.Second
+
+// IsMediaBanned decides whether media with the SHA-256 hash is banned, also
+// by what it looks like in data unless that's nil.
+// Bans are kept by db, which is set here at startup.
+var IsMediaBanned = func(hash string, data []byte) (bool, error) {
+	return false, nil
+}
+
+// WithMediaInfo returns the attachment with its dimensions, and its duration
+// if it plays, read from its local file.
+// Anything that can't be read is left unset.
+func (obj ObjectBase) WithMediaInfo() ObjectBase {
+	file := localFile(obj.Href)
+	if file == "" {
+		return obj
+	}
+
+	if w, h, d, err := probeMedia(file); err == nil {
+		obj.Width, obj.Height = w, h
+
+		// Still images have a duration too, but it means nothing.
+		if !strings.HasPrefix(obj.MediaType, "image/") {
+			obj.Duration = Duration(d)
+		}
+
+		return obj
+	}
+
+	// ffprobe may not be installed; we can still manage most images.
+	if strings.HasPrefix(obj.MediaType, "image/") {
+		if f, err := os.Open(file); err == nil {
+			defer f.Close()
+
+			if c, _, err := image.DecodeConfig(f); err == nil {
+				obj.Width, obj.Height = c.Width, c.Height
+			}
+		}
+	}
+
+	return obj
+}
+
+// BackfillMediaInfo reads how large and how long the local files posted before
+// we kept track are.
+// Files are only probed once; anything ffprobe can't read is recorded as
+// unknown.
+func BackfillMediaInfo() {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return
+	}
+
+	query := `select id, href, mediatype from activitystream where href like $1 and (mediatype like 'video/%' or mediatype like 'audio/%') and duration is null`
+	rows, err := config.DB.Query(query, config.Domain+"/public/%")
+	if err != nil {
+		log.Printf("failed to find media to backfill: %v", err)
+		return
+	}
+
+	var files []ObjectBase
+	for rows.Next() {
+		var obj ObjectBase
+		if err := rows.Scan(&obj.Id, &obj.Href, &obj.MediaType); err != nil {
+			rows.Close()
+			log.Printf("failed to find media to backfill: %v", err)
+			return
+		}
+
+		files = append(files, obj)
+	}
+	rows.Close()
+
+	for _, e := range files {
+		e = e.WithMediaInfo()
+
+		query := `update activitystream set width=coalesce(width, nullif($1, 0)), height=coalesce(height, nullif($2, 0)), duration=$3 where id=$4`
+		if _, err := config.DB.Exec(query, e.Width, e.Height, e.Duration, e.Id); err != nil {
+			log.Printf("failed to backfill %s: %v", e.Id, err)
+			return
+		}
+	}
+
+	if len(files) > 0 {
+		log.Printf("read the size and duration of %d files", len(files))
+	}
+}
+
+// localFile returns where the file behind href is kept, or an empty string if
+// it isn't ours.
+func localFile(href string) string {
+	if name := strings.TrimPrefix(href, config.Domain+"/tmp/"); name != href {
+		return tempDir + "/" + name
+	} else if !strings.HasPrefix(href, config.Domain+"/public/") {
+		return ""
+	}
+
+	return "." + strings.TrimPrefix(href, config.Domain)
+}
+
+// probeMedia reads the dimensions of the first video stream of file, and its
+// duration, using ffprobe.
+func probeMedia(file string) (int, int, float64, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=codec_type,width,height:stream_disposition=attached_pic:format=duration", "-of", "json", file).Output()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			Width       int    `json:"width"`
+			Height      int    `json:"height"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, 0, 0, err
+	}
+
+	var w, h int
+	for _, s := range probe.Streams {
+		// Cover art isn't what the file looks like when it plays.
+		if s.CodecType == "video" && s.Disposition.AttachedPic == 0 {
+			w, h = s.Width, s.Height
+			break
+		}
+	}
+
+	d, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	return w, h, d, nil
+}
+
+// framePreview writes a frame of a video, or the cover art of audio, to out
+// with ffmpeg, shrunk to fit the same size as image previews.
+func framePreview(file, out string, offset float64) error {
+	args := []string{"-v", "error"}
+	if offset > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%.2f", offset))
+	}
+
+	args = append(args, "-i", file, "-map", "0:v:0", "-frames:v", "1", "-vf", "scale=250:250:force_original_aspect_ratio=decrease", "-y", out)
+	if err := exec.Command("ffmpeg", args...).Run(); err != nil {
+		return err
+	}
+
+	// ffmpeg succeeds without writing anything if the offset is past the
+	// end.
+	if fi, err := os.Stat(out); err != nil || fi.Size() == 0 {
+		os.Remove(out)
+		return fmt.Errorf("ffmpeg didn't write a frame of %s", file)
+	}
+
+	return nil
+}
+
+// errRemoteTooLarge is returned for remote media larger than we're willing to
+// read.
+var errRemoteTooLarge = errors.New("remote media is too large")
+
+// fetchRemoteMedia downloads the media at href, returning its hash and size,
+// and what it contains if it's no larger than we would take from our own
+// posters.
+// Nothing past config.MaxRemoteMedia is read.
+func fetchRemoteMedia(href string) (string, []byte, int64, error) {
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return "", nil, 0, util.WrapError(err)
+	}
+
+	if util.ProxyFor(req.URL.Host, util.Proxies) == nil {
+		ctx, cancel := context.WithTimeout(req.Context(), remoteMediaTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := util.RouteProxy(req)
+	if err != nil {
+		return "", nil, 0, util.WrapError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", nil, 0, fmt.Errorf("non 200 status code (%d)", resp.StatusCode)
+	}
+
+	h := sha256.New()
+	data, err := io.ReadAll(io.TeeReader(io.LimitReader(resp.Body, int64(config.MaxFileSize)+1), h))
+	if err != nil {
+		return "", nil, 0, util.WrapError(err)
+	}
+
+	size := int64(len(data))
+	if size > int64(config.MaxFileSize) {
+		rest, err := io.Copy(h, io.LimitReader(resp.Body, config.MaxRemoteMedia-size+1))
+		if err != nil {
+			return "", nil, 0, util.WrapError(err)
+		}
+
+		data, size = nil, size+rest
+		if size > config.MaxRemoteMedia {
+			return "", nil, 0, errRemoteTooLarge
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), data, size, nil
+}
+
+// Remote media is checked in the background once its post is cached, as
+// fetching it can take a while and peers shouldn't be kept waiting on it.
+// Posts that don't fit in the queue are only checked as their media is shown.
+var remoteChecks = make(chan ObjectBase, 256)
+
+// queueRemoteMedia queues the media of a cached post to be checked.
+func (obj ObjectBase) queueRemoteMedia() {
+	select {
+	case remoteChecks <- obj:
+	default:
+		log.Printf("too much media waiting to be checked, skipping %s", obj.Id)
+	}
+}
+
+// CheckRemoteMedia checks the media of cached posts as they're queued, and
+// removes the posts any of it is banned from.
+func CheckRemoteMedia() {
+	for obj := range remoteChecks {
+		if banned, err := obj.checkRemoteMedia(); err != nil {
+			log.Printf("failed to check media of %s: %v", obj.Id, err)
+		} else if banned {
+			log.Printf("%s has banned media", obj.Id)
+
+			if err := obj.deleteCached(); err != nil {
+				log.Printf("failed to remove %s: %v", obj.Id, err)
+			}
+		}
+	}
+}
+
+// checkRemoteMedia fetches the media of a cached post to find out whether
+// any of it is banned, and records the size of each attachment as what it
+// really is.
+func (obj ObjectBase) checkRemoteMedia() (bool, error) {
+	for _, e := range obj.Attachment {
+		if e.Href == "" || localFile(e.Href) != "" {
+			continue
+		}
+
+		hash, data, size, err := fetchRemoteMedia(e.Href)
+		if err != nil {
+			// It's checked again whenever it's shown.
+			log.Printf("failed to check media of %s: %v", obj.Id, err)
+			continue
+		}
+
+		if size != e.Size {
+			query := `update cacheactivitystream set size=$1 where id=$2`
+			if _, err := config.DB.Exec(query, size, e.Id); err != nil {
+				return false, util.WrapError(err)
+			}
+
+			countMedia(obj.Actor, size-e.Size)
+		}
+
+		if banned, err := IsMediaBanned(hash, data); err != nil {
+			return false, util.WrapError(err)
+		} else if banned {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,419 @@
+package activitypub
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// moves maps the old ID of every moved local actor to its new ID.
+// It's read while handling requests and changed by staff, so it's locked.
+var moves struct {
+	sync.RWMutex
+	m map[string]string
+}
+
+// movedColumns lists every column that can hold a local ID.
+// Board-scoped tables are also cleared by DeleteBoard; a table added here
+// likely needs adding there too, and the other way around.
+var movedColumns = []struct{ table, column string }{
+	{"activitystream", "id"},
+	{"activitystream", "actor"},
+	{"activitystream", "attachment"},
+	{"activitystream", "preview"},
+	{"activitystream", "attributedto"},
+	{"activitystream", "href"},
+	{"cacheactivitystream", "actor"},
+	{"replies", "id"},
+	{"replies", "inreplyto"},
+	{"actor", "id"},
+	{"actor", "inbox"},
+	{"actor", "outbox"},
+	{"actor", "following"},
+	{"actor", "followers"},
+	{"actor", "publickeypem"},
+	{"boardsettings", "id"},
+	{"publickeypem", "id"},
+	{"publickeypem", "owner"},
+	{"sticky", "actor_id"},
+	{"sticky", "activity_id"},
+	{"locked", "actor_id"},
+	{"locked", "activity_id"},
+	{"following", "id"},
+	{"following", "following"},
+	{"follower", "id"},
+	{"follower", "follower"},
+	{"reported", "id"},
+	{"reported", "board"},
+	{"removed", "id"},
+	{"attachments", "id"},
+	{"attachments", "attachment"},
+	{"attachments", "preview"},
+	{"postpassword", "id"},
+	{"archived", "id"},
+	{"archived", "board"},
+	{"poster", "id"},
+	{"poster", "board"},
+	{"bans", "board"},
+	{"bans", "post"},
+	{"postnumber", "id"},
+	{"postnumber", "board"},
+	{"held", "id"},
+	{"postcounter", "board"},
+	{"citations", "id"},
+	{"citations", "cites"},
+	{"filters", "board"},
+	{"originality", "board"},
+	{"originalitymutes", "board"},
+	{"moved", "newid"},
+}
+
+func LoadMoves() error {
+	rows, err := config.DB.Query(`select oldid, newid from moved`)
+	if err != nil {
+		return util.WrapError(err)
+	}
+	defer rows.Close()
+
+	m := make(map[string]string)
+
+	for rows.Next() {
+		var from, to string
+		if err := rows.Scan(&from, &to); err != nil {
+			return util.WrapError(err)
+		}
+
+		m[from] = to
+	}
+
+	moves.Lock()
+	moves.m = m
+	moves.Unlock()
+
+	return nil
+}
+
+// MovedLocation returns the current location of id if it, or the actor it
+// belongs to, has been moved.
+func MovedLocation(id string) (string, bool) {
+	sid := util.StripTransferProtocol(id)
+
+	moves.RLock()
+	defer moves.RUnlock()
+
+	for from, to := range moves.m {
+		sfrom := util.StripTransferProtocol(from)
+		if sid != sfrom && !strings.HasPrefix(sid, sfrom+"/") {
+			continue
+		}
+
+		loc := to + sid[len(sfrom):]
+		if util.StripTransferProtocol(loc) == sid {
+			// Only the transfer protocol changed, which isn't ours to
+			// redirect.
+			continue
+		}
+
+		return loc, true
+	}
+
+	return "", false
+}
+
+// DeleteMove forgets that id was moved, so it may be used again.
+func DeleteMove(id string) error {
+	if _, err := config.DB.Exec(`delete from moved where oldid=$1`, id); err != nil {
+		return util.WrapError(err)
+	}
+
+	moves.Lock()
+	delete(moves.m, id)
+	moves.Unlock()
+
+	return nil
+}
+
+// Aliases returns the IDs this actor was previously known as.
+func (actor Actor) Aliases() []string {
+	var aliases []string
+
+	moves.RLock()
+	defer moves.RUnlock()
+
+	for from, to := range moves.m {
+		if actor.Id == to || strings.HasPrefix(actor.Id, to+"/") {
+			aliases = append(aliases, from+actor.Id[len(to):])
+		}
+	}
+
+	return aliases
+}
+
+// moveIDs rewrites every local ID that starts with from to start with to
+// instead, and remembers the move so the old IDs can be redirected.
+func moveIDs(tx *sql.Tx, from, to string) error {
+	for _, c := range movedColumns {
+		query := fmt.Sprintf(`update %[1]s set %[2]s = $2 || substr(%[2]s, length($1) + 1) where %[2]s = $1 or left(%[2]s, length($1) + 1) in ($1 || '/', $1 || '#')`, c.table, c.column)
+		if _, err := tx.Exec(query, from, to); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	// Moving back to an old ID shouldn't redirect to itself.
+	if _, err := tx.Exec(`delete from moved where oldid=$1`, to); err != nil {
+		return util.WrapError(err)
+	}
+
+	query := `insert into moved (oldid, newid) values ($1, $2) on conflict (oldid) do update set newid=excluded.newid`
+	_, err := tx.Exec(query, from, to)
+	return util.WrapError(err)
+}
+
+// MoveBoard renames a local board, keeping its posts, keys and followers.
+func MoveBoard(actor Actor, name string) error {
+	if actor.Id == config.Domain {
+		return errors.New("cannot move the instance actor")
+	}
+
+	from := actor.Id
+	to := config.Domain + "/" + name
+
+	if _, err := GetActorFromDB(to); err == nil {
+		return errors.New("board already exists")
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := moveIDs(tx, from, to); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	if _, err := tx.Exec(`update actor set name=$1 where id=$2`, name, to); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	if _, err := tx.Exec(`update reported set board=$1 where board=$2`, name, actor.Name); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	// Key pairs are named after the board, so they have to follow it or a new
+	// board with the old name would overwrite them.
+	oldPem, newPem := "./pem/board/"+actor.Name, "./pem/board/"+name
+	if _, err := tx.Exec(`update publickeypem set file=$1 where owner=$2`, newPem+"-public.pem", to); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	if err := os.Rename(oldPem+"-private.pem", newPem+"-private.pem"); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	if err := os.Rename(oldPem+"-public.pem", newPem+"-public.pem"); err != nil {
+		os.Rename(newPem+"-private.pem", oldPem+"-private.pem")
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		os.Rename(newPem+"-private.pem", oldPem+"-private.pem")
+		os.Rename(newPem+"-public.pem", oldPem+"-public.pem")
+		return util.WrapError(err)
+	}
+
+	if err := LoadMoves(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := LoadFilters(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := reloadBoards(); err != nil {
+		return util.WrapError(err)
+	}
+
+	announceMove(from, to)
+	return nil
+}
+
+// MoveInstance moves the instance, along with every board on it, from its old
+// domain to config.Domain.
+// Followers are told once SendMoves is called.
+func MoveInstance(from string) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := moveIDs(tx, from, config.Domain); err != nil {
+		tx.Rollback()
+		return util.WrapError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := LoadMoves(); err != nil {
+		return util.WrapError(err)
+	}
+
+	rows, err := config.DB.Query(`select id from actor where id != $1`, config.Domain)
+	if err != nil {
+		return util.WrapError(err)
+	}
+	defer rows.Close()
+
+	var boards []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return util.WrapError(err)
+		}
+
+		boards = append(boards, id)
+	}
+
+	for _, id := range boards {
+		announceMove(from+id[len(config.Domain):], id)
+	}
+
+	return nil
+}
+
+// Whoever receives a Move checks it by fetching the actor it's to, so moves
+// are only sent once we're serving it.
+var announced struct {
+	sync.Mutex
+	listening bool
+	moves     [][2]string
+}
+
+// announceMove tells the followers of a local actor that it moved, as soon as
+// we're listening.
+func announceMove(from, to string) {
+	announced.Lock()
+	defer announced.Unlock()
+
+	if !announced.listening {
+		announced.moves = append(announced.moves, [2]string{from, to})
+		return
+	}
+
+	go sendMoves([][2]string{{from, to}})
+}
+
+// SendMoves sends the moves made before we were listening, and lets any made
+// from now on be sent right away.
+func SendMoves() {
+	announced.Lock()
+	moves := announced.moves
+	announced.moves = nil
+	announced.listening = true
+	announced.Unlock()
+
+	sendMoves(moves)
+}
+
+func sendMoves(moves [][2]string) {
+	for _, e := range moves {
+		// Not being able to tell followers is unfortunate, but the move
+		// itself has already happened.
+		if err := sendMove(e[0], e[1]); err != nil {
+			log.Printf("failed to send move for %s: %v", e[1], err)
+		}
+	}
+}
+
+// sendMove tells the followers of a local actor that it moved from one ID to
+// another.
+func sendMove(from, to string) error {
+	actor, err := GetActorFromDB(to)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	followers, err := actor.GetFollower()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	// The old actor is the one moving, but it signs with the key it has now.
+	moving := actor
+	moving.Id = from
+	moving.MovedTo = to
+
+	var activity Activity
+	activity.AtContext.Context = "https://www.w3.org/ns/activitystreams"
+	activity.Type = "Move"
+	activity.Actor = &moving
+	activity.Object.Id = from
+	activity.Target = to
+
+	for _, e := range followers {
+		activity.To = append(activity.To, e.Id)
+	}
+
+	return activity.Send()
+}
+
+// ProcessMove handles a Move activity from a remote actor by pointing our
+// relationships with it to its new ID.
+func (activity Activity) ProcessMove() error {
+	from := activity.Object.Id
+	if from == "" {
+		from = activity.Actor.Id
+	}
+
+	if from != activity.Actor.Id || activity.Target == "" {
+		return errors.New("invalid move activity")
+	}
+
+	// A Move alone proves nothing; the new actor has to claim the old one,
+	// and we ask its instance rather than anything cached to be sure it does.
+	target, err := fetchActor(activity.Target)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if target.Id != activity.Target || !util.IsInStringArray(target.AlsoKnownAs, from) {
+		return errors.New("move target does not claim the moving actor")
+	}
+
+	// Cached copies are keyed without the transfer protocol and would hide
+	// the new actor from us.
+	name, instance := GetActorAndInstance(from)
+	uncacheActor(name, instance)
+	name, instance = GetActorAndInstance(target.Id)
+	cacheActor(name, instance, target)
+
+	if _, err := config.DB.Exec(`update following set following=$2 where following=$1`, from, target.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	if _, err := config.DB.Exec(`update follower set follower=$2 where follower=$1`, from, target.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	if _, err := config.DB.Exec(`update cacheactivitystream set actor=$2 where actor=$1`, from, target.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	log.Printf("%s moved to %s", from, target.Id)
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package activitypub
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// withMoves sets the moves known for the duration of a test.
+func withMoves(t *testing.T, m map[string]string) {
+	moves.Lock()
+	old := moves.m
+	moves.m = m
+	moves.Unlock()
+
+	t.Cleanup(func() {
+		moves.Lock()
+		moves.m = old
+		moves.Unlock()
+	})
+}
+
+func TestMovedLocation(t *testing.T) {
+	withMoves(t, map[string]string{
+		"https://old.example/a": "https://old.example/b",
+		"http://tp.example":     "https://tp.example",
+		"https://gone.example":  "https://new.example",
+	})
+
+	tests := []struct {
+		name string
+		id   string
+		loc  string
+		ok   bool
+	}{
+		{"board", "https://old.example/a", "https://old.example/b", true},
+		{"post on board", "https://old.example/a/123", "https://old.example/b/123", true},
+		{"without protocol", "old.example/a/123", "https://old.example/b/123", true},
+		{"same prefix", "https://old.example/ab", "", false},
+		{"other board", "https://old.example/c", "", false},
+		{"only protocol", "https://tp.example/a", "", false},
+		{"instance", "https://gone.example/a/1", "https://new.example/a/1", true},
+		{"unknown", "https://else.example/a", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, ok := MovedLocation(tt.id)
+			if loc != tt.loc || ok != tt.ok {
+				t.Errorf("MovedLocation(%q) = %q, %v, want %q, %v", tt.id, loc, ok, tt.loc, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAliases(t *testing.T) {
+	withMoves(t, map[string]string{
+		"https://old.example/a":  "https://new.example/b",
+		"https://old.example/aa": "https://new.example/bb",
+		"https://older.example":  "https://new.example",
+	})
+
+	tests := []struct {
+		name string
+		id   string
+		want []string
+	}{
+		{"board", "https://new.example/b", []string{"https://old.example/a", "https://older.example/b"}},
+		{"same prefix", "https://new.example/bb", []string{"https://old.example/aa", "https://older.example/bb"}},
+		{"instance", "https://new.example", []string{"https://older.example"}},
+		{"never moved", "https://other.example/b", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Actor{Id: tt.id}.Aliases()
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Aliases() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
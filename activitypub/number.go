@@ -0,0 +1,48 @@
+package activitypub
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Local posts are numbered in the order they were made on their board, as
+// people are used to quoting by number.
+// The numbers are only for us; IDs are still what identifies a post
+// everywhere else.
+
+// writeNumber gives a new local post the next number of its board.
+func (obj ObjectBase) writeNumber() (int, error) {
+	var n int
+
+	// Taking the number and claiming it in one statement means two posts
+	// can't end up with the same one.
+	query := `with counter as (insert into postcounter (board, last) values ($1, 1) on conflict (board) do update set last = postcounter.last + 1 returning last) insert into postnumber (id, board, number) select $2, $1, last from counter returning number`
+	err := config.DB.QueryRow(query, obj.Actor, obj.Id).Scan(&n)
+	return n, util.WrapError(err)
+}
+
+// GetNumber returns the number of a local post, or 0 if it doesn't have one.
+func (obj ObjectBase) GetNumber() (int, error) {
+	var n int
+
+	query := `select number from postnumber where id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&n); errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, util.WrapError(err)
+	}
+
+	return n, nil
+}
+
+// GetPostByNumber returns the ID of the post numbered n on a board.
+func (actor Actor) GetPostByNumber(n int) (string, error) {
+	var id string
+
+	query := `select id from postnumber where board=$1 and number=$2`
+	err := config.DB.QueryRow(query, actor.Id, n).Scan(&id)
+	return id, util.WrapError(err)
+}
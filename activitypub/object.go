@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"math"
 	"net/smtp"
 	"os"
 	"os/exec"
@@ -106,32 +108,82 @@ func (obj ObjectBase) CreatePreview() *ObjectBase {
 	re := regexp.MustCompile(`/.+$`)
 	mimetype := re.ReplaceAllString(obj.MediaType, "")
 
-	if mimetype != "image" {
+	re = regexp.MustCompile(`/public/.+`)
+	objFile := re.FindString(obj.Href)
+
+	var tmp string
+
+	switch mimetype {
+	case "image":
+		re = regexp.MustCompile(`.+/`)
+		file := re.ReplaceAllString(obj.MediaType, "")
+
+		f, err := tempMedia(mediaExtension(obj.MediaType, "."+file))
+		if err != nil {
+			return &nPreview
+		}
+		f.Close()
+		tmp = f.Name()
+
+		cmd := exec.Command("convert", "."+objFile, "-resize", "250x250>", "-strip", tmp)
+
+		if err := cmd.Run(); err != nil {
+			// TODO: previously we would call CheckError here
+			os.Remove(tmp)
+			var preview ObjectBase
+			return &preview
+		}
+
+		nPreview.MediaType = obj.MediaType
+	case "video", "audio":
+		f, err := tempMedia("jpg")
+		if err != nil {
+			return &nPreview
+		}
+		f.Close()
+		tmp = f.Name()
+
+		// Videos often fade in, so skip a little of them.
+		// Audio only has its cover art to show.
+		var offset float64
+		if mimetype == "video" {
+			offset = math.Min(previewOffset, float64(obj.Duration)/2)
+		}
+
+		if err := framePreview("."+objFile, tmp, offset); err != nil {
+			os.Remove(tmp)
+			return &nPreview
+		}
+
+		nPreview.MediaType = "image/jpeg"
+	default:
 		return &nPreview
 	}
 
-	re = regexp.MustCompile(`.+/`)
-	file := re.ReplaceAllString(obj.MediaType, "")
-	href := util.GetUniqueFilename(file)
+	// Previews of the same file come out the same, so they're shared too.
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return &ObjectBase{}
+	}
+
+	sum, err := hashMedia(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return &ObjectBase{}
+	}
+
+	href, err := storeMedia(tmp, sum)
+	if err != nil {
+		os.Remove(tmp)
+		return &ObjectBase{}
+	}
 
 	nPreview.Type = "Preview"
 	nPreview.Name = obj.Name
-	nPreview.Href = config.Domain + "" + href
-	nPreview.MediaType = obj.MediaType
-	nPreview.Size = obj.Size
+	nPreview.Href = href
+	nPreview.Size = fi.Size()
 	nPreview.Published = obj.Published
 
-	re = regexp.MustCompile(`/public/.+`)
-	objFile := re.FindString(obj.Href)
-
-	cmd := exec.Command("convert", "."+objFile, "-resize", "250x250>", "-strip", "."+href)
-
-	if err := cmd.Run(); err != nil {
-		// TODO: previously we would call CheckError here
-		var preview ObjectBase
-		return &preview
-	}
-
 	return &nPreview
 }
 
@@ -177,68 +229,155 @@ func (obj ObjectBase) DeleteAndRepliesRequest() error {
 
 // TODO break this off into seperate for Cache
 func (obj ObjectBase) DeleteAttachment() error {
-	query := `delete from activitystream where id in (select attachment from activitystream where id=$1)`
+	query := `delete from activitystream where id in (select attachment from attachments where id=$1)`
 	if _, err := config.DB.Exec(query, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `delete from cacheactivitystream where id in (select attachment from cacheactivitystream where id=$1)`
+	query = `delete from cacheactivitystream where id in (select attachment from attachments where id=$1)`
 	_, err := config.DB.Exec(query, obj.Id)
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) DeleteAttachmentFromFile() error {
-	var href string
-
-	query := `select href from activitystream where id in (select attachment from activitystream where id=$1)`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&href); err != nil {
-		return nil
-	}
-
-	href = strings.Replace(href, config.Domain+"/", "", 1)
-	if href != "static/notfound.png" {
-		if _, err := os.Stat(href); err != nil {
-			return nil
-		}
-		return os.Remove(href)
-	}
-
-	return nil
+	query := `select href from activitystream where id in (select attachment from attachments where id=$1)`
+	return deleteFiles(query, obj.Id)
 }
 
 // TODO break this off into seperate for Cache
 func (obj ObjectBase) DeletePreview() error {
-	query := `delete from activitystream where id=$1`
+	query := `delete from activitystream where id in (select preview from attachments where id=$1)`
 
 	if _, err := config.DB.Exec(query, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `delete from cacheactivitystream where id in (select preview from cacheactivitystream where id=$1)`
+	query = `delete from cacheactivitystream where id in (select preview from attachments where id=$1)`
 
 	_, err := config.DB.Exec(query, obj.Id)
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) DeletePreviewFromFile() error {
-	var href string
+	query := `select href from activitystream where id in (select preview from attachments where id=$1)`
+	return deleteFiles(query, obj.Id)
+}
 
-	query := `select href from activitystream where id in (select preview from activitystream where id=$1)`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&href); err != nil {
-		return nil
+// localFiles returns the local files behind every href query returns.
+func localFiles(query string, args ...interface{}) ([]string, error) {
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return nil, util.WrapError(err)
 	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var href string
+		if err := rows.Scan(&href); err != nil {
+			return nil, util.WrapError(err)
+		}
+
+		href = strings.Replace(href, config.Domain+"/", "", 1)
+		if href == "static/notfound.png" {
+			continue
+		}
 
-	href = strings.Replace(href, config.Domain+"/", "", 1)
-	if href != "static/notfound.png" {
 		if _, err := os.Stat(href); err != nil {
-			return nil
+			continue
+		}
+
+		files = append(files, href)
+	}
+
+	return files, nil
+}
+
+// deleteFiles removes the local files behind every href query returns, except
+// those other posts still use.
+func deleteFiles(query string, args ...interface{}) error {
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	// How many of the rows using each file are going away.
+	uses := make(map[string]int)
+	for rows.Next() {
+		var href string
+		if err := rows.Scan(&href); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		uses[href]++
+	}
+	rows.Close()
+
+	media.Lock()
+	defer media.Unlock()
+
+	unused, err := unusedFiles(uses, func(href string) (int, error) {
+		var total int
+		err := config.DB.QueryRow(`select count(*) from activitystream where href=$1`, href).Scan(&total)
+		return total, err
+	})
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, file := range unused {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return util.WrapError(err)
 		}
-		return os.Remove(href)
 	}
 
 	return nil
 }
 
+// unusedFiles returns the local files of the hrefs in uses that nothing will
+// use once that many of the rows using each are gone; total counts every row
+// using an href.
+// The media lock must be held.
+func unusedFiles(uses map[string]int, total func(href string) (int, error)) ([]string, error) {
+	var files []string
+
+	for href, n := range uses {
+		file := strings.Replace(href, config.Domain+"/", "", 1)
+		if file == "static/notfound.png" || isPending(href) {
+			continue
+		}
+
+		if t, err := total(href); err != nil {
+			return nil, util.WrapError(err)
+		} else if t > n {
+			continue
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// mediaFiles returns the local files of a post and how large each is.
+func (obj ObjectBase) mediaFiles() (map[string]int64, error) {
+	query := `select href from activitystream where id in (select attachment from attachments where id=$1 union select preview from attachments where id=$1)`
+	files, err := localFiles(query, obj.Id)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	sizes := make(map[string]int64)
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			sizes[file] = fi.Size()
+		}
+	}
+
+	return sizes, nil
+}
+
 func (obj ObjectBase) DeleteAll() error {
 	if err := obj.DeleteReported(); err != nil {
 		return util.WrapError(err)
@@ -274,6 +413,41 @@ func (obj ObjectBase) Delete() error {
 		return util.WrapError(err)
 	}
 
+	query = `delete from attachments where id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query = `delete from postpassword where id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query = `delete from archived where id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query = `delete from poster where id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query = `delete from postnumber where id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query = `delete from citations where id=$1 or cites=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query = `delete from held where id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
 	query = `delete from cacheactivitystream where id=$1`
 	_, err := config.DB.Exec(query, obj.Id)
 	return util.WrapError(err)
@@ -292,26 +466,67 @@ func (obj ObjectBase) DeleteRepliedTo() error {
 }
 
 func (obj ObjectBase) DeleteRequest() error {
-	activity, err := obj.CreateActivity("Delete")
+	nObj, err := obj.GetFromPath()
 
 	if err != nil {
 		return util.WrapError(err)
 	}
 
+	return obj.sendDelete(nObj.Actor)
+}
+
+// DeleteAttachmentsRequest tells the instances a post went to that its files
+// are gone, for when the post itself stays.
+func (obj ObjectBase) DeleteAttachmentsRequest() error {
 	nObj, err := obj.GetFromPath()
+	if err != nil {
+		return util.WrapError(err)
+	}
 
+	query := `select attachment from attachments where id=$1 order by position`
+	rows, err := config.DB.Query(query, obj.Id)
 	if err != nil {
 		return util.WrapError(err)
 	}
 
-	actor, err := FingerActor(nObj.Actor)
+	var attachments []ObjectBase
+	for rows.Next() {
+		var attachment ObjectBase
+		if err := rows.Scan(&attachment.Id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		attachments = append(attachments, attachment)
+	}
+	rows.Close()
+
+	for _, e := range attachments {
+		e.AttributedTo = obj.Id
+		if err := e.sendDelete(nObj.Actor); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// sendDelete sends a Delete for obj from the board it was posted to.
+func (obj ObjectBase) sendDelete(actorID string) error {
+	activity, err := obj.CreateActivity("Delete")
+
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	actor, err := FingerActor(actorID)
 
 	if err != nil {
 		return util.WrapError(err)
 	}
 
 	activity.Actor = &actor
-	objActor, _ := GetActor(nObj.Actor)
+	objActor, _ := GetActor(actorID)
 	followers, err := objActor.GetFollower()
 
 	if err != nil {
@@ -352,21 +567,24 @@ func (obj ObjectBase) GetCollectionLocal() (Collection, error) {
 	var rows *sql.Rows
 	var err error
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where id=$1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where id=$1 and (type='Note' or type='Archive')) as x`
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0), (select count(id) from replies where inreplyto=x.id), (select count(id) from attachments where id in (select id from replies where inreplyto=x.id)) from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where id=$1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where id=$1 and (type='Note' or type='Archive')) as x`
 	if rows, err = config.DB.Query(query, obj.Id); err != nil {
 		return nColl, util.WrapError(err)
 	}
 
+	boards := make(boardSettings)
+
 	defer rows.Close()
 	for rows.Next() {
 		var actor Actor
 		var post ObjectBase
+		var posts, files int
 
 		var attch ObjectBase
 
 		var prev ObjectBase
 
-		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number, &posts, &files)
 
 		if err != nil {
 			return nColl, util.WrapError(err)
@@ -374,6 +592,7 @@ func (obj ObjectBase) GetCollectionLocal() (Collection, error) {
 
 		post.Sticky, _ = post.IsSticky()
 		post.Locked, _ = post.IsLocked()
+		post.BumpLimit, post.ImageLimit = boards.of(actor.Id).threadLimits(posts, files)
 
 		post.Actor = actor.Id
 
@@ -397,15 +616,13 @@ func (obj ObjectBase) GetCollectionLocal() (Collection, error) {
 			post.Replies.TotalImgs += imgCnt
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
+		if err := post.setBacklinks(); err != nil {
+			return nColl, util.WrapError(err)
 		}
 
-		if prev.Id != "" {
-			if post.Preview, err = prev.GetPreview(); err != nil {
+		if attch.Id != "" {
+			post.Attachment, post.Preview, err = post.GetAttachments()
+			if err != nil {
 				return nColl, util.WrapError(err)
 			}
 		}
@@ -449,8 +666,8 @@ func (obj ObjectBase) GetInReplyTo() ([]ObjectBase, error) {
 func (obj ObjectBase) GetAttachment() ([]ObjectBase, error) {
 	var attachment ObjectBase
 
-	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published from (select id, type, name, href, mediatype, size, published from activitystream where id=$1 union select id, type, name, href, mediatype, size, published from cacheactivitystream where id=$1) as x`
-	err := config.DB.QueryRow(query, obj.Id).Scan(&attachment.Id, &attachment.Type, &attachment.Name, &attachment.Href, &attachment.MediaType, &attachment.Size, &attachment.Published)
+	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published, x.width, x.height, x.duration from (select id, type, name, href, mediatype, size, published, coalesce(width, 0) as width, coalesce(height, 0) as height, coalesce(duration, 0) as duration from activitystream where id=$1 union select id, type, name, href, mediatype, size, published, coalesce(width, 0), coalesce(height, 0), coalesce(duration, 0) from cacheactivitystream where id=$1) as x`
+	err := config.DB.QueryRow(query, obj.Id).Scan(&attachment.Id, &attachment.Type, &attachment.Name, &attachment.Href, &attachment.MediaType, &attachment.Size, &attachment.Published, &attachment.Width, &attachment.Height, &attachment.Duration)
 
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
@@ -461,11 +678,62 @@ func (obj ObjectBase) GetAttachment() ([]ObjectBase, error) {
 	return []ObjectBase{attachment}, nil
 }
 
+// GetAttachments returns every attachment of a post in the order they were
+// posted, each with its own preview.
+// The preview of the first one is also returned for where only one is shown.
+func (obj ObjectBase) GetAttachments() ([]ObjectBase, *ObjectBase, error) {
+	query := `select attachment, preview from attachments where id=$1 order by position`
+	rows, err := config.DB.Query(query, obj.Id)
+	if err != nil {
+		return nil, nil, util.WrapError(err)
+	}
+
+	var ids [][2]string
+	for rows.Next() {
+		var attachment, preview string
+		if err := rows.Scan(&attachment, &preview); err != nil {
+			rows.Close()
+			return nil, nil, util.WrapError(err)
+		}
+
+		ids = append(ids, [2]string{attachment, preview})
+	}
+	rows.Close()
+
+	var attachments []ObjectBase
+	for _, e := range ids {
+		attachment, err := ObjectBase{Id: e[0]}.GetAttachment()
+		if err != nil {
+			return nil, nil, util.WrapError(err)
+		} else if len(attachment) == 0 {
+			continue
+		}
+
+		if e[1] != "" {
+			preview, err := ObjectBase{Id: e[1]}.GetPreview()
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, nil, util.WrapError(err)
+			}
+
+			attachment[0].Preview = preview
+		}
+
+		attachments = append(attachments, attachment[0])
+	}
+
+	if len(attachments) == 0 {
+		return nil, nil, nil
+	}
+
+	return attachments, attachments[0].Preview, nil
+}
+
 func (obj ObjectBase) GetCollectionFromPath() (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
 	var post ObjectBase
+	var posts, files int
 	var actor Actor
 
 	var attch ObjectBase
@@ -474,13 +742,15 @@ func (obj ObjectBase) GetCollectionFromPath() (Collection, error) {
 
 	var err error
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where id like $1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where id like $1 and (type='Note' or type='Archive')) as x order by x.updated`
-	if err = config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0), (select count(id) from replies where inreplyto=x.id), (select count(id) from attachments where id in (select id from replies where inreplyto=x.id)) from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from activitystream where id like $1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where id like $1 and (type='Note' or type='Archive')) as x order by x.updated`
+	if err = config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number, &posts, &files); err != nil {
 		return nColl, err
 	}
 
 	post.Sticky, _ = post.IsSticky()
 	post.Locked, _ = post.IsLocked()
+	settings, _ := actor.Settings()
+	post.BumpLimit, post.ImageLimit = settings.threadLimits(posts, files)
 
 	post.Actor = actor.Id
 
@@ -492,15 +762,13 @@ func (obj ObjectBase) GetCollectionFromPath() (Collection, error) {
 		return nColl, util.WrapError(err)
 	}
 
-	if attch.Id != "" {
-		post.Attachment, err = attch.GetAttachment()
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
+	if err := post.setBacklinks(); err != nil {
+		return nColl, util.WrapError(err)
 	}
 
-	if prev.Id != "" {
-		if post.Preview, err = prev.GetPreview(); err != nil {
+	if attch.Id != "" {
+		post.Attachment, post.Preview, err = post.GetAttachments()
+		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 	}
@@ -523,8 +791,8 @@ func (obj ObjectBase) GetFromPath() (ObjectBase, error) {
 
 	var prev ObjectBase
 
-	query := `select id, name, content, type, published, attributedto, attachment, preview, actor from activitystream where id=$1 order by published desc`
-	err := config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &post.Actor)
+	query := `select id, name, content, type, published, attributedto, attachment, preview, actor, coalesce(posterid, ''), coalesce((select number from postnumber where id=$1), 0) from activitystream where id=$1 order by published desc`
+	err := config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &post.Actor, &post.PosterID, &post.Number)
 
 	if err != nil {
 		return post, util.WrapError(err)
@@ -548,21 +816,42 @@ func (obj ObjectBase) GetFromPath() (ObjectBase, error) {
 		post.Replies.TotalImgs += imgCnt
 	}
 
+	if err := post.setBacklinks(); err != nil {
+		return post, util.WrapError(err)
+	}
+
 	if attch.Id != "" {
-		post.Attachment, err = attch.GetAttachment()
+		post.Attachment, post.Preview, err = post.GetAttachments()
 		if err != nil {
 			return post, util.WrapError(err)
 		}
 	}
 
-	if prev.Id != "" {
-		post.Preview, err = post.Preview.GetPreview()
+	return post, util.WrapError(err)
+}
+
+// GetPost returns a single local or cached post, without its replies.
+func (obj ObjectBase) GetPost() (ObjectBase, error) {
+	var post ObjectBase
+	var attch ObjectBase
+
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0) from (select id, name, content, type, published, updated, attributedto, attachment, actor, tripcode, capcode, sensitive, posterid from activitystream where id=$1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, actor, tripcode, capcode, sensitive, posterid from cacheactivitystream where id=$1 and (type='Note' or type='Archive')) as x`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &post.Actor, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number); err != nil {
+		return post, util.WrapError(err)
+	}
+
+	var err error
+
+	post.Backlinks, _ = post.GetBacklinks()
+
+	if attch.Id != "" {
+		post.Attachment, post.Preview, err = post.GetAttachments()
 		if err != nil {
 			return post, util.WrapError(err)
 		}
 	}
 
-	return post, util.WrapError(err)
+	return post, nil
 }
 
 func (obj ObjectBase) GetPreview() (*ObjectBase, error) {
@@ -591,6 +880,58 @@ func (obj ObjectBase) GetRepliesCount() (int, int, error) {
 	return countId, countImg, nil
 }
 
+// ThreadLimits reports whether the thread has reached the bump and image
+// limits of the board it was posted to.
+// Threads from other instances use the default limits, and unknown threads
+// have none.
+func (obj ObjectBase) ThreadLimits() (bool, bool, error) {
+	var board Actor
+	var posts, files int
+
+	query := `select actor from activitystream where id=$1 union select actor from cacheactivitystream where id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&board.Id); errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, util.WrapError(err)
+	}
+
+	settings, err := board.Settings()
+	if err != nil {
+		return false, false, util.WrapError(err)
+	}
+
+	query = `select (select count(id) from replies where inreplyto=$1), (select count(id) from attachments where id in (select id from replies where inreplyto=$1))`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&posts, &files); err != nil {
+		return false, false, util.WrapError(err)
+	}
+
+	bump, image := settings.threadLimits(posts, files)
+	return bump, image, nil
+}
+
+// threadLimits reports whether a thread with the given number of replies and
+// files has reached the bump and image limits.
+func (s Settings) threadLimits(posts, files int) (bool, bool) {
+	bump := s.BumpLimit > 0 && posts >= s.BumpLimit
+	image := s.ImageLimit > 0 && files >= s.ImageLimit
+	return bump, image
+}
+
+// boardSettings holds the settings of the boards in a collection, so each
+// board's are only read once.
+type boardSettings map[string]Settings
+
+// of returns the settings of board, or the defaults if they can't be read.
+func (b boardSettings) of(board string) Settings {
+	s, ok := b[board]
+	if !ok {
+		s, _ = Actor{Id: board}.Settings()
+		b[board] = s
+	}
+
+	return s
+}
+
 func (obj ObjectBase) GetReplies() (*CollectionBase, error) {
 	var result []ObjectBase
 
@@ -600,7 +941,7 @@ func (obj ObjectBase) GetReplies() (*CollectionBase, error) {
 	var rows *sql.Rows
 	var err error
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select * from activitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive') union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive')) as x order by x.published asc`
+	query := `select x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0) from (select * from activitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive') union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive')) as x order by x.published asc`
 	if rows, err = config.DB.Query(query, obj.Id); err != nil {
 		return nil, util.WrapError(err)
 	}
@@ -614,7 +955,7 @@ func (obj ObjectBase) GetReplies() (*CollectionBase, error) {
 
 		var prev ObjectBase
 
-		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number)
 		if err != nil {
 			return nil, util.WrapError(err)
 		}
@@ -632,14 +973,7 @@ func (obj ObjectBase) GetReplies() (*CollectionBase, error) {
 
 		if attch.Id != "" {
 			attachCount++
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nil, util.WrapError(err)
 			}
@@ -668,7 +1002,7 @@ func (obj ObjectBase) GetRepliesLimit(limit int) (*CollectionBase, error) {
 	var rows *sql.Rows
 	var err error
 
-	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over(), x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select * from activitystream where id in (select id from replies where inreplyto=$1) and type='Note' union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and type='Note') as x order by x.published desc limit $2`
+	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over(), x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0) from (select * from activitystream where id in (select id from replies where inreplyto=$1) and type='Note' union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and type='Note') as x order by x.published desc limit $2`
 	if rows, err = config.DB.Query(query, obj.Id, limit); err != nil {
 		return nil, util.WrapError(err)
 	}
@@ -682,7 +1016,7 @@ func (obj ObjectBase) GetRepliesLimit(limit int) (*CollectionBase, error) {
 
 		var prev ObjectBase
 
-		err = rows.Scan(&postCount, &attachCount, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&postCount, &attachCount, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number)
 
 		if err != nil {
 			return nil, util.WrapError(err)
@@ -699,14 +1033,7 @@ func (obj ObjectBase) GetRepliesLimit(limit int) (*CollectionBase, error) {
 		}
 
 		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nil, util.WrapError(err)
 			}
@@ -737,7 +1064,7 @@ func (obj ObjectBase) GetRepliesReplies() (*CollectionBase, error) {
 	var err error
 	var rows *sql.Rows
 
-	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over(), x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select * from activitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive') union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive')) as x order by x.published asc`
+	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over(), x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.sensitive, coalesce(x.posterid, ''), coalesce((select number from postnumber where id=x.id), 0) from (select * from activitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive') union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive')) as x order by x.published asc`
 	if rows, err = config.DB.Query(query, obj.Id); err != nil {
 		return nil, util.WrapError(err)
 	}
@@ -752,7 +1079,7 @@ func (obj ObjectBase) GetRepliesReplies() (*CollectionBase, error) {
 
 		var prev ObjectBase
 
-		err = rows.Scan(&postCount, &attachCount, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&postCount, &attachCount, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.Sensitive, &post.PosterID, &post.Number)
 		if err != nil {
 			return nil, util.WrapError(err)
 		}
@@ -762,14 +1089,7 @@ func (obj ObjectBase) GetRepliesReplies() (*CollectionBase, error) {
 		post.Actor = actor.Id
 
 		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
+			post.Attachment, post.Preview, err = post.GetAttachments()
 			if err != nil {
 				return nil, util.WrapError(err)
 			}
@@ -854,12 +1174,12 @@ func (obj ObjectBase) MarkSensitive(sensitive bool) error {
 func (obj ObjectBase) SetAttachmentType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select attachment from activitystream where id=$3)`
+	query := `update activitystream set type=$1, deleted=$2 where id in (select attachment from attachments where id=$3)`
 	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select attachment from cacheactivitystream  where id=$3)`
+	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select attachment from attachments where id=$3)`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -867,12 +1187,12 @@ func (obj ObjectBase) SetAttachmentType(_type string) error {
 func (obj ObjectBase) SetAttachmentRepliesType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select attachment from activitystream where id in (select id from replies where inreplyto=$3))`
+	query := `update activitystream set type=$1, deleted=$2 where id in (select attachment from attachments where id in (select id from replies where inreplyto=$3))`
 	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select attachment from cacheactivitystream where id in (select id from replies where inreplyto=$3))`
+	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select attachment from attachments where id in (select id from replies where inreplyto=$3))`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -880,12 +1200,12 @@ func (obj ObjectBase) SetAttachmentRepliesType(_type string) error {
 func (obj ObjectBase) SetPreviewType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select preview from activitystream where id=$3)`
+	query := `update activitystream set type=$1, deleted=$2 where id in (select preview from attachments where id=$3)`
 	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select preview from cacheactivitystream where id=$3)`
+	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select preview from attachments where id=$3)`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -893,12 +1213,12 @@ func (obj ObjectBase) SetPreviewType(_type string) error {
 func (obj ObjectBase) SetPreviewRepliesType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select preview from activitystream where id in (select id from replies where inreplyto=$3))`
+	query := `update activitystream set type=$1, deleted=$2 where id in (select preview from attachments where id in (select id from replies where inreplyto=$3))`
 	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select preview from cacheactivitystream where id in (select id from replies where inreplyto=$3))`
+	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select preview from attachments where id in (select id from replies where inreplyto=$3))`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -968,12 +1288,37 @@ func (obj ObjectBase) _SetRepliesType(_type string) error {
 func (obj ObjectBase) TombstoneAttachment() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from activitystream where id=$3)`
+	query := `update activitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from attachments where id=$3)`
 	if _, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from cacheactivitystream where id=$3)`
+	query = `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from attachments where id=$3)`
+	_, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id)
+	return util.WrapError(err)
+}
+
+// AttachmentOf returns the post a file belongs to, or an empty string if obj
+// isn't a file on any post.
+func (obj ObjectBase) AttachmentOf() (string, error) {
+	var id string
+
+	query := `select id from attachments where attachment=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&id); errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", util.WrapError(err)
+	}
+
+	return id, nil
+}
+
+// TombstoneFile removes a single cached file and its preview from a post,
+// for when another instance deletes it.
+func (obj ObjectBase) TombstoneFile() error {
+	datetime := time.Now().UTC().Format(time.RFC3339)
+
+	query := `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id=$3 or id in (select preview from attachments where attachment=$3)`
 	_, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -1000,12 +1345,12 @@ func (obj ObjectBase) TombstoneAttachmentReplies() error {
 func (obj ObjectBase) TombstonePreview() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from activitystream where id=$3)`
+	query := `update activitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from attachments where id=$3)`
 	if _, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from cacheactivitystream where id=$3)`
+	query = `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from attachments where id=$3)`
 	_, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -1056,12 +1401,12 @@ func (obj ObjectBase) Tombstone() error {
 func (obj ObjectBase) _Tombstone() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', deleted=$1 where id=$2`
+	query := `update activitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', capcode='', deleted=$1 where id=$2`
 	if _, err := config.DB.Exec(query, datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='',  deleted=$1 where id=$2`
+	query = `update cacheactivitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', capcode='',  deleted=$1 where id=$2`
 	_, err := config.DB.Exec(query, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -1105,12 +1450,12 @@ func (obj ObjectBase) TombstoneReplies() error {
 func (obj ObjectBase) _TombstoneReplies() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
+	query := `update activitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', capcode='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
 	if _, err := config.DB.Exec(query, datetime, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
+	query = `update cacheactivitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', capcode='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
 	_, err := config.DB.Exec(query, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -1133,40 +1478,58 @@ func (obj ObjectBase) UpdatePreview(preview string) error {
 }
 
 func (obj ObjectBase) Write() (ObjectBase, error) {
-	id, err := util.CreateUniqueID(obj.Actor)
-	if err != nil {
-		return obj, util.WrapError(err)
+	var err error
+
+	// The ID may have been picked already by something that needed it.
+	if obj.Id == "" {
+		if obj.Id, err = newPostID(obj.Actor); err != nil {
+			return obj, util.WrapError(err)
+		}
 	}
 
-	obj.Id = fmt.Sprintf("%s/%s", obj.Actor, id)
 	if len(obj.Attachment) > 0 {
 		now := time.Now().UTC()
-		if obj.Preview.Href != "" {
+		for i := range obj.Attachment {
+			attachment := &obj.Attachment[i]
+
+			if attachment.Preview != nil && attachment.Preview.Href != "" {
+				id, err := util.CreateUniqueID(obj.Actor)
+				if err != nil {
+					return obj, util.WrapError(err)
+				}
+
+				attachment.Preview.Id = fmt.Sprintf("%s/%s", obj.Actor, id)
+				attachment.Preview.Published = now
+				attachment.Preview.Updated = &now
+				attachment.Preview.AttributedTo = obj.Id
+				if err := attachment.Preview.WritePreview(); err != nil {
+					return obj, util.WrapError(err)
+				}
+			}
+
 			id, err := util.CreateUniqueID(obj.Actor)
 			if err != nil {
 				return obj, util.WrapError(err)
 			}
 
-			obj.Preview.Id = fmt.Sprintf("%s/%s", obj.Actor, id)
-			obj.Preview.Published = now
-			obj.Preview.Updated = &now
-			obj.Preview.AttributedTo = obj.Id
-			if err := obj.Preview.WritePreview(); err != nil {
+			attachment.Id = fmt.Sprintf("%s/%s", obj.Actor, id)
+			attachment.Published = now
+			attachment.Updated = &now
+			attachment.AttributedTo = obj.Id
+			if err := attachment.WriteAttachment(); err != nil {
 				return obj, util.WrapError(err)
 			}
 		}
-		for i := range obj.Attachment {
-			id, err := util.CreateUniqueID(obj.Actor)
-			if err != nil {
-				return obj, util.WrapError(err)
-			}
 
-			obj.Attachment[i].Id = fmt.Sprintf("%s/%s", obj.Actor, id)
-			obj.Attachment[i].Published = now
-			obj.Attachment[i].Updated = &now
-			obj.Attachment[i].AttributedTo = obj.Id
-			obj.Attachment[i].WriteAttachment()
-			obj.WriteWithAttachment(obj.Attachment[i])
+		// Older instances only know about the first attachment's preview.
+		obj.Preview = obj.Attachment[0].Preview
+
+		if err := obj.WriteWithAttachment(obj.Attachment[0]); err != nil {
+			return obj, util.WrapError(err)
+		}
+
+		if err := obj.WriteAttachments(); err != nil {
+			return obj, util.WrapError(err)
 		}
 	} else {
 		if err := obj._Write(); err != nil {
@@ -1174,6 +1537,14 @@ func (obj ObjectBase) Write() (ObjectBase, error) {
 		}
 	}
 
+	if obj.Number, err = obj.writeNumber(); err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	if err := obj.WriteCitations(); err != nil {
+		return obj, util.WrapError(err)
+	}
+
 	err = obj.WriteReply()
 
 	return obj, util.WrapError(err)
@@ -1181,17 +1552,20 @@ func (obj ObjectBase) Write() (ObjectBase, error) {
 
 func (obj ObjectBase) _Write() error {
 
-	query := `insert into activitystream (id, type, name, content, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
+	query := `insert into activitystream (id, type, name, content, published, updated, attributedto, actor, tripcode, capcode, sensitive, posterid) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, nullif($12, ''))`
+	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Capcode, obj.Sensitive, obj.PosterID)
 
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) WriteAttachment() error {
-	query := `insert into activitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
+	query := `insert into activitystream (id, type, name, href, published, updated, attributedTo, mediatype, size, width, height, duration) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, nullif($10, 0), nullif($11, 0), nullif($12, 0))`
+	if _, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size, obj.Width, obj.Height, obj.Duration); err != nil {
+		return util.WrapError(err)
+	}
 
-	return util.WrapError(err)
+	mediaWritten(obj.Href)
+	return nil
 }
 
 func (obj ObjectBase) WriteAttachmentCache() error {
@@ -1203,8 +1577,8 @@ func (obj ObjectBase) WriteAttachmentCache() error {
 			obj.Updated = &obj.Published
 		}
 
-		query = `insert into cacheactivitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
+		query = `insert into cacheactivitystream (id, type, name, href, published, updated, attributedTo, mediatype, size, width, height, duration) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, nullif($10, 0), nullif($11, 0), nullif($12, 0))`
+		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size, obj.Width, obj.Height, obj.Duration)
 		return util.WrapError(err)
 	}
 
@@ -1220,8 +1594,8 @@ func (obj ObjectBase) _WriteCache() error {
 			obj.Updated = &obj.Published
 		}
 
-		query = `insert into cacheactivitystream (id, type, name, content, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
+		query = `insert into cacheactivitystream (id, type, name, content, published, updated, attributedto, actor, tripcode, capcode, sensitive, posterid) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, nullif($12, ''))`
+		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.remoteCapcode(), obj.Sensitive, obj.remotePosterID())
 		return util.WrapError(err)
 	}
 
@@ -1237,18 +1611,43 @@ func (obj ObjectBase) WriteCacheWithAttachment(attachment ObjectBase) error {
 			obj.Updated = &obj.Published
 		}
 
-		query = `insert into cacheactivitystream (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, obj.Preview.Id, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
+		query = `insert into cacheactivitystream (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, capcode, sensitive, posterid) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, nullif($14, ''))`
+		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, attachment.previewID(), obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.remoteCapcode(), obj.Sensitive, obj.remotePosterID())
 		return util.WrapError(err)
 	}
 
 	return nil
 }
 
+// WriteAttachments records which attachments, and which of their previews,
+// belong to the post and in what order.
+func (obj ObjectBase) WriteAttachments() error {
+	for i, e := range obj.Attachment {
+		query := `insert into attachments (id, attachment, preview, position) values ($1, $2, $3, $4) on conflict do nothing`
+		if _, err := config.DB.Exec(query, obj.Id, e.Id, e.previewID(), i); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
+
+func (obj ObjectBase) previewID() string {
+	if obj.Preview == nil {
+		return ""
+	}
+
+	return obj.Preview.Id
+}
+
 func (obj ObjectBase) WritePreview() error {
 	query := `insert into activitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
-	return util.WrapError(err)
+	if _, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size); err != nil {
+		return util.WrapError(err)
+	}
+
+	mediaWritten(obj.Href)
+	return nil
 }
 
 func (obj ObjectBase) WritePreviewCache() error {
@@ -1289,6 +1688,12 @@ func (obj ObjectBase) WriteReply() error {
 			return util.WrapError(err)
 		}
 
+		// Checked before this reply counts towards it.
+		bumpLimit, _, err := e.ThreadLimits()
+		if err != nil {
+			return util.WrapError(err)
+		}
+
 		var id string
 
 		query := `select id from replies where id=$1 and inreplyto=$2`
@@ -1299,7 +1704,8 @@ func (obj ObjectBase) WriteReply() error {
 			}
 		}
 
-		update := true
+		// Held posts only bump once they're shown, if at all.
+		update := !bumpLimit && !obj.IsHeld()
 		for _, o := range obj.Option {
 			if o == "sage" || o == "nokosage" {
 				update = false
@@ -1330,32 +1736,82 @@ func (obj ObjectBase) WriteReply() error {
 }
 
 func (obj ObjectBase) WriteCache() (ObjectBase, error) {
-	if isBlacklisted, err := util.IsPostBlacklist(obj.Content); err != nil || isBlacklisted {
-		log.Println("Blacklist post blocked")
-		return obj, util.WrapError(err)
+	if obj.Type == "Note" {
+		res := ApplyFilters(obj.AttributedTo, obj.Name, obj.Content, boardsShowing(obj.Actor)...)
+		if res.Block {
+			log.Printf("filters blocked %s", obj.Id)
+			return obj, nil
+		}
+
+		obj.AttributedTo, obj.Name, obj.Content = res.Name, res.Subject, res.Comment
+		if res.TooLong {
+			// Nobody to tell, so it's kept as much as it can be.
+			obj.AttributedTo = truncate(obj.AttributedTo, maxNameLen)
+			obj.Name = truncate(obj.Name, maxNameLen)
+			obj.Content = truncate(obj.Content, maxCommentLen)
+		}
+		obj.Sensitive = obj.Sensitive || res.Sensitive
+		if res.Sage {
+			obj.Option = append(obj.Option, "sage")
+		}
+		if res.Hold {
+			obj.Hold()
+		}
 	}
 
 	if len(obj.Attachment) > 0 {
-		if obj.Preview.Href != "" {
-			obj.Preview.WritePreviewCache()
+		for i := range obj.Attachment {
+			attachment := &obj.Attachment[i]
+
+			// Instances that only support one attachment put its preview on
+			// the post.
+			if attachment.Preview == nil && i == 0 {
+				attachment.Preview = obj.Preview
+			}
+
+			if attachment.Preview != nil && attachment.Preview.Href != "" {
+				if err := attachment.Preview.WritePreviewCache(); err != nil {
+					return obj, util.WrapError(err)
+				}
+			}
+
+			if err := attachment.WriteAttachmentCache(); err != nil {
+				return obj, util.WrapError(err)
+			}
 		}
 
-		for i := range obj.Attachment {
-			obj.Attachment[i].WriteAttachmentCache()
-			obj.WriteCacheWithAttachment(obj.Attachment[i])
+		if err := obj.WriteCacheWithAttachment(obj.Attachment[0]); err != nil {
+			return obj, util.WrapError(err)
 		}
-	} else {
-		obj._WriteCache()
+
+		if err := obj.WriteAttachments(); err != nil {
+			return obj, util.WrapError(err)
+		}
+	} else if err := obj._WriteCache(); err != nil {
+		return obj, util.WrapError(err)
 	}
 
-	obj.WriteReply()
+	if err := obj.WriteReply(); err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	obj.Cites = contentCites(obj.Content)
+	if err := obj.WriteCitations(); err != nil {
+		return obj, util.WrapError(err)
+	}
 
 	if obj.Replies != nil {
 		for _, e := range obj.Replies.OrderedItems {
-			e.WriteCache()
+			if _, err := e.WriteCache(); err != nil {
+				return obj, util.WrapError(err)
+			}
 		}
 	}
 
+	if obj.Type == "Note" && len(obj.Attachment) > 0 {
+		obj.queueRemoteMedia()
+	}
+
 	return obj, nil
 }
 
@@ -1370,15 +1826,11 @@ func (obj ObjectBase) WriteUpdate(updated time.Time) error {
 	return util.WrapError(err)
 }
 
-func (obj ObjectBase) WriteWithAttachment(attachment ObjectBase) {
-
-	query := `insert into activitystream (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
-	_, e := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, obj.Preview.Id, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
+func (obj ObjectBase) WriteWithAttachment(attachment ObjectBase) error {
+	query := `insert into activitystream (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, capcode, sensitive, posterid) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, nullif($14, ''))`
+	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, attachment.previewID(), obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Capcode, obj.Sensitive, obj.PosterID)
 
-	if e != nil {
-		log.Println("error inserting new activity with attachment")
-		panic(e)
-	}
+	return util.WrapError(err)
 }
 
 func (obj ObjectBase) MarkSticky(actorID string) error {
@@ -193,6 +193,12 @@ func StorePemToDB(actor Actor) error {
 		return util.WrapError(err)
 	}
 
+	// A board that used to have this name may have left its key behind.
+	query = "delete from publicKeyPem where id=$1"
+	if _, err := config.DB.Exec(query, publicKeyPem); err != nil {
+		return util.WrapError(err)
+	}
+
 	file := "./pem/board/" + actor.Name + "-public.pem"
 	query = "insert into publicKeyPem (id, owner, file) values($1, $2, $3)"
 	_, err = config.DB.Exec(query, publicKeyPem, actor.Id, file)
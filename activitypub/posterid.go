@@ -0,0 +1,42 @@
+package activitypub
+
+import "github.com/KushBlazingJudah/fedichan/util"
+
+// Longest poster ID we keep from other instances; activitystream.posterid.
+const maxPosterIDLen = 16
+
+// newPostID picks the ID of a new post made on actor.
+func newPostID(actor string) (string, error) {
+	id, err := util.CreateUniqueID(actor)
+	if err != nil {
+		return "", util.WrapError(err)
+	}
+
+	return actor + "/" + id, nil
+}
+
+// NewPostID picks the ID of a new post on the board, for when it needs to be
+// known before the post is written.
+func (actor Actor) NewPostID() (string, error) {
+	return newPostID(actor.Id)
+}
+
+// remotePosterID returns the poster ID another instance gave a post, cut down
+// to what we can store.
+func (obj ObjectBase) remotePosterID() string {
+	if id := []rune(obj.PosterID); len(id) > maxPosterIDLen {
+		return string(id[:maxPosterIDLen])
+	}
+
+	return obj.PosterID
+}
+
+// remoteCapcode returns the capcode another instance gave a post, cut down to
+// what we can store.
+func (obj ObjectBase) remoteCapcode() string {
+	if c := []rune(obj.Capcode); len(c) > maxCapcodeLen {
+		return string(c[:maxCapcodeLen])
+	}
+
+	return obj.Capcode
+}
@@ -0,0 +1,256 @@
+package activitypub
+
+import (
+	"container/list"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// bucket is a token bucket, refilling at rate tokens per second up to burst.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket, or returns how long until one is
+// available.
+func (b *bucket) take(now time.Time, rate, burst float64) (time.Duration, bool) {
+	if rate <= 0 {
+		// No limit
+		return 0, true
+	}
+
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+	}
+
+	b.tokens--
+	return 0, true
+}
+
+// PeerUsage is what a remote instance has sent us.
+type PeerUsage struct {
+	Instance string
+
+	// Totals since startup.
+	Requests int
+	Limited  int
+
+	// Reset every day.
+	Posts      int
+	MediaBytes int64
+
+	LastSeen time.Time
+
+	day    time.Time
+	bucket bucket
+}
+
+// lru is a map that forgets the entries used least recently once it holds
+// more than max, so peers that can't be verified yet can't grow it forever.
+type lru[V any] struct {
+	max   int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRU[V any](max int) *lru[V] {
+	return &lru[V]{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the value of key, adding the value add makes if it's missing.
+func (c *lru[V]) get(key string, add func() V) V {
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry[V]).value
+	}
+
+	v := add()
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key, v})
+
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+
+	return v
+}
+
+// each calls f with every value, most recently used first.
+func (c *lru[V]) each(f func(V)) {
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		f(e.Value.(*lruEntry[V]).value)
+	}
+}
+
+// How many instances, actors and addresses are remembered at once.
+const (
+	maxPeers     = 4096
+	maxActors    = 16384
+	maxAddresses = 16384
+)
+
+var (
+	peers         = newLRU[*PeerUsage](maxPeers)
+	actorBucket   = newLRU[*bucket](maxActors)
+	addressBucket = newLRU[*bucket](maxAddresses)
+	peersMu       sync.Mutex
+)
+
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// peer returns the usage of instance, resetting the daily counters if needed.
+// peersMu must be held.
+func peer(instance string) *PeerUsage {
+	p := peers.get(instance, func() *PeerUsage {
+		return &PeerUsage{Instance: instance}
+	})
+
+	if day := today(); !p.day.Equal(day) {
+		p.day = day
+		p.Posts = 0
+		p.MediaBytes = 0
+	}
+
+	return p
+}
+
+func newBucket() *bucket {
+	return &bucket{}
+}
+
+// instanceOf returns the instance id is on.
+func instanceOf(id string) string {
+	if u, err := url.Parse(id); err == nil && u.Host != "" {
+		return u.Host
+	}
+
+	_, instance := GetActorAndInstance(id)
+	return instance
+}
+
+// keyInstance returns the instance that signed for actor, which is where the
+// key it was verified with lives.
+func keyInstance(actor Actor) string {
+	if actor.PublicKey.Id == "" {
+		return instanceOf(actor.Id)
+	}
+
+	return instanceOf(actor.PublicKey.Id)
+}
+
+// AllowAddress reports whether addr may send another activity to us, before
+// anything about it has been checked.
+// If not, it returns how long they should wait.
+func AllowAddress(addr string) (time.Duration, bool) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	return addressBucket.get(addr, newBucket).take(time.Now(), config.AddressRate/60, config.AddressBurst)
+}
+
+// AllowInbox reports whether actor may deliver another activity to us.
+// If not, it returns how long they should wait.
+// It's charged to the instance whose key signed the activity, so actor must
+// have been verified first.
+func AllowInbox(actor Actor) (time.Duration, bool) {
+	now := time.Now()
+
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	p := peer(keyInstance(actor))
+	p.Requests++
+	p.LastSeen = now
+
+	if wait, ok := p.bucket.take(now, config.InboxRate/60, config.InboxBurst); !ok {
+		p.Limited++
+		return wait, false
+	}
+
+	if wait, ok := actorBucket.get(actor.Id, newBucket).take(now, config.ActorRate/60, config.ActorBurst); !ok {
+		p.Limited++
+		return wait, false
+	}
+
+	return 0, true
+}
+
+// AllowCache reports whether we're still willing to cache posts from the
+// instance actor is on today.
+// If not, it returns how long until we are again.
+func AllowCache(actor Actor) (time.Duration, bool) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	p := peer(keyInstance(actor))
+	if (config.DailyPosts > 0 && p.Posts >= config.DailyPosts) || (config.DailyMedia > 0 && p.MediaBytes >= config.DailyMedia) {
+		p.Limited++
+		return time.Until(p.day.Add(24 * time.Hour)), false
+	}
+
+	return 0, true
+}
+
+// countCached charges a cached post and its media to the instance of the
+// actor that sent it.
+func countCached(actor Actor, obj ObjectBase) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	p := peer(keyInstance(actor))
+	p.Posts++
+
+	for _, e := range obj.Attachment {
+		p.MediaBytes += e.Size
+	}
+}
+
+// countMedia charges media found to be n bytes larger than it was said to be
+// to the instance of board, once it has been checked.
+func countMedia(board string, n int64) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	peer(instanceOf(board)).MediaBytes += n
+}
+
+// PeersUsage returns the current usage of every instance we've heard from,
+// busiest first.
+func PeersUsage() []PeerUsage {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	var usage []PeerUsage
+	peers.each(func(p *PeerUsage) {
+		usage = append(usage, *peer(p.Instance))
+	})
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Requests > usage[j].Requests
+	})
+
+	return usage
+}
@@ -0,0 +1,72 @@
+package activitypub
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A token is taken at each time in at; only the last result is checked.
+	tests := []struct {
+		name  string
+		at    []time.Duration
+		ok    bool
+		wait  time.Duration
+		rate  float64
+		burst float64
+	}{
+		{"first is full", []time.Duration{0}, true, 0, 1, 2},
+		{"burst", []time.Duration{0, 0}, true, 0, 1, 2},
+		{"past burst", []time.Duration{0, 0, 0}, false, time.Second, 1, 2},
+		{"partly refilled", []time.Duration{0, 0, 500 * time.Millisecond}, false, 500 * time.Millisecond, 1, 2},
+		{"refilled", []time.Duration{0, 0, time.Second}, true, 0, 1, 2},
+		{"refill is capped", []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, false, time.Second, 1, 2},
+		{"no limit", []time.Duration{0, 0, 0, 0}, true, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bucket
+			var wait time.Duration
+			var ok bool
+
+			for _, at := range tt.at {
+				wait, ok = b.take(start.Add(at), tt.rate, tt.burst)
+			}
+
+			if ok != tt.ok || wait != tt.wait {
+				t.Errorf("take() = %v, %v, want %v, %v", wait, ok, tt.wait, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU[int](2)
+	add := func(n int) func() int {
+		return func() int { return n }
+	}
+
+	c.get("a", add(1))
+	c.get("b", add(2))
+
+	// Using a keeps it over b.
+	if got := c.get("a", add(-1)); got != 1 {
+		t.Errorf("get(a) = %d, want 1", got)
+	}
+
+	c.get("c", add(3))
+
+	var got string
+	c.each(func(n int) { got += strconv.Itoa(n) })
+	if got != "31" {
+		t.Errorf("values = %q, want %q", got, "31")
+	}
+
+	if got := c.get("b", add(4)); got != 4 {
+		t.Errorf("get(b) = %d, want 4 after being forgotten", got)
+	}
+}
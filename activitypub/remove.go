@@ -0,0 +1,335 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// How long Activity.send may keep retrying, after which a deleted board's keys
+// are no longer needed to sign anything.
+const sendWindow = 15 * time.Minute
+
+// DeleteBoard deletes a local board along with everything on it.
+// Followers and followed boards are sent a Delete for the actor first.
+func (actor Actor) DeleteBoard() error {
+	actor, err := GetActorFromDB(actor.Id)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var activity Activity
+	activity.AtContext.Context = "https://www.w3.org/ns/activitystreams"
+	activity.Type = "Delete"
+	activity.Actor = &actor
+	activity.Object.Id = actor.Id
+	activity.Object.Type = actor.Type
+
+	followers, err := actor.GetFollower()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	following, err := actor.GetFollowing()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, e := range append(followers, following...) {
+		if !util.IsInStringArray(activity.To, e.Id) {
+			activity.To = append(activity.To, e.Id)
+		}
+	}
+
+	if err := activity.Send(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := purgeThreads(actor.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	query := `select id from activitystream where actor=$1 and type in ('Note', 'Archive', 'Held', 'Tombstone')`
+	rows, err := config.DB.Query(query, actor.Id)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var posts []ObjectBase
+	for rows.Next() {
+		var obj ObjectBase
+		if err := rows.Scan(&obj.Id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		posts = append(posts, obj)
+	}
+	rows.Close()
+
+	for _, e := range posts {
+		if err := e.DeleteAll(); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	// Everything else kept about the board, so a new one with its name starts
+	// afresh. Keep this in sync with movedColumns.
+	for _, query := range []string{
+		`delete from follower where id=$1 or follower=$1`,
+		`delete from following where id=$1 or following=$1`,
+		`delete from sticky where actor_id=$1`,
+		`delete from locked where actor_id=$1`,
+		`delete from postnumber where board=$1`,
+		`delete from postcounter where board=$1`,
+		`delete from filters where board=$1`,
+		`delete from originality where board=$1`,
+		`delete from originalitymutes where board=$1`,
+		`delete from moved where newid=$1`,
+		`delete from boardsettings where id=$1`,
+		`delete from bans where board=$1`,
+		`delete from archived where board=$1`,
+		`delete from poster where board=$1`,
+		`delete from actor where id=$1`,
+	} {
+		if _, err := config.DB.Exec(query, actor.Id); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	// Reports are filed under either the name or the ID of the board.
+	if _, err := config.DB.Exec(`delete from reported where board=$1 or board=$2`, actor.Id, actor.Name); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := LoadMoves(); err != nil {
+		return util.WrapError(err)
+	}
+
+	if err := LoadFilters(); err != nil {
+		return util.WrapError(err)
+	}
+
+	// The Delete is still being sent and has to be signed until it's done, so
+	// the keys are only removed after that.
+	// They're recorded so that they are removed at startup if we stop first.
+	query = `insert into retiredkeys (owner, name) values ($1, $2) on conflict (owner) do update set name=$2, retired=now()`
+	if _, err := config.DB.Exec(query, actor.Id, actor.Name); err != nil {
+		return util.WrapError(err)
+	}
+
+	go func() {
+		time.Sleep(sendWindow)
+
+		if err := removeRetiredKeys(sendWindow); err != nil {
+			log.Printf("failed to remove keys of %s: %v", actor.Id, err)
+		}
+	}()
+
+	return reloadBoards()
+}
+
+// IsGone asks the instance of a remote board whether it was deleted.
+// A Delete for a board is only signed with the key it comes with, so only its
+// instance saying so is taken as proof.
+func (actor Actor) IsGone() (bool, error) {
+	req, err := http.NewRequest("GET", actor.Id, nil)
+	if err != nil {
+		return false, util.WrapError(err)
+	}
+
+	req.Header.Set("Accept", config.ActivityStreams)
+
+	resp, err := util.RouteProxy(req)
+	if err != nil {
+		return false, util.WrapError(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return true, nil
+	case http.StatusOK:
+		var obj ObjectBase
+		if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+			return false, util.WrapError(err)
+		}
+
+		return obj.Type == "Tombstone", nil
+	}
+
+	return false, nil
+}
+
+// Forget drops a remote board: local boards stop following it, and everything
+// cached from it is purged.
+// If unfollow is set, the board is told that we stopped following it.
+func (actor Actor) Forget(unfollow bool) error {
+	query := `select id from following where following=$1`
+	rows, err := config.DB.Query(query, actor.Id)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var followers []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		followers = append(followers, id)
+	}
+	rows.Close()
+
+	if unfollow {
+		for _, e := range followers {
+			// Following an actor again is how we unfollow it.
+			activity, err := Actor{Id: e}.MakeFollowActivity(actor.Id)
+			if err != nil {
+				log.Printf("failed to unfollow %s from %s: %v", actor.Id, e, err)
+				continue
+			}
+
+			if err := activity.Send(); err != nil {
+				log.Printf("failed to unfollow %s from %s: %v", actor.Id, e, err)
+			}
+		}
+	}
+
+	for _, query := range []string{
+		`delete from following where following=$1`,
+		`delete from follower where follower=$1`,
+		`delete from cachedfollower where id=$1`,
+		`delete from cachedcollection where id=$1`,
+	} {
+		if _, err := config.DB.Exec(query, actor.Id); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	if err := actor.DeleteCache(); err != nil {
+		return util.WrapError(err)
+	}
+
+	name, instance := GetActorAndInstance(actor.Id)
+	uncacheActor(name, instance)
+
+	return reloadBoards()
+}
+
+// purgeThreads removes the cached replies to every thread of an actor.
+func purgeThreads(id string) error {
+	query := `select id from replies where inreplyto in (select id from activitystream where actor=$1 union select id from cacheactivitystream where actor=$1) and id in (select id from cacheactivitystream)`
+	rows, err := config.DB.Query(query, id)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var replies []ObjectBase
+	for rows.Next() {
+		var obj ObjectBase
+		if err := rows.Scan(&obj.Id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		replies = append(replies, obj)
+	}
+	rows.Close()
+
+	for _, e := range replies {
+		if err := e.deleteCached(); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// deleteCached removes a cached post along with its attachment, preview and
+// replies entries.
+func (obj ObjectBase) deleteCached() error {
+	for _, query := range []string{
+		`delete from cacheactivitystream where id in (select attachment from attachments where id=$1)`,
+		`delete from cacheactivitystream where id in (select preview from attachments where id=$1)`,
+		`delete from cacheactivitystream where id=$1`,
+		`delete from attachments where id=$1`,
+		`delete from replies where id=$1`,
+		`delete from sticky where activity_id=$1`,
+		`delete from locked where activity_id=$1`,
+		`delete from reported where id=$1`,
+		`delete from citations where id=$1 or cites=$1`,
+	} {
+		if _, err := config.DB.Exec(query, obj.Id); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// reloadBoards refreshes the board list after boards were added or removed.
+func reloadBoards() error {
+	instance, err := GetActorFromDB(config.Domain)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if FollowingBoards, err = instance.GetFollowing(); err != nil {
+		return util.WrapError(err)
+	}
+
+	Boards, err = GetBoardCollection()
+	return util.WrapError(err)
+}
+
+// RemoveRetiredKeys removes the keys of every deleted board.
+// It's run at startup, when nothing can still be being sent for them.
+func RemoveRetiredKeys() error {
+	return removeRetiredKeys(0)
+}
+
+// removeRetiredKeys removes the keys of boards deleted at least age ago.
+func removeRetiredKeys(age time.Duration) error {
+	rows, err := config.DB.Query(`select owner, name from retiredkeys where retired <= $1`, time.Now().Add(-age))
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var retired []Actor
+	for rows.Next() {
+		var actor Actor
+		if err := rows.Scan(&actor.Id, &actor.Name); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		retired = append(retired, actor)
+	}
+	rows.Close()
+
+	for _, actor := range retired {
+		// A new board may have taken the name, and these keys with it.
+		if local, _ := actor.IsLocal(); !local {
+			if _, err := config.DB.Exec(`delete from publicKeyPem where owner=$1`, actor.Id); err != nil {
+				return util.WrapError(err)
+			}
+
+			os.Remove("./pem/board/" + actor.Name + "-private.pem")
+			os.Remove("./pem/board/" + actor.Name + "-public.pem")
+		}
+
+		if _, err := config.DB.Exec(`delete from retiredkeys where owner=$1`, actor.Id); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,610 @@
+package activitypub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/KushBlazingJudah/fedichan/util"
+	"golang.org/x/image/webp"
+)
+
+// ErrBadMedia is returned for files that aren't what they claim to be, or
+// are too damaged to read.
+var ErrBadMedia = errors.New("media is damaged or not of its type")
+
+// MaxPixels is the most pixels an image can have for it to be decoded.
+// Images compress well enough that a file of a few kilobytes could otherwise
+// take gigabytes of memory.
+const MaxPixels = 8192 * 8192
+
+// checkPixels makes sure an image isn't too large to decode, from its header.
+func checkPixels(data []byte) error {
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ErrBadMedia
+	} else if int64(c.Width)*int64(c.Height) > MaxPixels {
+		return fmt.Errorf("%w: it has more than %d pixels", ErrBadMedia, MaxPixels)
+	}
+
+	return nil
+}
+
+// DecodeImage decodes an image, if it isn't too large to.
+func DecodeImage(data []byte) (image.Image, error) {
+	if err := checkPixels(data); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadMedia
+	}
+
+	return img, nil
+}
+
+// DecodeImageFile decodes the image in file, if it isn't too large to.
+func DecodeImageFile(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+	defer f.Close()
+
+	c, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, ErrBadMedia
+	} else if int64(c.Width)*int64(c.Height) > MaxPixels {
+		return nil, fmt.Errorf("%w: it has more than %d pixels", ErrBadMedia, MaxPixels)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, ErrBadMedia
+	}
+
+	return img, nil
+}
+
+// Muxers ffmpeg writes video and audio back out with, as files may not have
+// an extension it could guess from.
+var mediaMuxers = map[string][]string{
+	"video/mp4":   {"-f", "mp4"},
+	"video/webm":  {"-f", "webm"},
+	"video/ogg":   {"-f", "ogg"},
+	"audio/ogg":   {"-f", "ogg"},
+	"audio/mpeg":  {"-f", "mp3", "-id3v2_version", "0"},
+	"audio/wav":   {"-f", "wav"},
+	"audio/wave":  {"-f", "wav"},
+	"audio/x-wav": {"-f", "wav"},
+}
+
+// SanitizeMedia removes metadata, such as where a photo was taken or what
+// recorded a video, from the local file of an attachment.
+// Images are turned the way their EXIF orientation says first, as that is
+// lost with the rest, or keep only their orientation where they can't be.
+// Files that can't be read are rejected with ErrBadMedia, and the attachment
+// is returned with its new size.
+func (obj ObjectBase) SanitizeMedia() (ObjectBase, error) {
+	file := localFile(obj.Href)
+	if file == "" {
+		return obj, fmt.Errorf("%s isn't a local file", obj.Href)
+	}
+
+	var err error
+
+	switch obj.MediaType {
+	case "image/jpeg":
+		err = sanitizeJPEG(file)
+	case "image/png", "image/apng":
+		err = rewriteFile(file, stripPNG)
+	case "image/gif":
+		err = rewriteFile(file, stripGIF)
+	case "image/webp":
+		err = sanitizeWebP(file)
+	default:
+		if args, ok := mediaMuxers[obj.MediaType]; ok {
+			err = sanitizeAV(file, args)
+		} else {
+			err = fmt.Errorf("don't know how to remove metadata from %s", obj.MediaType)
+		}
+	}
+
+	if err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	obj.Size = fi.Size()
+	return obj, nil
+}
+
+// rewriteFile replaces the contents of file with what strip makes of them.
+func rewriteFile(file string, strip func([]byte) ([]byte, error)) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	if data, err = strip(data); err != nil {
+		return err
+	}
+
+	return util.WrapError(os.WriteFile(file, data, 0644))
+}
+
+// sanitizeAV copies the streams of a video or audio file into a new
+// container, leaving its metadata and chapters behind.
+func sanitizeAV(file string, muxer []string) error {
+	tmp := file + ".tmp"
+	defer os.Remove(tmp)
+
+	args := []string{"-v", "error", "-i", file, "-map", "0", "-map_metadata", "-1", "-map_chapters", "-1", "-c", "copy", "-fflags", "+bitexact", "-flags:v", "+bitexact", "-flags:a", "+bitexact"}
+	args = append(append(args, muxer...), "-y", tmp)
+
+	if err := exec.Command("ffmpeg", args...).Run(); errors.Is(err, exec.ErrNotFound) {
+		return errors.New("ffmpeg is needed to remove metadata from video and audio")
+	} else if err != nil {
+		return ErrBadMedia
+	}
+
+	return util.WrapError(os.Rename(tmp, file))
+}
+
+// sanitizeJPEG applies the orientation of a JPEG and strips it with
+// ImageMagick, or in Go if it isn't installed.
+func sanitizeJPEG(file string) error {
+	err := exec.Command("convert", file, "-auto-orient", "-strip", file).Run()
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, exec.ErrNotFound) {
+		return ErrBadMedia
+	}
+
+	return rewriteFile(file, stripJPEG)
+}
+
+// sanitizeWebP re-encodes a WebP the way its orientation says with
+// ImageMagick. Go can't encode WebP, so without it the WebP is only checked
+// and has its metadata dropped.
+func sanitizeWebP(file string) error {
+	if err := rewriteFile(file, stripWebP); err != nil {
+		return err
+	}
+
+	err := exec.Command("convert", file, "-auto-orient", "-strip", "webp:"+file).Run()
+	if err != nil && !errors.Is(err, exec.ErrNotFound) {
+		return ErrBadMedia
+	}
+
+	return nil
+}
+
+// stripJPEG re-encodes a JPEG the way its EXIF orientation says to show it.
+// Nothing but the pixels survive.
+func stripJPEG(data []byte) ([]byte, error) {
+	if err := checkPixels(data); err != nil {
+		return nil, err
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadMedia
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(img, jpegOrientation(data)), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 if it doesn't
+// have one.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+length > len(data) {
+			// The image data starts here.
+			break
+		}
+
+		seg := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// exifOrientation reads the orientation tag out of the first IFD of EXIF
+// data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+
+			break
+		}
+	}
+
+	return 1
+}
+
+// orientationEXIF returns EXIF data holding nothing but orientation o.
+func orientationEXIF(o int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, // big endian TIFF
+		0, 0, 0, 8, // the first IFD follows
+		0, 1, // with one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0, // orientation, a SHORT
+		0, 0, 0, 0, // and no more IFDs
+	}
+
+	return tiff
+}
+
+// orient turns img the way EXIF orientation o says it should be shown.
+func orient(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return out
+}
+
+// PNG chunks that are kept; everything else, such as text and EXIF, is
+// dropped.
+// Animation chunks are kept so APNGs still play.
+var pngChunks = map[string]bool{
+	"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+	"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true, "sBIT": true, "pHYs": true, "bKGD": true,
+	"acTL": true, "fcTL": true, "fdAT": true,
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNG drops the chunks of a PNG that could hold metadata.
+// A still PNG with an EXIF orientation is turned that way, while an animated
+// one keeps only its orientation.
+func stripPNG(data []byte) ([]byte, error) {
+	if err := checkPixels(data); err != nil {
+		return nil, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadMedia
+	}
+
+	o, animated := 1, false
+	out := append([]byte{}, pngSignature...)
+	for i := len(pngSignature); i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrBadMedia
+		}
+
+		name := string(data[i+4 : i+8])
+		switch name {
+		case "eXIf":
+			o = exifOrientation(data[i+8 : end-4])
+		case "acTL":
+			animated = true
+		}
+
+		if pngChunks[name] {
+			out = append(out, data[i:end]...)
+		}
+
+		if name == "IEND" {
+			break
+		}
+
+		i = end
+	}
+
+	if o == 1 {
+		return out, nil
+	} else if !animated {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, orient(img, o)); err != nil {
+			return nil, util.WrapError(err)
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	// EXIF has to come before the image data, so it goes right after IHDR,
+	// which is always first.
+	ihdr := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(out[len(pngSignature):]))
+	return append(append(out[:ihdr:ihdr], pngChunk("eXIf", orientationEXIF(o))...), out[ihdr:]...), nil
+}
+
+// pngChunk returns a PNG chunk named name holding data.
+func pngChunk(name string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(append(chunk, name...), data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// stripGIF re-encodes a GIF, which leaves its comments and application
+// extensions behind.
+// Frames, their timing and how often it loops are kept.
+func stripGIF(data []byte) ([]byte, error) {
+	if err := checkPixels(data); err != nil {
+		return nil, err
+	}
+
+	// Every frame is decoded at once, so they all count.
+	if pixels, err := gifPixels(data); err != nil {
+		return nil, err
+	} else if pixels > MaxGIFPixels {
+		return nil, fmt.Errorf("%w: its frames have more than %d pixels", ErrBadMedia, MaxGIFPixels)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadMedia
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// MaxGIFPixels is the most pixels all the frames of a GIF can have together
+// for it to be decoded.
+const MaxGIFPixels = 2 * MaxPixels
+
+// gifPixels adds up the pixels of every frame of a GIF, going by what each
+// says it has without decoding any of them.
+func gifPixels(data []byte) (int64, error) {
+	// Header and logical screen descriptor.
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return 0, ErrBadMedia
+	}
+
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	// skipBlocks skips data sub-blocks up to their terminator.
+	skipBlocks := func() bool {
+		for i < len(data) {
+			n := int(data[i])
+			i += 1 + n
+			if n == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var pixels int64
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // Extension
+			i += 2
+			if !skipBlocks() {
+				return 0, ErrBadMedia
+			}
+		case 0x2c: // Image descriptor
+			if i+10 > len(data) {
+				return 0, ErrBadMedia
+			}
+
+			w := binary.LittleEndian.Uint16(data[i+5:])
+			h := binary.LittleEndian.Uint16(data[i+7:])
+			pixels += int64(w) * int64(h)
+
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+
+			// LZW minimum code size, then the image data.
+			i++
+			if !skipBlocks() {
+				return 0, ErrBadMedia
+			}
+		case 0x3b: // Trailer
+			return pixels, nil
+		default:
+			return 0, ErrBadMedia
+		}
+	}
+
+	// The decoder doesn't mind a missing trailer.
+	return pixels, nil
+}
+
+// VP8X flags.
+const (
+	webpAnimated = 0x02
+	webpXMP      = 0x04
+	webpEXIF     = 0x08
+	webpAlpha    = 0x10
+)
+
+// stripWebP checks a WebP and drops its EXIF and XMP chunks, apart from its
+// orientation.
+// Animated WebPs can't be decoded in Go, so only their header is checked.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrBadMedia
+	}
+
+	if err := checkPixels(data); err != nil {
+		return nil, err
+	}
+
+	var vp8x []byte
+	o := 1
+
+	out := append([]byte{}, data[:12]...)
+	for i := 12; i+8 <= len(data); {
+		name := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+
+		// Chunks are padded to an even length.
+		end := i + 8 + length + length%2
+		if length < 0 || end > len(data) {
+			return nil, ErrBadMedia
+		}
+
+		switch name {
+		case "EXIF":
+			// Some encoders keep the JPEG header on it.
+			o = exifOrientation(bytes.TrimPrefix(data[i+8:i+8+length], []byte("Exif\x00\x00")))
+		case "XMP ":
+		default:
+			chunk := append([]byte{}, data[i:end]...)
+			if name == "VP8X" && len(chunk) >= 18 {
+				// Unset the flags saying there is EXIF or XMP.
+				chunk[8] &^= webpEXIF | webpXMP
+				vp8x = chunk
+			}
+
+			out = append(out, chunk...)
+		}
+
+		i = end
+	}
+
+	if vp8x == nil || vp8x[8]&webpAnimated == 0 {
+		if _, err := webp.Decode(bytes.NewReader(data)); err != nil {
+			return nil, ErrBadMedia
+		}
+	}
+
+	if o != 1 {
+		if vp8x == nil {
+			// Simple WebPs need the extended header to have EXIF.
+			c, err := webp.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				return nil, ErrBadMedia
+			}
+
+			var flags byte
+			if string(out[12:16]) == "VP8L" {
+				// Lossless images may have alpha; saying so doesn't hurt if
+				// they don't.
+				flags = webpAlpha
+			}
+
+			vp8x = []byte{'V', 'P', '8', 'X', 10, 0, 0, 0, flags, 0, 0, 0}
+			vp8x = append(vp8x, byte(c.Width-1), byte((c.Width-1)>>8), byte((c.Width-1)>>16))
+			vp8x = append(vp8x, byte(c.Height-1), byte((c.Height-1)>>8), byte((c.Height-1)>>16))
+			out = append(append(out[:12:12], vp8x...), out[12:]...)
+		}
+
+		// VP8X has to be the first chunk, so that's where its flags are.
+		if string(out[12:16]) != "VP8X" {
+			return nil, ErrBadMedia
+		}
+		out[12+8] |= webpEXIF
+
+		exif := orientationEXIF(o)
+		out = binary.LittleEndian.AppendUint32(append(out, "EXIF"...), uint32(len(exif)))
+		out = append(out, exif...)
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
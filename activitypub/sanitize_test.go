@@ -0,0 +1,240 @@
+package activitypub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// pngHeader returns the start of a PNG claiming to be w by h pixels, which is
+// all that's read to find out how large it is.
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 0 // greyscale
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+
+	return buf.Bytes()
+}
+
+func TestCheckPixels(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewGray(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"small image", small.Bytes(), true},
+		{"at the limit", pngHeader(8192, 8192), true},
+		{"too many pixels", pngHeader(8192, 8193), false},
+		{"enormous", pngHeader(1<<30, 1<<30), false},
+		{"not an image", []byte("hello"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPixels(tt.data)
+			if tt.ok && err != nil {
+				t.Errorf("checkPixels() = %v, want nil", err)
+			} else if !tt.ok && !errors.Is(err, ErrBadMedia) {
+				t.Errorf("checkPixels() = %v, want ErrBadMedia", err)
+			}
+		})
+	}
+}
+
+// gifFrames returns a GIF with a frame of w by h pixels for each of n, whose
+// image data is left empty.
+func gifFrames(w, h uint16, n int) []byte {
+	data := []byte("GIF89a")
+	data = binary.LittleEndian.AppendUint16(data, w)
+	data = binary.LittleEndian.AppendUint16(data, h)
+	data = append(data, 0, 0, 0)
+
+	for i := 0; i < n; i++ {
+		// Graphic control extension, then the frame with two colours of its
+		// own.
+		data = append(data, 0x21, 0xf9, 4, 0, 0, 0, 0, 0)
+		data = append(data, 0x2c, 0, 0, 0, 0)
+		data = binary.LittleEndian.AppendUint16(data, w)
+		data = binary.LittleEndian.AppendUint16(data, h)
+		data = append(data, 0x80, 0, 0, 0, 255, 255, 255, 2, 1, 0, 0)
+	}
+
+	return append(data, 0x3b)
+}
+
+func TestGIFPixels(t *testing.T) {
+	g := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 5), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, g); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		pixels int64
+		ok     bool
+	}{
+		{"encoded", encoded.Bytes(), 60, true},
+		{"one frame", gifFrames(8192, 8192, 1), MaxPixels, true},
+		{"many frames", gifFrames(8192, 8192, 40), 40 * MaxPixels, true},
+		{"no trailer", bytes.TrimSuffix(gifFrames(2, 2, 2), []byte{0x3b}), 8, true},
+		{"truncated", gifFrames(2, 2, 2)[:30], 0, false},
+		{"not a gif", []byte("hello, world"), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pixels, err := gifPixels(tt.data)
+			if tt.ok && (err != nil || pixels != tt.pixels) {
+				t.Errorf("gifPixels() = %d, %v, want %d, nil", pixels, err, tt.pixels)
+			} else if !tt.ok && !errors.Is(err, ErrBadMedia) {
+				t.Errorf("gifPixels() = %d, %v, want ErrBadMedia", pixels, err)
+			}
+		})
+	}
+
+	// Frames are counted before any of them are decoded.
+	if _, err := stripGIF(gifFrames(8192, 8192, 40)); !errors.Is(err, ErrBadMedia) {
+		t.Errorf("stripGIF() of too many frames = %v, want ErrBadMedia", err)
+	}
+}
+
+// withPNGChunk returns a PNG with the chunk added right after IHDR.
+func withPNGChunk(data []byte, name string, chunk []byte) []byte {
+	ihdr := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+	return append(append(append([]byte{}, data[:ihdr]...), pngChunk(name, chunk)...), data[ihdr:]...)
+}
+
+func TestStripPNG(t *testing.T) {
+	var wide bytes.Buffer
+	if err := png.Encode(&wide, image.NewGray(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		w, h int
+	}{
+		{"plain", wide.Bytes(), 4, 2},
+		{"text dropped", withPNGChunk(wide.Bytes(), "tEXt", []byte("Author\x00someone")), 4, 2},
+		{"upside down", withPNGChunk(wide.Bytes(), "eXIf", orientationEXIF(3)), 4, 2},
+		{"turned", withPNGChunk(wide.Bytes(), "eXIf", orientationEXIF(6)), 2, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := stripPNG(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(out, []byte("tEXt")) || bytes.Contains(out, []byte("eXIf")) {
+				t.Error("metadata was kept")
+			}
+
+			c, err := png.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			} else if c.Width != tt.w || c.Height != tt.h {
+				t.Errorf("got %dx%d, want %dx%d", c.Width, c.Height, tt.w, tt.h)
+			}
+		})
+	}
+}
+
+// webpImage is a 1x1 lossless WebP.
+var webpImage = []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f\x00\x00\x00\x10\x07\x10\x11\x11\x88\x88\xfe\x07\x00")
+
+// withWebPChunk returns a WebP with the chunk added to the end.
+func withWebPChunk(data []byte, name string, chunk []byte) []byte {
+	out := append(append([]byte{}, data...), name...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(chunk)))
+	out = append(out, chunk...)
+	if len(chunk)%2 == 1 {
+		out = append(out, 0)
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+func TestStripWebP(t *testing.T) {
+	broken := append([]byte{}, webpImage...)
+	broken[len(broken)-4] ^= 0xff
+
+	tests := []struct {
+		name        string
+		data        []byte
+		orientation int // 0 if it should be rejected
+	}{
+		{"plain", webpImage, 1},
+		{"xmp dropped", withWebPChunk(webpImage, "XMP ", []byte("<x:xmpmeta/>")), 1},
+		{"orientation kept", withWebPChunk(webpImage, "EXIF", orientationEXIF(6)), 6},
+		{"jpeg style exif", withWebPChunk(webpImage, "EXIF", append([]byte("Exif\x00\x00"), orientationEXIF(8)...)), 8},
+		{"not a webp", []byte("RIFF\x04\x00\x00\x00WAVE"), 0},
+		{"damaged", broken, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := stripWebP(tt.data)
+			if tt.orientation == 0 {
+				if !errors.Is(err, ErrBadMedia) {
+					t.Errorf("stripWebP() = %v, want ErrBadMedia", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(out, []byte("XMP ")) {
+				t.Error("XMP was kept")
+			}
+
+			if _, err := webp.DecodeConfig(bytes.NewReader(out)); err != nil {
+				t.Fatalf("result doesn't decode: %v", err)
+			}
+
+			o := 1
+			if i := bytes.Index(out, []byte("EXIF")); i >= 0 {
+				o = exifOrientation(out[i+8:])
+				if out[20]&webpEXIF == 0 {
+					t.Error("EXIF flag not set")
+				}
+			}
+
+			if o != tt.orientation {
+				t.Errorf("orientation %d, want %d", o, tt.orientation)
+			}
+		})
+	}
+}
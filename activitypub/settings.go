@@ -0,0 +1,226 @@
+package activitypub
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Limits imposed by the database.
+const (
+	maxCommentLen = 4500 // activitystream.content
+	maxNameLen    = 100  // activitystream.name and attributedto
+	maxCapcodeLen = 20   // activitystream.capcode
+)
+
+// Settings holds the limits of a board.
+type Settings struct {
+	MaxFiles       int           // files per post
+	MaxFileSize    int           // bytes per file
+	MaxComment     int           // characters per comment
+	MaxName        int           // characters per name or subject
+	MaxLines       int           // lines per comment
+	TruncateLines  int           // lines shown before a post is cut short
+	DeleteWindow   time.Duration // how long posters may delete their posts, 0 if they can't
+	MaxThreads     int           // threads kept before the rest are archived
+	ThreadsPerPage int
+	MaxPages       int
+	BumpLimit      int // replies that bump a thread, 0 for no limit
+	ImageLimit     int // files in a thread, 0 for no limit
+
+	// ArchiveRetention is how long archived threads are kept, 0 to keep
+	// them forever.
+	// Afterwards they lose their media, or are deleted entirely if
+	// PurgeArchive is set.
+	ArchiveRetention time.Duration
+	PurgeArchive     bool
+
+	// How long posters have to wait between posts, 0 if they don't.
+	ReplyCooldown     time.Duration
+	ThreadCooldown    time.Duration
+	IdenticalCooldown time.Duration // before posting the same comment again
+
+	PosterIDs bool // show who made each post in its thread
+
+	// Only take what hasn't been posted on the board before: comments, and
+	// files if OriginalMedia is set.
+	Originality   bool
+	OriginalMedia bool
+
+	PostMode  string   // which posts need a file, one of PostModes
+	FileTypes []string // MIME types of files that may be posted
+}
+
+// Post modes
+const (
+	PostModeOPFile   = "opfile"   // new threads need a file
+	PostModeOptional = "optional" // no posts need a file
+	PostModeFiles    = "files"    // every post needs a file
+	PostModeText     = "text"     // no files at all
+)
+
+// PostModes lists every post mode, in the order they're offered.
+var PostModes = []string{PostModeOPFile, PostModeOptional, PostModeFiles, PostModeText}
+
+// DefaultSettings returns the settings of boards that haven't changed them.
+func DefaultSettings() Settings {
+	return Settings{
+		MaxFiles:       config.MaxFiles,
+		MaxFileSize:    config.MaxFileSize,
+		MaxComment:     config.MaxComment,
+		MaxName:        config.MaxName,
+		MaxLines:       config.MaxLines,
+		TruncateLines:  config.TruncateLines,
+		DeleteWindow:   time.Duration(config.DeleteWindow) * time.Minute,
+		MaxThreads:     config.MaxThreads,
+		ThreadsPerPage: config.ThreadsPerPage,
+		MaxPages:       config.MaxPages,
+		BumpLimit:      config.BumpLimit,
+		ImageLimit:     config.ImageLimit,
+
+		ArchiveRetention: time.Duration(config.ArchiveRetention) * 24 * time.Hour,
+		PurgeArchive:     config.PurgeArchive,
+
+		ReplyCooldown:     time.Duration(config.ReplyCooldown) * time.Second,
+		ThreadCooldown:    time.Duration(config.ThreadCooldown) * time.Second,
+		IdenticalCooldown: time.Duration(config.IdenticalCooldown) * time.Second,
+
+		PosterIDs: config.PosterIDs,
+
+		Originality:   config.Originality,
+		OriginalMedia: config.OriginalMedia,
+
+		PostMode:  config.PostMode,
+		FileTypes: append([]string(nil), config.SupportedFiles...),
+	}
+}
+
+// Validate checks that every setting is sensible and fits in the database.
+func (s Settings) Validate() error {
+	limits := []struct {
+		name          string
+		val, min, max int
+	}{
+		{"file limit", s.MaxFiles, 1, math.MaxInt32},
+		{"file size limit", s.MaxFileSize, 1, math.MaxInt32},
+		{"comment limit", s.MaxComment, 1, maxCommentLen},
+		{"name limit", s.MaxName, 1, maxNameLen},
+		{"line limit", s.MaxLines, 1, math.MaxInt32},
+		{"truncation limit", s.TruncateLines, 1, math.MaxInt32},
+		{"deletion window", int(s.DeleteWindow.Seconds()), 0, math.MaxInt32},
+		{"thread limit", s.MaxThreads, 1, math.MaxInt32},
+		{"threads per page", s.ThreadsPerPage, 1, math.MaxInt32},
+		{"page limit", s.MaxPages, 1, math.MaxInt32},
+		{"bump limit", s.BumpLimit, 0, math.MaxInt32},
+		{"image limit", s.ImageLimit, 0, math.MaxInt32},
+		{"archive retention", int(s.ArchiveRetention.Seconds()), 0, math.MaxInt32},
+		{"reply cooldown", int(s.ReplyCooldown.Seconds()), 0, math.MaxInt32},
+		{"thread cooldown", int(s.ThreadCooldown.Seconds()), 0, math.MaxInt32},
+		{"identical comment cooldown", int(s.IdenticalCooldown.Seconds()), 0, math.MaxInt32},
+	}
+
+	for _, l := range limits {
+		if l.val < l.min || l.val > l.max {
+			return fmt.Errorf("%s must be between %d and %d", l.name, l.min, l.max)
+		}
+	}
+
+	if !util.IsInStringArray(PostModes, s.PostMode) {
+		return fmt.Errorf("unknown post mode %q", s.PostMode)
+	}
+
+	if s.AllowsFiles() && len(s.FileTypes) == 0 {
+		return errors.New("at least one kind of file must be allowed")
+	}
+
+	// Files we don't know how to handle can't be allowed.
+	for _, e := range s.FileTypes {
+		if !util.IsInStringArray(config.SupportedFiles, e) {
+			return fmt.Errorf("%s files aren't supported", e)
+		}
+	}
+
+	return nil
+}
+
+// AllowsFiles reports whether files may be posted at all.
+func (s Settings) AllowsFiles() bool {
+	return s.PostMode != PostModeText
+}
+
+// NeedsFile reports whether a new thread, or a reply if thread is false,
+// has to have a file.
+func (s Settings) NeedsFile(thread bool) bool {
+	return s.PostMode == PostModeFiles || (thread && s.PostMode == PostModeOPFile)
+}
+
+// Accepts reports whether files of type mime may be posted, if files may be
+// posted at all.
+func (s Settings) Accepts(mime string) bool {
+	return util.IsInStringArray(s.FileTypes, mime)
+}
+
+// Accept returns the file types that may be posted, for the accept attribute
+// of a file input.
+func (s Settings) Accept() string {
+	return strings.Join(s.FileTypes, ",")
+}
+
+// Settings returns the settings of the board, using the defaults for anything
+// it hasn't changed.
+func (a Actor) Settings() (Settings, error) {
+	s := DefaultSettings()
+	window := int(s.DeleteWindow.Seconds())
+	retention := int(s.ArchiveRetention.Seconds())
+	reply, thread, identical := int(s.ReplyCooldown.Seconds()), int(s.ThreadCooldown.Seconds()), int(s.IdenticalCooldown.Seconds())
+	types := strings.Join(s.FileTypes, ",")
+
+	query := `select coalesce(maxfiles, $2), coalesce(maxfilesize, $3), coalesce(maxcomment, $4), coalesce(maxname, $5), coalesce(maxlines, $6), coalesce(truncatelines, $7), coalesce(deletewindow, $8), coalesce(maxthreads, $9), coalesce(threadsperpage, $10), coalesce(maxpages, $11), coalesce(bumplimit, $12), coalesce(imagelimit, $13), coalesce(archiveretention, $14), coalesce(purgearchive, $15), coalesce(replycooldown, $16), coalesce(threadcooldown, $17), coalesce(identicalcooldown, $18), coalesce(posterids, $19), coalesce(originality, $20), coalesce(originalmedia, $21), coalesce(postmode, $22), coalesce(filetypes, $23) from boardsettings where id = $1`
+	err := config.DB.QueryRow(query, a.Id, s.MaxFiles, s.MaxFileSize, s.MaxComment, s.MaxName, s.MaxLines, s.TruncateLines, window, s.MaxThreads, s.ThreadsPerPage, s.MaxPages, s.BumpLimit, s.ImageLimit, retention, s.PurgeArchive, reply, thread, identical, s.PosterIDs, s.Originality, s.OriginalMedia, s.PostMode, types).Scan(&s.MaxFiles, &s.MaxFileSize, &s.MaxComment, &s.MaxName, &s.MaxLines, &s.TruncateLines, &window, &s.MaxThreads, &s.ThreadsPerPage, &s.MaxPages, &s.BumpLimit, &s.ImageLimit, &retention, &s.PurgeArchive, &reply, &thread, &identical, &s.PosterIDs, &s.Originality, &s.OriginalMedia, &s.PostMode, &types)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, nil
+	} else if err != nil {
+		return DefaultSettings(), util.WrapError(err)
+	}
+
+	s.DeleteWindow = time.Duration(window) * time.Second
+	s.ArchiveRetention = time.Duration(retention) * time.Second
+	s.ReplyCooldown = time.Duration(reply) * time.Second
+	s.ThreadCooldown = time.Duration(thread) * time.Second
+	s.IdenticalCooldown = time.Duration(identical) * time.Second
+	s.FileTypes = splitFileTypes(types)
+	return s, nil
+}
+
+// SetSettings changes the settings of the board.
+// Settings that are the same as the defaults are left unset so they follow
+// the defaults if they change.
+func (a Actor) SetSettings(s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	d := DefaultSettings()
+
+	query := `insert into boardsettings (id, maxfiles, maxfilesize, maxcomment, maxname, maxlines, truncatelines, deletewindow, maxthreads, threadsperpage, maxpages, bumplimit, imagelimit, archiveretention, purgearchive, replycooldown, threadcooldown, identicalcooldown, posterids, originality, originalmedia, postmode, filetypes) values ($1, nullif($2, $24), nullif($3, $25), nullif($4, $26), nullif($5, $27), nullif($6, $28), nullif($7, $29), nullif($8, $30), nullif($9, $31), nullif($10, $32), nullif($11, $33), nullif($12, $34), nullif($13, $35), nullif($14, $36), nullif($15, $37), nullif($16, $38), nullif($17, $39), nullif($18, $40), nullif($19, $41), nullif($20, $42), nullif($21, $43), nullif($22, $44), nullif($23, $45))
+on conflict (id) do update set maxfiles = excluded.maxfiles, maxfilesize = excluded.maxfilesize, maxcomment = excluded.maxcomment, maxname = excluded.maxname, maxlines = excluded.maxlines, truncatelines = excluded.truncatelines, deletewindow = excluded.deletewindow, maxthreads = excluded.maxthreads, threadsperpage = excluded.threadsperpage, maxpages = excluded.maxpages, bumplimit = excluded.bumplimit, imagelimit = excluded.imagelimit, archiveretention = excluded.archiveretention, purgearchive = excluded.purgearchive, replycooldown = excluded.replycooldown, threadcooldown = excluded.threadcooldown, identicalcooldown = excluded.identicalcooldown, posterids = excluded.posterids, originality = excluded.originality, originalmedia = excluded.originalmedia, postmode = excluded.postmode, filetypes = excluded.filetypes`
+	_, err := config.DB.Exec(query, a.Id,
+		s.MaxFiles, s.MaxFileSize, s.MaxComment, s.MaxName, s.MaxLines, s.TruncateLines, int(s.DeleteWindow.Seconds()), s.MaxThreads, s.ThreadsPerPage, s.MaxPages, s.BumpLimit, s.ImageLimit, int(s.ArchiveRetention.Seconds()), s.PurgeArchive, int(s.ReplyCooldown.Seconds()), int(s.ThreadCooldown.Seconds()), int(s.IdenticalCooldown.Seconds()), s.PosterIDs, s.Originality, s.OriginalMedia, s.PostMode, strings.Join(s.FileTypes, ","),
+		d.MaxFiles, d.MaxFileSize, d.MaxComment, d.MaxName, d.MaxLines, d.TruncateLines, int(d.DeleteWindow.Seconds()), d.MaxThreads, d.ThreadsPerPage, d.MaxPages, d.BumpLimit, d.ImageLimit, int(d.ArchiveRetention.Seconds()), d.PurgeArchive, int(d.ReplyCooldown.Seconds()), int(d.ThreadCooldown.Seconds()), int(d.IdenticalCooldown.Seconds()), d.PosterIDs, d.Originality, d.OriginalMedia, d.PostMode, strings.Join(d.FileTypes, ","))
+	return util.WrapError(err)
+}
+
+// File types are stored as a list separated by commas.
+func splitFileTypes(types string) []string {
+	if types == "" {
+		return nil
+	}
+
+	return strings.Split(types, ",")
+}
@@ -0,0 +1,68 @@
+package activitypub
+
+import (
+	"testing"
+	"time"
+)
+
+// testSettings returns settings that should pass validation, to be broken by
+// each test.
+func testSettings() Settings {
+	return Settings{
+		MaxFiles:       4,
+		MaxFileSize:    7 * 1024 * 1024,
+		MaxComment:     4500,
+		MaxName:        100,
+		MaxLines:       50,
+		TruncateLines:  30,
+		DeleteWindow:   30 * time.Minute,
+		MaxThreads:     165,
+		ThreadsPerPage: 15,
+		MaxPages:       10,
+		BumpLimit:      300,
+		ImageLimit:     150,
+
+		ReplyCooldown:     10 * time.Second,
+		ThreadCooldown:    2 * time.Minute,
+		IdenticalCooldown: 10 * time.Minute,
+
+		PostMode:  PostModeOPFile,
+		FileTypes: []string{"image/png", "image/jpeg"},
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Settings)
+		ok     bool
+	}{
+		{"defaults", func(s *Settings) {}, true},
+		{"comment too long for the column", func(s *Settings) { s.MaxComment = 4501 }, false},
+		{"no comments", func(s *Settings) { s.MaxComment = 0 }, false},
+		{"name too long", func(s *Settings) { s.MaxName = maxNameLen + 1 }, false},
+		{"no files per post", func(s *Settings) { s.MaxFiles = 0 }, false},
+		{"no bump limit", func(s *Settings) { s.BumpLimit = 0 }, true},
+		{"negative cooldown", func(s *Settings) { s.ReplyCooldown = -time.Second }, false},
+		{"negative deletion window", func(s *Settings) { s.DeleteWindow = -time.Minute }, false},
+		{"unknown post mode", func(s *Settings) { s.PostMode = "sometimes" }, false},
+		{"empty post mode", func(s *Settings) { s.PostMode = "" }, false},
+		{"files without file types", func(s *Settings) { s.FileTypes = nil }, false},
+		{"text without file types", func(s *Settings) { s.PostMode = PostModeText; s.FileTypes = nil }, true},
+		{"unsupported file type", func(s *Settings) { s.FileTypes = append(s.FileTypes, "application/pdf") }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSettings()
+			tt.change(&s)
+
+			err := s.Validate()
+			if tt.ok && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			} else if !tt.ok && err == nil {
+				t.Error("Validate() = nil, want an error")
+			}
+		})
+	}
+}
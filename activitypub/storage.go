@@ -0,0 +1,188 @@
+package activitypub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Media is stored in ./public under the SHA-256 of its contents, so the same
+// file posted many times is only kept once.
+// Files are shared by every row of activitystream with their href, and are
+// only removed once none are left; see deleteFiles.
+
+// Extensions media is stored with, so it's served as the right type no
+// matter what it was called when it was uploaded.
+var mediaExtensions = map[string]string{
+	"image/gif":   "gif",
+	"image/jpeg":  "jpg",
+	"image/png":   "png",
+	"image/webp":  "webp",
+	"image/apng":  "png",
+	"video/mp4":   "mp4",
+	"video/ogg":   "ogv",
+	"video/webm":  "webm",
+	"audio/mpeg":  "mp3",
+	"audio/ogg":   "ogg",
+	"audio/wav":   "wav",
+	"audio/wave":  "wav",
+	"audio/x-wav": "wav",
+}
+
+// mediaExtension returns the extension to store media of mimetype with,
+// falling back to that of its name.
+func mediaExtension(mimetype, name string) string {
+	if ext, ok := mediaExtensions[mimetype]; ok {
+		return ext
+	}
+
+	return strings.TrimPrefix(path.Ext(name), ".")
+}
+
+// Media is written to ./tmp until it's stored, which isn't served, so nothing
+// can be fetched before it has been checked.
+const tempDir = "./tmp"
+
+// tempMedia creates a file for media that hasn't been stored yet.
+func tempMedia(ext string) (*os.File, error) {
+	f, err := os.CreateTemp(tempDir, "upload-*."+ext)
+	return f, util.WrapError(err)
+}
+
+// How long stored media is kept for the post it was stored for, if that post
+// is never written.
+const pendingMedia = time.Hour
+
+// Stored media only counts as used once a post with it has been written, so
+// it's kept from deleteFiles until then.
+// Storing and deleting are done under the lock, so a file can't be removed
+// between being found and being used again.
+var media = struct {
+	sync.Mutex
+	pending map[string]time.Time
+}{pending: make(map[string]time.Time)}
+
+// hashMedia hashes the contents of file.
+func hashMedia(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", util.WrapError(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", util.WrapError(err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storeMedia moves the media at file, whose contents hash to sum, to where
+// it belongs, and returns its href.
+// If the same media is already stored, file is removed and the stored copy
+// is used instead.
+func storeMedia(file, sum string) (string, error) {
+	name := "/public/" + sum + path.Ext(file)
+
+	media.Lock()
+	defer media.Unlock()
+
+	if _, err := os.Stat("." + name); err == nil {
+		if err := os.Remove(file); err != nil {
+			return "", util.WrapError(err)
+		}
+	} else if err := os.Rename(file, "."+name); err != nil {
+		return "", util.WrapError(err)
+	}
+
+	href := config.Domain + name
+	media.pending[href] = time.Now()
+
+	return href, nil
+}
+
+// mediaWritten marks media as used by a post that has been written.
+func mediaWritten(href string) {
+	media.Lock()
+	delete(media.pending, href)
+	media.Unlock()
+}
+
+// isPending reports whether href is waiting for its post to be written.
+// The lock must be held.
+func isPending(href string) bool {
+	stored, ok := media.pending[href]
+	if ok && time.Since(stored) > pendingMedia {
+		delete(media.pending, href)
+		return false
+	}
+
+	return ok
+}
+
+// StoreMedia stores the local file of an attachment by its contents, and
+// returns the attachment with its new href.
+func (obj ObjectBase) StoreMedia() (ObjectBase, error) {
+	file := localFile(obj.Href)
+	if file == "" {
+		return obj, nil
+	}
+
+	sum, err := hashMedia(file)
+	if err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	href, err := storeMedia(file, sum)
+	if err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	obj.Href = href
+	return obj, nil
+}
+
+// DiscardMedia removes the stored files of an attachment whose post is never
+// going to be written, unless other posts use them.
+func (obj ObjectBase) DiscardMedia() error {
+	hrefs := []string{obj.Href}
+	if obj.Preview != nil {
+		hrefs = append(hrefs, obj.Preview.Href)
+	}
+
+	media.Lock()
+	defer media.Unlock()
+
+	for _, href := range hrefs {
+		file := localFile(href)
+		if file == "" {
+			continue
+		}
+
+		delete(media.pending, href)
+
+		var total int
+		if err := config.DB.QueryRow(`select count(*) from activitystream where href=$1`, href).Scan(&total); err != nil {
+			return util.WrapError(err)
+		} else if total > 0 {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package activitypub
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// inTempDir runs a test from an empty directory with the ones media is kept
+// in.
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, e := range []string{"public", tempDir} {
+		if err := os.Mkdir(e, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStoreMedia(t *testing.T) {
+	inTempDir(t)
+
+	store := func(data string) (string, string) {
+		f, err := tempMedia("png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+
+		sum, err := hashMedia(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		href, err := storeMedia(f.Name(), sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f.Name(), href
+	}
+
+	first, a := store("same")
+	second, b := store("same")
+	_, c := store("different")
+
+	if a != b {
+		t.Errorf("identical media stored as %q and %q", a, b)
+	} else if a == c {
+		t.Errorf("different media both stored as %q", a)
+	}
+
+	for _, e := range []string{first, second} {
+		if _, err := os.Stat(e); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s is still there after being stored", e)
+		}
+	}
+
+	if _, err := os.Stat(localFile(a)); err != nil {
+		t.Errorf("stored media is missing: %v", err)
+	}
+
+	media.Lock()
+	pending := isPending(a)
+	media.Unlock()
+	if !pending {
+		t.Errorf("%s isn't pending until its post is written", a)
+	}
+
+	mediaWritten(a)
+	mediaWritten(c)
+}
+
+func TestUnusedFiles(t *testing.T) {
+	media.Lock()
+	defer media.Unlock()
+
+	pending := config.Domain + "/public/pending.png"
+	media.pending[pending] = time.Now()
+	defer delete(media.pending, pending)
+
+	totals := map[string]int{
+		config.Domain + "/public/a.png":        1,
+		config.Domain + "/public/b.png":        3,
+		config.Domain + "/public/c.png":        2,
+		config.Domain + "/static/notfound.png": 1,
+		pending:                                0,
+	}
+
+	uses := map[string]int{
+		config.Domain + "/public/a.png":        1, // only this post
+		config.Domain + "/public/b.png":        1, // two others still use it
+		config.Domain + "/public/c.png":        2, // every use is going
+		config.Domain + "/static/notfound.png": 1,
+		pending:                                1,
+	}
+
+	got, err := unusedFiles(uses, func(href string) (int, error) {
+		return totals[href], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+	if want := []string{"public/a.png", "public/c.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unusedFiles() = %q, want %q", got, want)
+	}
+
+	if _, err := unusedFiles(uses, func(string) (int, error) { return 0, errors.New("oops") }); err == nil {
+		t.Error("unusedFiles() ignored an error counting uses")
+	}
+}
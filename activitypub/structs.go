@@ -22,6 +22,7 @@ type ActivityRaw struct {
 	Published time.Time       `json:"published,omitempty"`
 	ActorRaw  json.RawMessage `json:"actor,omitempty"`
 	ObjectRaw json.RawMessage `json:"object,omitempty"`
+	TargetRaw json.RawMessage `json:"target,omitempty"`
 }
 
 type AtContext struct {
@@ -80,6 +81,13 @@ type Actor struct {
 	PublicKey         *PublicKeyPem `json:"publicKey,omitempty"`
 	Summary           string        `json:"summary,omitempty"`
 	Restricted        bool          `json:"restricted"`
+	AlsoKnownAs       []string      `json:"alsoKnownAs,omitempty"`
+	MovedTo           string        `json:"movedTo,omitempty"`
+	Endpoints         *Endpoints    `json:"endpoints,omitempty"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
 }
 
 type PublicKeyPem struct {
@@ -99,6 +107,7 @@ type Activity struct {
 	Cc        []string   `json:"cc,omitempty"`
 	Published time.Time  `json:"published,omitempty"`
 	Object    ObjectBase `json:"object,omitempty"`
+	Target    string     `json:"target,omitempty"`
 
 	// Auth      string     `json:"auth,omitempty"`
 	// Bto       []string   `json:"bto,omitempty"`
@@ -111,6 +120,7 @@ type ObjectBase struct {
 	Option       []string        `json:"-"`
 	AttributedTo string          `json:"attributedTo,omitempty"`
 	TripCode     string          `json:"tripcode,omitempty"`
+	Capcode      string          `json:"capcode,omitempty"`
 	Actor        string          `json:"actor,omitempty"`
 	Content      string          `json:"content,omitempty"`
 	InReplyTo    []ObjectBase    `json:"inReplyTo,omitempty"`
@@ -128,16 +138,24 @@ type ObjectBase struct {
 	Bcc          string          `json:"Bcc,omitempty"`
 	MediaType    string          `json:"mediatype,omitempty"`
 	Size         int64           `json:"size,omitempty"`
+	Width        int             `json:"width,omitempty"`
+	Height       int             `json:"height,omitempty"`
+	Duration     Duration        `json:"duration,omitempty"`
 	Sensitive    bool            `json:"sensitive,omitempty"`
 	Sticky       bool            `json:"sticky,omitempty"`
 	Locked       bool            `json:"locked,omitempty"`
+	BumpLimit    bool            `json:"-"`
+	ImageLimit   bool            `json:"-"`
+	Number       int             `json:"-"` // per-board post number, if local
+	PosterID     string          `json:"posterid,omitempty"`
+	Cites        []ObjectBase    `json:"-"` // posts this one cites, when writing it
+	Backlinks    []ObjectBase    `json:"-"` // posts that cite this one
 
 	// Alias        string          `json:"alias,omitempty"`
 	// Audience     string          `json:"audience,omitempty"`
 	// Bto          []string        `json:"bto,omitempty"`
 	// ContentHTML  template.HTML   `json:"contenthtml,omitempty"`
 	// Deleted      string          `json:"deleted,omitempty"`
-	// Duration     string          `json:"duration,omitempty"`
 	// EndTime      string          `json:"endTime,omitempty"`
 	// Generator    string          `json:"generator,omitempty"`
 	// Icon         string          `json:"icon,omitempty"`
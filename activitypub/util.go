@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"mime/multipart"
 	"os"
-	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -39,20 +39,21 @@ func CreateAttachmentObject(file multipart.File, header *multipart.FileHeader) (
 	filename := header.Filename
 	size := header.Size
 
-	fileType := path.Ext(header.Filename)
-	name := fmt.Sprint(time.Now().UTC().Unix())
-
-	tempFile, err := os.Create(fmt.Sprintf("./public/%s%s", name, fileType))
+	// Where it belongs isn't known until it's written; see StoreMedia.
+	tempFile, err := tempMedia(mediaExtension(contentType, filename))
 	if err != nil {
 		return nil, nil, util.WrapError(err)
 	}
 
+	// Only until it's stored; nothing is served from here.
+	href := "/tmp/" + filepath.Base(tempFile.Name())
+
 	var nAttachment []ObjectBase
 	var image ObjectBase
 
 	image.Type = "Attachment"
 	image.Name = filename
-	image.Href = fmt.Sprintf("%s/public/%s%s", config.Domain, name, fileType)
+	image.Href = config.Domain + href
 	image.MediaType = contentType
 	image.Size = size
 	image.Published = time.Now().UTC()
@@ -156,6 +157,16 @@ func GetActivityFromJson(ctx *fiber.Ctx) (Activity, error) {
 
 		nActivity.Name = respActivity.Name
 		nActivity.Object = jObj
+
+		if len(respActivity.TargetRaw) > 0 {
+			// The target can be an ID or an embedded object, same as an actor.
+			target, err := GetActorFromJson(respActivity.TargetRaw)
+			if err != nil {
+				return nActivity, util.WrapError(err)
+			}
+
+			nActivity.Target = target.Id
+		}
 	} else if err != nil {
 		return nActivity, util.WrapError(err)
 	}
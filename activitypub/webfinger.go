@@ -41,6 +41,7 @@ type Board struct {
 	TP          string
 	Restricted  bool
 	Post        ObjectBase
+	Settings    Settings
 }
 
 type BoardSortAsc []Board
@@ -58,11 +59,25 @@ func GetActor(id string) (Actor, error) {
 
 	actor, instance := GetActorAndInstance(id)
 
-	if ActorCache[actor+"@"+instance].Id != "" {
-		respActor = ActorCache[actor+"@"+instance]
-		return respActor, nil
+	if cached, ok := CachedActor(actor, instance); ok {
+		return cached, nil
+	}
+
+	respActor, err := fetchActor(id)
+	if err != nil {
+		return respActor, util.WrapError(err)
 	}
 
+	cacheActor(actor, instance, respActor)
+
+	return respActor, nil
+}
+
+// fetchActor asks the instance of id for the actor, without looking at or
+// filling the cache.
+func fetchActor(id string) (Actor, error) {
+	var respActor Actor
+
 	req, err := http.NewRequest("GET", strings.TrimSpace(id), nil)
 	if err != nil {
 		return respActor, util.WrapError(err)
@@ -84,8 +99,6 @@ func GetActor(id string) (Actor, error) {
 		return respActor, util.WrapError(err)
 	}
 
-	ActorCache[actor+"@"+instance] = respActor
-
 	return respActor, nil
 }
 
@@ -99,8 +112,8 @@ func FingerActor(path string) (Actor, error) {
 		return nActor, nil
 	}
 
-	if ActorCache[actor+"@"+instance].Id != "" {
-		nActor = ActorCache[actor+"@"+instance]
+	if cached, ok := CachedActor(actor, instance); ok {
+		nActor = cached
 	} else {
 		resp, err := FingerRequest(actor, instance)
 		if err != nil {
@@ -116,7 +129,7 @@ func FingerActor(path string) (Actor, error) {
 			return nActor, util.WrapError(err)
 		}
 
-		ActorCache[actor+"@"+instance] = nActor
+		cacheActor(actor, instance, nActor)
 	}
 
 	return nActor, nil
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var Port = ":" + GetConfigValue("instanceport", "3000")
@@ -23,13 +24,50 @@ var SiteEmailSMTP = GetConfigValue("emailsmtp", fmt.Sprintf("%s:%s", SiteEmailSe
 var TorProxy = GetConfigValue("torproxy", "") //127.0.0.1:9050
 var Salt = GetConfigValue("instancesalt", "")
 var DBHost = GetConfigValue("dbhost", "localhost")
-var DBPort, _ = strconv.Atoi(GetConfigValue("dbport", "5432"))
+var DBPort = configInt("dbport", "5432")
 var DBUser = GetConfigValue("dbuser", "postgres")
 var DBPassword = GetConfigValue("dbpass", "password")
 var DBName = GetConfigValue("dbname", "server")
 var CookieKey = GetConfigValue("cookiekey", "")
+var InboxRate = configFloat("inboxrate", "120")        // activities per minute per instance
+var InboxBurst = configFloat("inboxburst", "240")      // activities an instance can send at once
+var ActorRate = configFloat("actorrate", "30")         // activities per minute per actor
+var ActorBurst = configFloat("actorburst", "60")       // activities an actor can send at once
+var AddressRate = configFloat("addressrate", "600")    // unverified activities per minute per address
+var AddressBurst = configFloat("addressburst", "1200") // unverified activities an address can send at once
+var DailyPosts = configInt("dailyposts", "5000")       // posts cached per instance per day, 0 for no limit
+var dailyMediaMB = int64(configInt("dailymedia", "1024"))
+var DailyMedia = dailyMediaMB * 1024 * 1024 // media bytes cached per instance per day, 0 for no limit
+var remoteMediaMB = int64(configInt("maxremotemedia", "100"))
+var MaxRemoteMedia = remoteMediaMB * 1024 * 1024 // bytes read of a remote file before giving up on it
 var ActivityStreams = "application/ld+json; profile=\"https://www.w3.org/ns/activitystreams\""
-var PostCountPerPage = 10
+var MaxFiles = configInt("maxfiles", "4")          // files per post
+var DeleteWindow = configInt("deletewindow", "30") // minutes posters have to delete their posts
+var maxFileSizeMB = configInt("maxfilesize", "7")
+var MaxFileSize = maxFileSizeMB * 1024 * 1024                                              // bytes per file
+var MaxComment = configInt("maxcomment", "4500")                                           // characters per comment
+var MaxName = configInt("maxname", "100")                                                  // characters per name or subject
+var MaxLines = configInt("maxlines", "50")                                                 // lines per comment
+var TruncateLines = configInt("truncatelines", "30")                                       // lines shown before a post is cut short
+var MaxThreads = configInt("maxthreads", "165")                                            // threads kept before archiving
+var ThreadsPerPage = configInt("threadsperpage", "15")                                     // threads per index page
+var MaxPages = configInt("maxpages", "10")                                                 // index pages
+var BumpLimit = configInt("bumplimit", "300")                                              // replies that bump a thread, 0 for no limit
+var ImageLimit = configInt("imagelimit", "150")                                            // files in a thread, 0 for no limit
+var ArchiveRetention = configInt("archiveretention", "0")                                  // days archived threads are kept, 0 to keep them forever
+var PurgeArchive = GetConfigValue("purgearchive", "false") == "true"                       // delete old archived threads rather than only their media
+var ReplyCooldown = configInt("replycooldown", "10")                                       // seconds between replies from a poster, 0 for none
+var ThreadCooldown = configInt("threadcooldown", "120")                                    // seconds between threads from a poster, 0 for none
+var IdenticalCooldown = configInt("identicalcooldown", "600")                              // seconds before a poster can repeat a comment, 0 for none
+var PosterIDs = GetConfigValue("posterids", "false") == "true"                             // show who made each post in its thread
+var Originality = GetConfigValue("originality", "false") == "true"                         // only take comments that haven't been posted before
+var OriginalMedia = GetConfigValue("originalmedia", "false") == "true"                     // and files, with originality
+var PostMode = GetConfigValue("postmode", "opfile")                                        // which posts need a file: opfile, optional, text or files
+var ProxyHeader = GetConfigValue("proxyheader", "")                                        // X-Forwarded-For
+var TrustedProxies = strings.Split(GetConfigValue("trustedproxies", "127.0.0.1,::1"), ",") // addresses or ranges of proxies allowed to set ProxyHeader
+var posterHashHours = configInt("posterhashrotation", "24")
+var PosterHashRotation = time.Duration(posterHashHours) * time.Hour // how often poster hashes change
+var MediaHashDistance = configInt("mediahashdistance", "8")         // bits a file's perceptual hash may differ from a banned one's, -1 to only ban exact files
 var SupportedFiles = []string{"image/gif", "image/jpeg", "image/png", "image/webp", "image/apng", "video/mp4", "video/ogg", "video/webm", "audio/mpeg", "audio/ogg", "audio/wav", "audio/wave", "audio/x-wav"}
 var MediaHashs = make(map[string]string)
 var Key = GetConfigValue("modkey", "")
@@ -50,6 +88,42 @@ var deprecated = map[string]string{
 	"emailnotify": "This option no longer has any effect. All users who have a registered email address are notified.",
 }
 
+// badValues holds an error for every number in the config that couldn't be
+// read, which are reported by CheckValues.
+var badValues []string
+
+func configInt(key, ifnone string) int {
+	value := GetConfigValue(key, ifnone)
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		badValues = append(badValues, fmt.Sprintf("%s: %q isn't a whole number", key, value))
+	}
+
+	return n
+}
+
+func configFloat(key, ifnone string) float64 {
+	value := GetConfigValue(key, ifnone)
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		badValues = append(badValues, fmt.Sprintf("%s: %q isn't a number", key, value))
+	}
+
+	return n
+}
+
+// CheckValues returns an error describing every value in the config that
+// couldn't be read, if there are any.
+func CheckValues() error {
+	if len(badValues) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("bad config values:\n\t%s", strings.Join(badValues, "\n\t"))
+}
+
 // TODO Change this to some other config format like YAML
 // to save into a struct and only read once
 func GetConfigValue(value string, ifnone string) string {
@@ -79,6 +153,37 @@ func GetConfigValue(value string, ifnone string) string {
 	return ifnone
 }
 
+// GetConfigValues returns every value whose key starts with prefix, keyed by
+// the rest of the key.
+func GetConfigValues(prefix string) map[string]string {
+	values := make(map[string]string)
+
+	file, err := os.Open("fchan.cfg")
+	if err != nil {
+		log.Println(err)
+		return values
+	}
+
+	defer file.Close()
+
+	lines := bufio.NewScanner(file)
+
+	for lines.Scan() {
+		line := strings.SplitN(lines.Text(), ":", 2)
+
+		if len(line) == 2 && strings.HasPrefix(line[0], prefix) {
+			key := strings.TrimPrefix(line[0], prefix)
+
+			// First one wins, same as GetConfigValue
+			if _, ok := values[key]; !ok {
+				values[key] = line[1]
+			}
+		}
+	}
+
+	return values
+}
+
 func IsEmailSetup() bool {
 	return SiteEmail != ""
 }
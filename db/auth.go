@@ -7,12 +7,16 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"errors"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
 )
 
 var (
-	ErrInvalid = errors.New("invalid username or password")
+	ErrInvalid        = errors.New("invalid username or password")
+	ErrTooManyGuesses = errors.New("too many wrong passwords")
 )
 
 type AcctType int
@@ -54,6 +58,17 @@ func (a AcctType) String() string {
 	}
 }
 
+// ParseAcctType is the inverse of AcctType.String.
+func ParseAcctType(s string) AcctType {
+	for _, t := range []AcctType{Janitor, Mod, Admin} {
+		if strings.EqualFold(s, t.String()) {
+			return t
+		}
+	}
+
+	return None
+}
+
 func makeSalt() []byte {
 	// The panics are here because if there is an error here, its probably
 	// fatal anyway.
@@ -188,3 +203,85 @@ func User(name string) (Acct, error) {
 
 	return user, err
 }
+
+// SetPostPassword saves the password a poster can later delete a post with.
+func SetPostPassword(id, password string) error {
+	salt := makeSalt()
+	plaintext := makePwText(password, salt)
+	ciphertext := sha256.Sum256(plaintext)
+
+	_, err := config.DB.Exec(`insert into postpassword (id, password, salt) values ($1, $2, $3) on conflict (id) do update set password=excluded.password, salt=excluded.salt`, id, ciphertext[:], salt)
+	return wrapErr(err)
+}
+
+// Wrong guesses allowed at a post's password before it's locked for a while.
+const (
+	maxPasswordGuesses  = 5
+	passwordGuessWindow = 15 * time.Minute
+)
+
+type guesses struct {
+	count int
+	since time.Time
+}
+
+// passwordGuesses counts the wrong guesses at each post's password, so they
+// can't be brute forced.
+var passwordGuesses struct {
+	sync.Mutex
+	m map[string]*guesses
+}
+
+// CheckPostPassword determines if password is the one a post was made with.
+// Posts made without one can't be deleted by their poster.
+// After too many wrong guesses, ErrTooManyGuesses is returned until the
+// window passes.
+func CheckPostPassword(id, password string) (bool, error) {
+	now := time.Now()
+
+	passwordGuesses.Lock()
+	defer passwordGuesses.Unlock()
+
+	if passwordGuesses.m == nil {
+		passwordGuesses.m = make(map[string]*guesses)
+	}
+
+	g, ok := passwordGuesses.m[id]
+	if ok && now.Sub(g.since) > passwordGuessWindow {
+		delete(passwordGuesses.m, id)
+		ok = false
+	}
+
+	if ok && g.count >= maxPasswordGuesses {
+		return false, ErrTooManyGuesses
+	}
+
+	var pwhash, salt []byte
+
+	if password == "" || config.DB.QueryRow(`select password, salt from postpassword where id=$1`, id).Scan(&pwhash, &salt) != nil {
+		return false, nil
+	}
+
+	plaintext := makePwText(password, salt)
+	ciphertext := sha256.Sum256(plaintext)
+
+	if bytes.Equal(ciphertext[:], pwhash) {
+		return true, nil
+	}
+
+	if len(passwordGuesses.m) > 4096 {
+		for k, v := range passwordGuesses.m {
+			if now.Sub(v.since) > passwordGuessWindow {
+				delete(passwordGuesses.m, k)
+			}
+		}
+	}
+
+	if !ok {
+		g = &guesses{since: now}
+		passwordGuesses.m[id] = g
+	}
+	g.count++
+
+	return false, nil
+}
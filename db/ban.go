@@ -0,0 +1,161 @@
+package db
+
+import (
+	"database/sql"
+	"net"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// Ban stops a poster, or a range of addresses, from posting.
+type Ban struct {
+	ID int
+
+	// Board is the ID of the board the ban applies to, or empty if it
+	// applies to all of them.
+	Board string
+
+	// A ban is either on the poster of Post, by their hash, or on Range.
+	Hash  string
+	Key   int
+	Range string
+	Post  string
+
+	Reason  string
+	Staff   string
+	Created time.Time
+	Expires time.Time // zero if the ban doesn't expire
+
+	Appeal       string
+	AppealDenied bool
+}
+
+const banColumns = `id, board, hash, coalesce(key, 0), iprange, post, reason, staff, created, expires, appeal, appealdenied`
+
+func scanBan(row interface{ Scan(...interface{}) error }) (Ban, error) {
+	var b Ban
+	var expires sql.NullTime
+
+	err := row.Scan(&b.ID, &b.Board, &b.Hash, &b.Key, &b.Range, &b.Post, &b.Reason, &b.Staff, &b.Created, &expires, &b.Appeal, &b.AppealDenied)
+	b.Expires = expires.Time
+	return b, err
+}
+
+// Save creates the ban.
+func (b Ban) Save() error {
+	var key, expires interface{}
+	if b.Hash != "" {
+		key = b.Key
+	}
+
+	if !b.Expires.IsZero() {
+		expires = b.Expires.UTC()
+	}
+
+	query := `insert into bans (board, hash, key, iprange, post, reason, staff, created, expires) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := config.DB.Exec(query, b.Board, b.Hash, key, b.Range, b.Post, b.Reason, b.Staff, time.Now().UTC(), expires)
+	return wrapErr(err)
+}
+
+// Matches determines if the ban applies to the poster at ip.
+func (b Ban) Matches(ip string) (bool, error) {
+	if b.Range != "" {
+		_, ipnet, err := net.ParseCIDR(b.Range)
+		if err != nil {
+			return false, wrapErr(err)
+		}
+
+		return ipnet.Contains(net.ParseIP(ip)), nil
+	}
+
+	key, err := posterKeyByID(b.Key)
+	if err != nil {
+		return false, wrapErr(err)
+	} else if key == nil {
+		return false, nil
+	}
+
+	return hashPoster(key, ip) == b.Hash, nil
+}
+
+// FindBan returns the ban stopping the poster at ip from posting on board, or
+// nil if there isn't one.
+func FindBan(board, ip string) (*Ban, error) {
+	bans, err := queryBans(`select `+banColumns+` from bans where (board='' or board=$1) and (expires is null or expires > $2) order by expires desc nulls first`, board, time.Now().UTC())
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	for _, b := range bans {
+		if ok, err := b.Matches(ip); err != nil {
+			return nil, wrapErr(err)
+		} else if ok {
+			return &b, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetBan returns a ban by its ID.
+func GetBan(id int) (Ban, error) {
+	b, err := scanBan(config.DB.QueryRow(`select `+banColumns+` from bans where id=$1`, id))
+	return b, wrapErr(err)
+}
+
+// Bans returns every ban that hasn't expired, with appeals first.
+func Bans() ([]Ban, error) {
+	bans, err := queryBans(`select `+banColumns+` from bans where expires is null or expires > $1 order by (appeal != '' and not appealdenied) desc, created desc`, time.Now().UTC())
+	return bans, wrapErr(err)
+}
+
+func queryBans(query string, args ...interface{}) ([]Ban, error) {
+	rows, err := config.DB.Query(query, args...)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		b, err := scanBan(rows)
+		if err != nil {
+			return bans, wrapErr(err)
+		}
+
+		bans = append(bans, b)
+	}
+
+	return bans, nil
+}
+
+// EditBan changes the reason and expiry of a ban.
+func EditBan(id int, reason string, expires time.Time) error {
+	var exp interface{}
+	if !expires.IsZero() {
+		exp = expires.UTC()
+	}
+
+	_, err := config.DB.Exec(`update bans set reason=$1, expires=$2 where id=$3`, reason, exp, id)
+	return wrapErr(err)
+}
+
+// LiftBan removes a ban.
+func LiftBan(id int) error {
+	_, err := config.DB.Exec(`delete from bans where id=$1`, id)
+	return wrapErr(err)
+}
+
+// AppealBan saves the appeal of a ban.
+// Bans can only be appealed once.
+func AppealBan(id int, appeal string) error {
+	_, err := config.DB.Exec(`update bans set appeal=$1 where id=$2 and appeal=''`, appeal, id)
+	return wrapErr(err)
+}
+
+// DenyAppeal denies the appeal of a ban, leaving the ban as it is.
+func DenyAppeal(id int) error {
+	_, err := config.DB.Exec(`update bans set appealdenied=true where id=$1`, id)
+	return wrapErr(err)
+}
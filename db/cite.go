@@ -0,0 +1,242 @@
+package db
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
+	"github.com/KushBlazingJudah/fedichan/internal/rx"
+)
+
+// Besides full IDs, posts can cite:
+//   - posts on the same board by number, as >>1234
+//   - boards, as >>>/board/ or >>>/board@instance/
+//   - posts on other boards, as >>>/board/ID or >>>/board@instance/ID, where
+//     local posts can also be cited by number
+//
+// These are turned into full IDs when posting, so other instances see real
+// links; boards become their ID followed by a slash.
+
+// How much of a post is shown when hovering over a link to it.
+const citeTitleLen = 100
+
+// ExpandCites turns the citations of comment that aren't full IDs into ones
+// that are.
+// Citations of posts or boards that can't be found are left alone.
+// Nothing in code blocks and the like is changed, as it isn't read as markup.
+func ExpandCites(board activitypub.Actor, comment string) string {
+	return markup.OutsideBlocks(comment, func(text string) string {
+		text = expandNumberCites(text, board.GetPostByNumber)
+
+		return rx.BoardCite.ReplaceAllStringFunc(text, func(cite string) string {
+			id, post := resolveBoardCite(cite, true)
+			if id == "" {
+				return cite
+			} else if !post {
+				return ">>" + id + "/"
+			}
+
+			return ">>" + id
+		})
+	})
+}
+
+// expandNumberCites turns >>1234 citations in text into the IDs that post
+// returns for their numbers.
+func expandNumberCites(text string, post func(n int) (string, error)) string {
+	return rx.NumberCite.ReplaceAllStringFunc(text, func(cite string) string {
+		n, err := strconv.Atoi(strings.TrimPrefix(cite, ">>"))
+		if err != nil {
+			return cite
+		}
+
+		id, err := post(n)
+		if err != nil {
+			return cite
+		}
+
+		return ">>" + id
+	})
+}
+
+// resolveBoardCite returns the ID of what a >>>/board/ citation points to, and
+// whether it is a post rather than a board.
+// Boards on other instances are only looked up if finger is set; otherwise
+// they have to be known already.
+// An empty ID is returned if it can't be found.
+func resolveBoardCite(cite string, finger bool) (string, bool) {
+	m := rx.BoardCite.FindStringSubmatch(cite)
+	if m == nil {
+		return "", false
+	}
+
+	name, instance, ref := m[1], m[2], m[3]
+	local := instance == "" || instance == stripTransferProtocol(config.Domain)
+
+	var actor activitypub.Actor
+	var err error
+
+	if local {
+		actor, err = activitypub.GetActorByNameFromDB(name)
+	} else if finger {
+		actor, err = activitypub.FingerActor(name + "@" + instance)
+	} else {
+		actor, _ = activitypub.CachedActor(name, instance)
+	}
+
+	if err != nil || actor.Id == "" {
+		return "", false
+	} else if ref == "" {
+		return actor.Id, false
+	}
+
+	if !local {
+		id := actor.Id + "/" + ref
+		if exists, err := postExists(id); err == nil && exists {
+			return id, true
+		}
+
+		// Numbers only mean something on the instance that gave them, so
+		// one we don't know can't be turned into an ID.
+		if _, err := strconv.Atoi(ref); err == nil {
+			return "", false
+		}
+
+		// We can't tell whether it exists without asking, which isn't
+		// worth it just to post a link.
+		return id, true
+	}
+
+	if n, err := strconv.Atoi(ref); err == nil {
+		if id, err := actor.GetPostByNumber(n); err == nil {
+			return id, true
+		}
+	}
+
+	id := actor.Id + "/" + ref
+	if exists, err := postExists(id); err != nil || !exists {
+		return "", false
+	}
+
+	return id, true
+}
+
+func postExists(id string) (bool, error) {
+	var exists bool
+
+	query := `select exists (select 1 from activitystream where id=$1 and type in ('Note', 'Archive') union select 1 from cacheactivitystream where id=$1 and type in ('Note', 'Archive'))`
+	err := config.DB.QueryRow(query, id).Scan(&exists)
+	return exists, wrapErr(err)
+}
+
+// citeText returns what a citation of id is shown as: its number if it is a
+// post on board, or its short ID otherwise.
+func citeText(board activitypub.Actor, id string) string {
+	if strings.HasPrefix(id, board.Id+"/") {
+		if n, err := (activitypub.ObjectBase{Id: id}).GetNumber(); err == nil && n != 0 {
+			return strconv.Itoa(n)
+		}
+	}
+
+	return shortURL(board.Outbox, id)
+}
+
+// crossCiteText returns what a citation of a post on actor in another thread
+// is shown as, after the >>.
+// Posts on other boards are shown the same way they are written, such as
+// >/board/1234 or >/board@instance/ID.
+func crossCiteText(board, actor activitypub.Actor, id string) string {
+	if actor.Id == board.Id {
+		return citeText(board, id)
+	}
+
+	ref := localShort(id)
+	if n, err := (activitypub.ObjectBase{Id: id}).GetNumber(); err == nil && n != 0 {
+		ref = strconv.Itoa(n)
+	}
+
+	return template.HTMLEscapeString(">/" + boardName(actor) + "/" + ref)
+}
+
+// boardName returns the name of a board as it's written in citations.
+func boardName(actor activitypub.Actor) string {
+	if strings.HasPrefix(actor.Id, config.Domain+"/") {
+		return actor.Name
+	}
+
+	if u, err := url.Parse(actor.Id); err == nil {
+		return actor.Name + "@" + u.Host
+	}
+
+	return actor.Name
+}
+
+// citedBoard returns the board with the ID id.
+// Boards on other instances we haven't looked up before are made up from
+// their ID, as pages shouldn't wait on other instances.
+func citedBoard(id string) activitypub.Actor {
+	if strings.HasPrefix(id, config.Domain+"/") {
+		actor, _ := activitypub.GetActorFromDB(id)
+		return actor
+	}
+
+	u, err := url.Parse(id)
+	if err != nil || u.Host == "" {
+		return activitypub.Actor{}
+	}
+
+	name := path.Base(u.Path)
+	if actor, ok := activitypub.CachedActor(name, u.Host); ok {
+		return actor
+	}
+
+	return activitypub.Actor{Id: id, Name: name}
+}
+
+// boardOf returns the ID of the board the post id is on.
+func boardOf(id string) string {
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		return id[:i]
+	}
+
+	return id
+}
+
+// boardLink renders a citation of the board id.
+func boardLink(id string) string {
+	actor := citedBoard(id)
+	if actor.Id == "" {
+		return fmt.Sprintf(`<a class="reply dead">&gt;&gt;%s/</a>`, template.HTMLEscapeString(id))
+	}
+
+	href := actor.Id
+	if strings.HasPrefix(actor.Id, config.Domain+"/") {
+		href = "/" + actor.Name
+	}
+
+	return fmt.Sprintf(`<a class="reply" title="%s" href="%s">&gt;&gt;&gt;/%s/ →</a>`, template.HTMLEscapeString(actor.PreferredUsername), template.HTMLEscapeString(href), template.HTMLEscapeString(boardName(actor)))
+}
+
+// citeTitle returns the start of the post id to show when hovering over a
+// link to it, or an empty string if we don't have it.
+func citeTitle(id string) string {
+	var content string
+
+	query := `select content from activitystream where id=$1 union select content from cacheactivitystream where id=$1 limit 1`
+	if err := config.DB.QueryRow(query, id).Scan(&content); err != nil {
+		return ""
+	}
+
+	content = strings.Join(strings.Fields(content), " ")
+	if r := []rune(content); len(r) > citeTitleLen {
+		content = string(r[:citeTitleLen]) + "…"
+	}
+
+	return template.HTMLEscapeString(content)
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+)
+
+func TestExpandNumberCites(t *testing.T) {
+	posts := map[int]string{
+		1:  "https://example.com/b/AAAA",
+		12: "https://example.com/b/BBBB",
+	}
+
+	post := func(n int) (string, error) {
+		if id, ok := posts[n]; ok {
+			return id, nil
+		}
+
+		return "", errors.New("no such post")
+	}
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"cite", ">>12", ">>https://example.com/b/BBBB"},
+		{"several", ">>1 and >>12", ">>https://example.com/b/AAAA and >>https://example.com/b/BBBB"},
+		{"unknown", ">>3", ">>3"},
+		{"part of a word", ">>12abc", ">>12abc"},
+		{"not a cite", "12", "12"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandNumberCites(tt.in, post); got != tt.want {
+				t.Errorf("expandNumberCites(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandCitesSkipsBlocks(t *testing.T) {
+	// Nothing here is looked up, so no database is needed.
+	for _, in := range []string{"[code]>>12 >>>/b/1[/code]", "[aa]>>1[/aa]"} {
+		if got := ExpandCites(activitypub.Actor{}, in); got != in {
+			t.Errorf("ExpandCites(%q) = %q, want it unchanged", in, got)
+		}
+	}
+}
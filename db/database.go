@@ -65,6 +65,11 @@ func CreateNewBoard(actor activitypub.Actor) (activitypub.Actor, error) {
 
 	log.Println("board added")
 
+	// The board may reuse the name of one that moved away.
+	if err := activitypub.DeleteMove(actor.Id); err != nil {
+		return actor, wrapErr(err)
+	}
+
 	activitypub.CreatePem(actor)
 
 	if actor.Name != "main" {
@@ -140,12 +145,12 @@ func GetReplyOP(link string) (string, error) {
 }
 
 func IsHashBanned(hash string) (bool, error) {
-	var h string
+	var banned bool
 
-	query := `select hash from bannedmedia where hash=$1`
-	_ = config.DB.QueryRow(query, hash).Scan(&h)
+	query := `select exists (select from bannedmedia where hash=$1)`
+	err := config.DB.QueryRow(query, hash).Scan(&banned)
 
-	return h == hash, nil
+	return banned, wrapErr(err)
 }
 
 func PrintAdminAuth() error {
@@ -171,8 +176,15 @@ func PrintAdminAuth() error {
 	return a.SetPassword(string(pw))
 }
 
-func InitInstance() error {
+// InitInstance creates the instance actor if needed.
+// If the instance used to be somewhere else, it's only moved if moveFrom says
+// where; otherwise nothing is started.
+func InitInstance(moveFrom string) error {
 	if config.InstanceName != "" {
+		if err := checkDomain(moveFrom); err != nil {
+			return wrapErr(err)
+		}
+
 		if _, err := CreateNewBoard(*activitypub.CreateNewActor("", config.InstanceName, config.InstanceSummary, false)); err != nil {
 			return wrapErr(err)
 		}
@@ -181,6 +193,30 @@ func InitInstance() error {
 	return nil
 }
 
+// checkDomain moves the instance if the configured domain no longer matches
+// the one in the database, such as after switching from HTTP to HTTPS.
+// Moving rewrites every ID and can't be taken back, so a typo or a copy of the
+// database mustn't do it: moveFrom has to name the old domain.
+func checkDomain(moveFrom string) error {
+	var id string
+
+	if err := config.DB.QueryRow(`select id from actor where name='main'`).Scan(&id); err != nil {
+		// Nothing to move on a fresh database.
+		return nil
+	}
+
+	if id == config.Domain {
+		return nil
+	}
+
+	if moveFrom != id {
+		return fmt.Errorf("the database is for %s, not %s; check the instance and instancetp config values, or start with -move-from %s to move every board to %s for good", id, config.Domain, id, config.Domain)
+	}
+
+	log.Printf("moving the instance from %s to %s", id, config.Domain)
+	return activitypub.MoveInstance(id)
+}
+
 func GetPostIDFromNum(num string) (string, error) {
 	var postID string
 
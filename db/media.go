@@ -0,0 +1,450 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/phash"
+)
+
+const thumbnailSize = 100
+
+// MediaBan bans a file, and files that look like it.
+type MediaBan struct {
+	ID      int
+	Hash    string // SHA-256 of the entire file
+	PHash   uint64 // perceptual hash, if HasPHash
+	Created time.Time
+
+	HasPHash bool
+}
+
+// Checking media means hashing it, so remember what we decided for files we
+// have already seen.
+// Remote media is checked when it's cached and every time it's proxied, which
+// would otherwise mean decoding it every time.
+var mediaVerdicts = struct {
+	sync.Mutex
+	banned map[string]bool
+}{banned: make(map[string]bool)}
+
+const maxMediaVerdicts = 4096
+
+func forgetMediaVerdicts() {
+	mediaVerdicts.Lock()
+	mediaVerdicts.banned = make(map[string]bool)
+	mediaVerdicts.Unlock()
+}
+
+func hashFile(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// legacyMediaHash is how media used to be banned: by the SHA-256 of its first
+// 2048 bytes, padded with zeros if it's shorter.
+func legacyMediaHash(data []byte) string {
+	head := make([]byte, 2048)
+	copy(head, data)
+	return hashFile(head)
+}
+
+// HashMedia hashes media as it's read from r, the same way it's stored.
+func HashMedia(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", wrapErr(err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mediaImage returns what an image or video looks like, or nil if it isn't
+// one or can't be decoded.
+func mediaImage(data []byte) image.Image {
+	mime := http.DetectContentType(data)
+
+	if strings.HasPrefix(mime, "image/") {
+		img, err := activitypub.DecodeImage(data)
+		if err != nil {
+			return nil
+		}
+
+		return img
+	} else if strings.HasPrefix(mime, "video/") {
+		return videoFrame(data)
+	}
+
+	return nil
+}
+
+// fileImage is mediaImage for media already in file, which is read as little
+// as it can be.
+func fileImage(file string) image.Image {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	mime := http.DetectContentType(head[:n])
+
+	if strings.HasPrefix(mime, "image/") {
+		img, err := activitypub.DecodeImageFile(file)
+		if err != nil {
+			return nil
+		}
+
+		return img
+	} else if strings.HasPrefix(mime, "video/") {
+		return videoFileFrame(file)
+	}
+
+	return nil
+}
+
+// videoFrame returns the first frame of a video, using ffmpeg.
+func videoFrame(data []byte) image.Image {
+	// Most containers can't be read from a pipe.
+	f, err := os.CreateTemp("", "fchan-media")
+	if err != nil {
+		return nil
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return nil
+	}
+
+	return videoFileFrame(f.Name())
+}
+
+// videoFileFrame returns the first frame of the video in file, using ffmpeg.
+func videoFileFrame(file string) image.Image {
+	out, err := exec.Command("ffmpeg", "-v", "error", "-i", file, "-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-").Output()
+	if err != nil {
+		return nil
+	}
+
+	img, err := activitypub.DecodeImage(out)
+	if err != nil {
+		return nil
+	}
+
+	return img
+}
+
+// thumbnail shrinks img to fit in a square of size pixels and encodes it as
+// PNG.
+func thumbnail(img image.Image, size int) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w > h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+
+	if w < 1 {
+		w = 1
+	}
+
+	if h < 1 {
+		h = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			thumb.Set(x, y, img.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, thumb)
+	return buf.Bytes(), wrapErr(err)
+}
+
+// IsMediaBanned determines if data is banned, or looks like banned media.
+func IsMediaBanned(data []byte) (bool, error) {
+	return IsMediaHashBanned(hashFile(data), data)
+}
+
+// IsMediaFileBanned determines if the media in file is banned, or looks like
+// banned media, without reading all of it at once.
+func IsMediaFileBanned(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, wrapErr(err)
+	}
+	defer f.Close()
+
+	hash, err := HashMedia(f)
+	if err != nil {
+		return false, wrapErr(err)
+	}
+
+	head := make([]byte, 2048)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, wrapErr(err)
+	}
+
+	return mediaVerdict(hash, func() (bool, error) {
+		return isMediaBanned(hash, head[:n], func() image.Image {
+			return fileImage(file)
+		})
+	})
+}
+
+// IsMediaHashBanned determines if media with the SHA-256 hash is banned, or
+// looks like banned media if data isn't nil.
+func IsMediaHashBanned(hash string, data []byte) (bool, error) {
+	return mediaVerdict(hash, func() (bool, error) {
+		if data == nil {
+			return isMediaBanned(hash, nil, nil)
+		}
+
+		return isMediaBanned(hash, data, func() image.Image {
+			return mediaImage(data)
+		})
+	})
+}
+
+// mediaVerdict returns what was last decided about media with the hash, or
+// decides now.
+func mediaVerdict(hash string, decide func() (bool, error)) (bool, error) {
+	mediaVerdicts.Lock()
+	banned, ok := mediaVerdicts.banned[hash]
+	mediaVerdicts.Unlock()
+
+	if ok {
+		return banned, nil
+	}
+
+	banned, err := decide()
+	if err != nil {
+		return false, wrapErr(err)
+	}
+
+	mediaVerdicts.Lock()
+	if len(mediaVerdicts.banned) >= maxMediaVerdicts {
+		mediaVerdicts.banned = make(map[string]bool)
+	}
+	mediaVerdicts.banned[hash] = banned
+	mediaVerdicts.Unlock()
+
+	return banned, nil
+}
+
+// isMediaBanned decides whether media is banned by its hash, and if head, the
+// start of it, isn't nil, by what look says it looks like too.
+func isMediaBanned(hash string, head []byte, look func() image.Image) (bool, error) {
+	if banned, err := IsHashBanned(hash); err != nil || banned {
+		return banned, wrapErr(err)
+	}
+
+	if head == nil {
+		return false, nil
+	}
+
+	var legacy bool
+	query := `select exists (select from bannedmedia where hash=$1 and legacy=true)`
+	if err := config.DB.QueryRow(query, legacyMediaHash(head)).Scan(&legacy); err != nil || legacy {
+		return legacy, wrapErr(err)
+	}
+
+	if config.MediaHashDistance < 0 {
+		return false, nil
+	}
+
+	img := look()
+	if img == nil {
+		return false, nil
+	}
+
+	ph := phash.DHash(img)
+
+	rows, err := config.DB.Query(`select phash from bannedmedia where phash is not null`)
+	if err != nil {
+		return false, wrapErr(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var banned int64
+		if err := rows.Scan(&banned); err != nil {
+			return false, wrapErr(err)
+		}
+
+		if phash.Distance(ph, uint64(banned)) <= config.MediaHashDistance {
+			return true, nil
+		}
+	}
+
+	return false, wrapErr(rows.Err())
+}
+
+// BanMedia bans data, and media that looks like it.
+func BanMedia(data []byte) error {
+	hash := hashFile(data)
+
+	var ph interface{}
+	var thumb []byte
+
+	if img := mediaImage(data); img != nil {
+		ph = int64(phash.DHash(img))
+
+		var err error
+		if thumb, err = thumbnail(img, thumbnailSize); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	if err := addMediaBan(hash, ph, thumb); err != nil {
+		return wrapErr(err)
+	}
+
+	forgetMediaVerdicts()
+	return nil
+}
+
+func addMediaBan(hash string, ph interface{}, thumb []byte) error {
+	if banned, err := IsHashBanned(hash); err != nil || banned {
+		return wrapErr(err)
+	}
+
+	query := `insert into bannedmedia (hash, phash, thumbnail, created) values ($1, $2, $3, $4)`
+	_, err := config.DB.Exec(query, hash, ph, thumb, time.Now().UTC())
+	return wrapErr(err)
+}
+
+// UnbanMedia removes a media ban.
+func UnbanMedia(id int) error {
+	if _, err := config.DB.Exec(`delete from bannedmedia where id=$1`, id); err != nil {
+		return wrapErr(err)
+	}
+
+	forgetMediaVerdicts()
+	return nil
+}
+
+// MediaBans returns every media ban, newest first.
+func MediaBans() ([]MediaBan, error) {
+	rows, err := config.DB.Query(`select id, hash, phash, created from bannedmedia order by created desc, id desc`)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	var bans []MediaBan
+	for rows.Next() {
+		var b MediaBan
+		var ph sql.NullInt64
+
+		if err := rows.Scan(&b.ID, &b.Hash, &ph, &b.Created); err != nil {
+			return bans, wrapErr(err)
+		}
+
+		b.PHash, b.HasPHash = uint64(ph.Int64), ph.Valid
+		bans = append(bans, b)
+	}
+
+	return bans, wrapErr(rows.Err())
+}
+
+// MediaBanThumbnail returns a PNG of what banned media looked like, or nil if
+// there isn't one.
+func MediaBanThumbnail(id int) ([]byte, error) {
+	var thumb []byte
+	err := config.DB.QueryRow(`select thumbnail from bannedmedia where id=$1`, id).Scan(&thumb)
+	return thumb, wrapErr(err)
+}
+
+// ExportMediaBans writes every media ban to w, one per line as the SHA-256
+// of the file followed by its perceptual hash, or - if it doesn't have one.
+func ExportMediaBans(w io.Writer) error {
+	bans, err := MediaBans()
+	if err != nil {
+		return wrapErr(err)
+	}
+
+	for _, b := range bans {
+		ph := "-"
+		if b.HasPHash {
+			ph = fmt.Sprintf("%016x", b.PHash)
+		}
+
+		if _, err := fmt.Fprintf(w, "%s %s\n", b.Hash, ph); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	return nil
+}
+
+// ImportMediaBans bans the media listed in r, in the format ExportMediaBans
+// writes, and returns how many bans it read.
+// Media that is already banned is skipped.
+func ImportMediaBans(r io.Reader) (int, error) {
+	defer forgetMediaVerdicts()
+
+	var n, lineNo int
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lineNo++
+
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+			return n, fmt.Errorf("line %d: invalid hash %q", lineNo, fields[0])
+		}
+
+		var ph interface{}
+		if len(fields) > 1 && fields[1] != "-" {
+			v, err := strconv.ParseUint(fields[1], 16, 64)
+			if err != nil {
+				return n, fmt.Errorf("line %d: invalid perceptual hash %q", lineNo, fields[1])
+			}
+
+			ph = int64(v)
+		}
+
+		if err := addMediaBan(strings.ToLower(fields[0]), ph, nil); err != nil {
+			return n, wrapErr(err)
+		}
+
+		n++
+	}
+
+	return n, wrapErr(s.Err())
+}
@@ -1,10 +1,18 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/phash"
 
 	_ "embed"
 )
@@ -14,6 +22,27 @@ var dbSchema string
 
 var errContinue = errors.New("db continue")
 
+// afterCommit holds what the running migration wants done once it has been
+// committed, such as removing files it no longer uses.
+var afterCommit []func() error
+
+// commit commits a migration, and then does what it left for afterwards.
+func commit(tx *sql.Tx) error {
+	defer func() { afterCommit = nil }()
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, f := range afterCommit {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func migrationScript(s string) func(*sql.Tx) error {
 	return func(tx *sql.Tx) error {
 		_, err := tx.Exec(s)
@@ -155,6 +184,300 @@ var migrations = []func(*sql.Tx) error{
 	migrationScript(`
 		ALTER TABLE actor ADD COLUMN locked BOOLEAN NOT NULL DEFAULT FALSE;
 	`),
+	migrationScript(`
+		CREATE TABLE moved(
+		       oldid varchar(100) UNIQUE,
+		       newid varchar(100)
+		);
+	`),
+	migrationScript(`
+		CREATE TABLE cachedcollection(
+		       id varchar(100) PRIMARY KEY,
+		       updated TIMESTAMP
+		);
+
+		CREATE TABLE cachedfollower(
+		       id varchar(100),
+		       follower varchar(100),
+		       UNIQUE(id, follower)
+		);
+	`),
+	migrationScript(`
+		CREATE TABLE attachments(
+		       id varchar(100),
+		       attachment varchar(100),
+		       preview varchar(100) default '',
+		       position INTEGER NOT NULL DEFAULT 0,
+		       UNIQUE(id, attachment)
+		);
+
+		INSERT INTO attachments (id, attachment, preview)
+		       SELECT id, attachment, coalesce(preview, '') FROM activitystream WHERE attachment != ''
+		       UNION SELECT id, attachment, coalesce(preview, '') FROM cacheactivitystream WHERE attachment != '';
+	`),
+	migrationScript(`
+		CREATE TABLE postpassword(
+		       id varchar(100) PRIMARY KEY,
+		       password bytea NOT NULL,
+		       salt bytea NOT NULL
+		);
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN capcode varchar(20) default '';
+		ALTER TABLE cacheactivitystream ADD COLUMN capcode varchar(20) default '';
+	`),
+	migrationScript(`
+		CREATE TABLE boardsettings(
+		       id varchar(100) PRIMARY KEY,
+		       maxfiles INTEGER,
+		       maxfilesize INTEGER,
+		       maxcomment INTEGER,
+		       maxname INTEGER,
+		       maxlines INTEGER,
+		       truncatelines INTEGER,
+		       deletewindow INTEGER,
+		       maxthreads INTEGER,
+		       threadsperpage INTEGER,
+		       maxpages INTEGER
+		);
+	`),
+	migrationScript(`
+		ALTER TABLE boardsettings ADD COLUMN bumplimit INTEGER;
+		ALTER TABLE boardsettings ADD COLUMN imagelimit INTEGER;
+	`),
+	migrationScript(`
+		ALTER TABLE boardsettings ADD COLUMN archiveretention INTEGER;
+		ALTER TABLE boardsettings ADD COLUMN purgearchive BOOLEAN;
+
+		CREATE TABLE archived(
+		       id varchar(100) PRIMARY KEY,
+		       board varchar(100) NOT NULL,
+		       archived TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		INSERT INTO archived (id, board)
+		       SELECT id, actor FROM activitystream WHERE type='Archive' AND id IN (SELECT id FROM replies WHERE inreplyto='')
+		       UNION SELECT id, actor FROM cacheactivitystream WHERE type='Archive' AND id IN (SELECT id FROM replies WHERE inreplyto='')
+		       ON CONFLICT DO NOTHING;
+
+		CREATE TABLE archiveprune(
+		       ran TIMESTAMP NOT NULL DEFAULT NOW(),
+		       threads INTEGER NOT NULL,
+		       reclaimed BIGINT NOT NULL
+		);
+	`),
+	migrationScript(`
+		ALTER TABLE boardsettings ADD COLUMN replycooldown INTEGER;
+		ALTER TABLE boardsettings ADD COLUMN threadcooldown INTEGER;
+		ALTER TABLE boardsettings ADD COLUMN identicalcooldown INTEGER;
+
+		CREATE TABLE posterkey(
+		       key bytea NOT NULL,
+		       created TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE poster(
+		       id varchar(100) PRIMARY KEY,
+		       board varchar(100) NOT NULL,
+		       hash varchar(64) NOT NULL,
+		       thread boolean NOT NULL DEFAULT false,
+		       published TIMESTAMP NOT NULL
+		);
+
+		CREATE INDEX poster_hash ON poster (board, hash);
+	`),
+	migrationScript(`
+		ALTER TABLE posterkey ADD COLUMN id SERIAL PRIMARY KEY;
+		ALTER TABLE poster ADD COLUMN key INTEGER;
+
+		CREATE TABLE bans(
+		       id SERIAL PRIMARY KEY,
+		       board varchar(100) NOT NULL DEFAULT '',
+		       hash varchar(64) NOT NULL DEFAULT '',
+		       key INTEGER,
+		       iprange varchar(50) NOT NULL DEFAULT '',
+		       post varchar(100) NOT NULL DEFAULT '',
+		       reason TEXT NOT NULL DEFAULT '',
+		       staff varchar(100) NOT NULL,
+		       created TIMESTAMP NOT NULL,
+		       expires TIMESTAMP,
+		       appeal TEXT NOT NULL DEFAULT '',
+		       appealdenied BOOLEAN NOT NULL DEFAULT false
+		);
+	`),
+	convertMediaBans,
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN width int default NULL;
+		ALTER TABLE activitystream ADD COLUMN height int default NULL;
+		ALTER TABLE activitystream ADD COLUMN duration real default NULL;
+
+		ALTER TABLE cacheactivitystream ADD COLUMN width int default NULL;
+		ALTER TABLE cacheactivitystream ADD COLUMN height int default NULL;
+		ALTER TABLE cacheactivitystream ADD COLUMN duration real default NULL;
+	`),
+	dedupeMedia,
+	migrationScript(`
+		CREATE TABLE postcounter(
+		       board varchar(100) PRIMARY KEY,
+		       last BIGINT NOT NULL
+		);
+
+		CREATE TABLE postnumber(
+		       id varchar(100) PRIMARY KEY,
+		       board varchar(100) NOT NULL,
+		       number BIGINT NOT NULL,
+		       UNIQUE(board, number)
+		);
+
+		-- Number what is already there in the order it was posted.
+		INSERT INTO postnumber (id, board, number)
+		       SELECT id, actor, row_number() OVER (PARTITION BY actor ORDER BY published, id)
+		       FROM activitystream WHERE type IN ('Note', 'Archive') AND actor IS NOT NULL;
+
+		INSERT INTO postcounter (board, last)
+		       SELECT board, max(number) FROM postnumber GROUP BY board;
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN posterid varchar(16) default NULL;
+		ALTER TABLE cacheactivitystream ADD COLUMN posterid varchar(16) default NULL;
+
+		ALTER TABLE boardsettings ADD COLUMN posterids BOOLEAN;
+
+		CREATE TABLE posteridkey(
+		       key bytea NOT NULL
+		);
+	`),
+	migrationScript(`
+		CREATE TABLE citations(
+		       id varchar(100) NOT NULL,
+		       cites varchar(100) NOT NULL,
+		       PRIMARY KEY(id, cites)
+		);
+
+		CREATE INDEX citations_cites ON citations (cites);
+
+		-- Replies to anything but the start of a thread were citations.
+		INSERT INTO citations (id, cites)
+		       SELECT id, inreplyto FROM replies
+		       WHERE inreplyto != '' AND inreplyto NOT IN (SELECT id FROM replies WHERE inreplyto = '')
+		       ON CONFLICT DO NOTHING;
+	`),
+	migrationScript(`
+		CREATE TABLE filters(
+		       id serial PRIMARY KEY,
+		       board varchar(100) NOT NULL DEFAULT '',
+		       pattern varchar(200) NOT NULL,
+		       action varchar(16) NOT NULL,
+		       replacement varchar(200) NOT NULL DEFAULT '',
+		       name boolean NOT NULL DEFAULT false,
+		       subject boolean NOT NULL DEFAULT false,
+		       comment boolean NOT NULL DEFAULT false,
+		       hits INTEGER NOT NULL DEFAULT 0,
+		       created TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		-- The blacklist blocked posts on every board by their comment.
+		INSERT INTO filters (pattern, action, comment)
+		       SELECT regex, 'block', true FROM postblacklist WHERE regex IS NOT NULL AND regex != '';
+
+		DROP TABLE postblacklist;
+	`),
+	recordOriginality,
+	migrationScript(`
+		ALTER TABLE boardsettings ADD COLUMN postmode varchar(16);
+		ALTER TABLE boardsettings ADD COLUMN filetypes TEXT;
+	`),
+	migrationScript(`
+		CREATE TABLE held(
+		       id varchar(100) PRIMARY KEY,
+		       recipients TEXT NOT NULL DEFAULT '',
+		       cc TEXT NOT NULL DEFAULT '',
+		       options TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE TABLE retiredkeys(
+		       owner varchar(100) PRIMARY KEY,
+		       name varchar(100) NOT NULL,
+		       retired TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+	`),
+	migrationScript(`
+		ALTER TABLE poster ALTER COLUMN hash DROP NOT NULL;
+	`),
+}
+
+// dedupeMedia moves the media of posts in ./public to where its contents say
+// it belongs, keeping only one copy of each file.
+func dedupeMedia(tx *sql.Tx) error {
+	entries, err := os.ReadDir("./public")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var old []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		// Only move what posts use; captchas live here too, and are found
+		// by their name.
+		href := config.Domain + "/public/" + e.Name()
+
+		var used bool
+		if err := tx.QueryRow(`select exists (select from activitystream where href=$1)`, href).Scan(&used); err != nil {
+			return err
+		} else if !used {
+			continue
+		}
+
+		f, err := os.Open("./public/" + e.Name())
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		name := hex.EncodeToString(h.Sum(nil)) + path.Ext(e.Name())
+		if name == e.Name() {
+			continue
+		}
+
+		if _, err := os.Stat("./public/" + name); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Link("./public/"+e.Name(), "./public/"+name); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		query := `update activitystream set href=$1 where href=$2`
+		if _, err := tx.Exec(query, config.Domain+"/public/"+name, href); err != nil {
+			return err
+		}
+
+		old = append(old, "./public/"+e.Name())
+	}
+
+	// Nothing refers to the old names any more, once this is committed.
+	afterCommit = append(afterCommit, func() error {
+		for _, file := range old {
+			if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return nil
 }
 
 func migrate() error {
@@ -196,7 +519,7 @@ func migrate() error {
 				return err
 			}
 
-			if err := tx.Commit(); err != nil {
+			if err := commit(tx); err != nil {
 				return err
 			}
 
@@ -208,9 +531,181 @@ func migrate() error {
 			return err
 		}
 
-		if err := tx.Commit(); err != nil {
+		if err := commit(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordOriginality creates the tables originality is checked with, and fills
+// them with what has been posted so far.
+func recordOriginality(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		ALTER TABLE boardsettings ADD COLUMN originality BOOLEAN;
+		ALTER TABLE boardsettings ADD COLUMN originalmedia BOOLEAN;
+
+		CREATE TABLE originality(
+		       board varchar(100) NOT NULL,
+		       hash char(64) NOT NULL,
+		       media boolean NOT NULL,
+		       PRIMARY KEY(board, hash, media)
+		);
+
+		CREATE TABLE originalitymutes(
+		       board varchar(100) NOT NULL,
+		       hash varchar(64) NOT NULL,
+		       offenses INTEGER NOT NULL,
+		       until TIMESTAMP NOT NULL,
+		       PRIMARY KEY(board, hash)
+		);
+
+		-- Stored media is named after its hash.
+		INSERT INTO originality (board, hash, media)
+		       SELECT DISTINCT p.actor, substring(a.href from '/public/([0-9a-f]{64})(\.[^/]*)?$'), true
+		       FROM activitystream p
+		       JOIN attachments t ON t.id = p.id
+		       JOIN activitystream a ON a.id = t.attachment
+		       WHERE p.type IN ('Note', 'Archive') AND a.href ~ '/public/[0-9a-f]{64}(\.[^/]*)?$'
+		       ON CONFLICT DO NOTHING;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Comments have to be reduced the same way new ones are, so it's done
+	// here instead.
+	rows, err := tx.Query(`select actor, content from activitystream where type in ('Note', 'Archive') and content != ''`)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[[2]string]bool)
+	for rows.Next() {
+		var board, content string
+		if err := rows.Scan(&board, &content); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if hash := originalTextHash(content); hash != "" {
+			seen[[2]string{board, hash}] = true
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for k := range seen {
+		if _, err := tx.Exec(`insert into originality (board, hash, media) values ($1, $2, false) on conflict do nothing`, k[0], k[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// convertMediaBans moves media bans to hashing entire files.
+// Bans used to hash only the first 2048 bytes of a file. Those of files we
+// still have are made again from the entire file, and the rest are kept as
+// legacy bans, which are checked the old way.
+func convertMediaBans(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		DELETE FROM bannedmedia WHERE hash IS NULL OR length(hash) != 64;
+
+		ALTER TABLE bannedmedia ALTER COLUMN hash TYPE varchar(64);
+		ALTER TABLE bannedmedia ALTER COLUMN hash SET NOT NULL;
+		ALTER TABLE bannedmedia ADD COLUMN phash BIGINT;
+		ALTER TABLE bannedmedia ADD COLUMN thumbnail bytea;
+		ALTER TABLE bannedmedia ADD COLUMN created TIMESTAMP NOT NULL DEFAULT now();
+		ALTER TABLE bannedmedia ADD COLUMN legacy BOOLEAN NOT NULL DEFAULT false;
+
+		UPDATE bannedmedia SET legacy = true;
+
+		CREATE UNIQUE INDEX bannedmedia_hash ON bannedmedia (hash);
+	`); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`select hash from bannedmedia`)
+	if err != nil {
+		return err
+	}
+
+	legacy := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
 			return err
 		}
+
+		legacy[hash] = true
+	}
+	rows.Close()
+
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir("./public")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		// Only files that match are read in full.
+		f, err := os.Open("./public/" + e.Name())
+		if err != nil {
+			return err
+		}
+
+		head := make([]byte, 2048)
+		n, err := io.ReadFull(f, head)
+		f.Close()
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		old := legacyMediaHash(head[:n])
+		if !legacy[old] {
+			continue
+		}
+
+		data, err := os.ReadFile("./public/" + e.Name())
+		if err != nil {
+			return err
+		}
+
+		var ph interface{}
+		var thumb []byte
+
+		if img := mediaImage(data); img != nil {
+			ph = int64(phash.DHash(img))
+			if thumb, err = thumbnail(img, thumbnailSize); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(`delete from bannedmedia where hash=$1 and legacy=true`, old); err != nil {
+			return err
+		}
+
+		query := `insert into bannedmedia (hash, phash, thumbnail) values ($1, $2, $3) on conflict (hash) do nothing`
+		if _, err := tx.Exec(query, hashFile(data), ph, thumb); err != nil {
+			return err
+		}
+
+		delete(legacy, old)
 	}
 
 	return nil
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/rx"
+)
+
+// Boards with the originality setting only take what has never been posted
+// on them before, and mute those who try to repost something for longer each
+// time.
+// What every local post has is remembered whether boards use the setting or
+// not, so that turning it on counts everything posted before.
+
+// Mutes double with every attempt, up to a day.
+// Offenses are forgiven a day after the mute for the last one ended.
+const (
+	firstMute   = 2 * time.Second
+	maxMute     = 24 * time.Hour
+	forgiveness = 24 * time.Hour
+)
+
+// Originality is what a post has that has to be original: its comment and its
+// files, as hashes.
+type Originality struct {
+	Text  string // "" if there is no comment to speak of
+	Media []string
+}
+
+// originalText reduces a comment to the words in it, so that changing case,
+// punctuation or spacing doesn't make it original.
+// Citations are left out, as they're stored expanded and so wouldn't match
+// what was posted.
+func originalText(comment string) string {
+	comment = rx.BoardCite.ReplaceAllString(comment, " ")
+	comment = rx.Cite.ReplaceAllString(comment, " ")
+	comment = rx.NumberCite.ReplaceAllString(comment, " ")
+
+	return strings.Join(strings.FieldsFunc(strings.ToLower(comment), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+func originalTextHash(comment string) string {
+	text := originalText(comment)
+	if text == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewOriginality returns the originality of a post with comment.
+func NewOriginality(comment string) Originality {
+	return Originality{Text: originalTextHash(comment)}
+}
+
+// AddMedia adds a file to the post by its hash; see HashMedia.
+func (o *Originality) AddMedia(hash string) {
+	o.Media = append(o.Media, hash)
+}
+
+// AddHref adds a file stored locally at href, whose name is its hash.
+func (o *Originality) AddHref(href string) {
+	name := strings.TrimSuffix(path.Base(href), path.Ext(href))
+	if _, err := hex.DecodeString(name); err == nil && len(name) == sha256.Size*2 {
+		o.Media = append(o.Media, name)
+	}
+}
+
+// IsOriginal reports whether nothing in o has been posted on board before.
+// Files are only checked if media is set.
+func (o Originality) IsOriginal(board string, media bool) (bool, error) {
+	var seen bool
+
+	if o.Text != "" {
+		query := `select exists (select from originality where board=$1 and hash=$2 and media=false)`
+		if err := config.DB.QueryRow(query, board, o.Text).Scan(&seen); err != nil {
+			return false, wrapErr(err)
+		} else if seen {
+			return false, nil
+		}
+	}
+
+	if !media {
+		return true, nil
+	}
+
+	for _, e := range o.Media {
+		query := `select exists (select from originality where board=$1 and hash=$2 and media=true)`
+		if err := config.DB.QueryRow(query, board, e).Scan(&seen); err != nil {
+			return false, wrapErr(err)
+		} else if seen {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Record remembers everything in o as posted on board.
+func (o Originality) Record(board string) error {
+	query := `insert into originality (board, hash, media) values ($1, $2, $3) on conflict do nothing`
+
+	if o.Text != "" {
+		if _, err := config.DB.Exec(query, board, o.Text, false); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	for _, e := range o.Media {
+		if _, err := config.DB.Exec(query, board, e, true); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	return nil
+}
+
+// OriginalityMute returns when the poster may post on board again, or the
+// zero time if they aren't muted.
+func OriginalityMute(board, hash string) (time.Time, error) {
+	var until time.Time
+
+	query := `select until from originalitymutes where board=$1 and hash=$2`
+	if err := config.DB.QueryRow(query, board, hash).Scan(&until); errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, wrapErr(err)
+	}
+
+	return until, nil
+}
+
+// MuteUnoriginal mutes a poster for trying to post something unoriginal on
+// board, returning for how long.
+func MuteUnoriginal(board, hash string) (time.Duration, error) {
+	var offenses int
+
+	// Old offenses may not have been forgiven yet, so they start over here.
+	now := time.Now().UTC()
+	query := `insert into originalitymutes (board, hash, offenses, until) values ($1, $2, 1, $3) on conflict (board, hash) do update set offenses = case when originalitymutes.until < $4 then 1 else originalitymutes.offenses + 1 end returning offenses`
+	if err := config.DB.QueryRow(query, board, hash, now, now.Add(-forgiveness)).Scan(&offenses); err != nil {
+		return 0, wrapErr(err)
+	}
+
+	mute := firstMute
+	for i := 1; i < offenses && mute < maxMute; i++ {
+		mute *= 2
+	}
+
+	if mute > maxMute {
+		mute = maxMute
+	}
+
+	query = `update originalitymutes set until=$3 where board=$1 and hash=$2`
+	_, err := config.DB.Exec(query, board, hash, now.Add(mute))
+	return mute, wrapErr(err)
+}
+
+// ForgiveOffenses forgets the mutes of posters who haven't been muted for a
+// while, every hour.
+func ForgiveOffenses() {
+	for {
+		if _, err := config.DB.Exec(`delete from originalitymutes where until < $1`, time.Now().UTC().Add(-forgiveness)); err != nil {
+			log.Printf("failed to forgive offenses: %v", err)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,31 @@
+package db
+
+import "testing"
+
+func TestOriginalText(t *testing.T) {
+	tests := []struct {
+		name, a, b string
+		same       bool
+	}{
+		{"case and punctuation", "Hello, World!", "hello world", true},
+		{"spacing", "hello\n\n   world", "hello world", true},
+		{"different words", "hello world", "goodbye world", false},
+		{"number cite expanded", ">>12\nnice post", ">>https://example.com/b/ABCDEFGH\nnice post", true},
+		{"board cite expanded", ">>>/b/ABCDEFGH nice post", ">>https://example.com/b/ABCDEFGH nice post", true},
+		{"remote board cite", ">>>/b@other.example/ nice", "nice", true},
+		{"numbers are kept", "call 12 now", "call now", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := originalTextHash(tt.a), originalTextHash(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("originalText(%q) = %q, originalText(%q) = %q", tt.a, originalText(tt.a), tt.b, originalText(tt.b))
+			}
+		})
+	}
+
+	if h := originalTextHash(">>1234"); h != "" {
+		t.Errorf("a comment that's only a citation hashed to %q", h)
+	}
+}
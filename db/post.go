@@ -3,13 +3,13 @@ package db
 import (
 	"fmt"
 	"html/template"
-	"mime/multipart"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
 	"github.com/KushBlazingJudah/fedichan/internal/rx"
 )
 
@@ -29,6 +29,11 @@ func ConvertHashLink(domain string, link string) string {
 
 func ParseCommentForReplies(comment string, op string) ([]activitypub.ObjectBase, error) {
 	match := rx.Cite.FindAllStringSubmatch(comment, -1)
+	for _, cite := range rx.BoardCite.FindAllString(comment, -1) {
+		if id, post := resolveBoardCite(cite, true); post {
+			match = append(match, []string{">>" + id})
+		}
+	}
 
 	var links []string
 
@@ -91,115 +96,110 @@ func ParseLinkTitle(actorName string, op string, content string) string {
 	return content
 }
 
-func IsMediaBanned(f multipart.File) (bool, error) {
-	/* TODO: Rewrite
-	f.Seek(0, 0)
-	fileBytes := make([]byte, 2048)
-	_, err := f.Read(fileBytes)
-
-	if err != nil {
-		return true, wrapErr(err)
+func ParseContent(board activitypub.Actor, op string, content string, thread activitypub.ObjectBase, id string, trunc bool) (template.HTML, error) {
+	var more string
+	if trunc {
+		content, more = ParseTruncate(content, board, op, id)
 	}
 
-	hash := util.HashBytes(fileBytes)
-	f.Seek(0, 0)
-
-	return IsHashBanned(hash)
-	*/
+	content = markup.Render(content, func(cite string) string {
+		return ParseLinkComment(board, op, cite, thread)
+	})
 
-	return false, nil
+	return template.HTML(content + more), nil
 }
 
-func ParseContent(board activitypub.Actor, op string, content string, thread activitypub.ObjectBase, id string, trunc bool) (template.HTML, error) {
-	content = template.HTMLEscapeString(content)
-	if trunc {
-		content = ParseTruncate(content, board, op, id)
+// ParseTruncate cuts long posts short, returning what is left of it and a link
+// to the rest.
+func ParseTruncate(content string, board activitypub.Actor, op string, id string) (string, string) {
+	settings, _ := board.Settings()
+	if n := settings.TruncateLines; strings.Count(content, "\n") > n {
+		content = strings.Join(rx.Newline.Split(content, n+1)[:n], "\n")
+
+		return content, fmt.Sprintf("<br/><a href=\"%s\">(view full post...)</a>", board.Id+"/"+shortURL(board.Outbox, op)+"#"+shortURL(board.Outbox, id))
 	}
 
-	content = ParseLinkComments(board, op, content, thread)
-	content = ParseCommentQuotes(content)
+	return content, ""
+}
 
-	content = strings.ReplaceAll(content, "\r", "")
-	content = strings.ReplaceAll(content, "\n", "<br/>")
+// ParseLinkComment renders a single citation.
+func ParseLinkComment(board activitypub.Actor, op string, cite string, thread activitypub.ObjectBase) string {
+	if strings.HasPrefix(cite, ">>>/") {
+		id, post := resolveBoardCite(cite, false)
+		if id == "" {
+			return fmt.Sprintf(`<a class="reply dead">%s</a>`, template.HTMLEscapeString(cite))
+		} else if !post {
+			return boardLink(id)
+		}
 
-	return template.HTML(content), nil
-}
+		cite = ">>" + id
+	}
 
-func ParseTruncate(content string, board activitypub.Actor, op string, id string) string {
-	if strings.Count(content, "\n") > 30 {
-		content = strings.Join(rx.Newline.Split(content, 30), "\n")
+	v := rx.Cite.FindStringSubmatch(cite)
+	if v == nil {
+		return template.HTMLEscapeString(cite)
+	}
 
-		content += fmt.Sprintf("<a href=\"%s\">(view full post...)</a>", board.Id+"/"+shortURL(board.Outbox, op)+"#"+shortURL(board.Outbox, id))
+	if v[3] == "" && v[4] == "" && v[5] == "" {
+		// Only a board was cited.
+		return boardLink(strings.TrimSuffix(v[2], "/"))
 	}
 
-	return content
-}
+	isOP := ""
+	domain := v[2]
+	link := strings.Replace(v[0], ">>", "", 1)
 
-func ParseLinkComments(board activitypub.Actor, op string, content string, thread activitypub.ObjectBase) string {
-	return rx.CiteEsc.ReplaceAllStringFunc(content, func(match string) string {
-		v := rx.CiteEsc.FindStringSubmatch(match)
+	if link == op {
+		isOP = " (OP)"
+	}
 
-		isOP := ""
-		domain := v[2]
-		link := strings.Replace(v[0], "&gt;&gt;", "", 1)
+	parsedLink := ConvertHashLink(domain, link)
 
-		if link == op {
-			isOP = " (OP)"
-		}
+	/* TODO: Broken until I fix it again.
+	//format the hover title text
+	var quoteTitle string
 
-		parsedLink := ConvertHashLink(domain, link)
-
-		/* TODO: Broken until I fix it again.
-		//format the hover title text
-		var quoteTitle string
-
-		// if the quoted content is local get it
-		// else get it from the database
-		if thread.Id == link {
-			quoteTitle = ParseLinkTitle(board.Outbox, op, thread.Content)
-		} else {
-			for _, e := range thread.Replies.OrderedItems {
-				if e.Id == parsedLink {
-					quoteTitle = ParseLinkTitle(board.Outbox, op, e.Content)
-					break
-				}
+	// if the quoted content is local get it
+	// else get it from the database
+	if thread.Id == link {
+		quoteTitle = ParseLinkTitle(board.Outbox, op, thread.Content)
+	} else {
+		for _, e := range thread.Replies.OrderedItems {
+			if e.Id == parsedLink {
+				quoteTitle = ParseLinkTitle(board.Outbox, op, e.Content)
+				break
 			}
+		}
 
-			if quoteTitle == "" {
-				obj := activitypub.ObjectBase{Id: parsedLink}
-				col, err := obj.GetCollectionFromPath()
-				if err == nil {
-					if len(col.OrderedItems) > 0 {
-						quoteTitle = ParseLinkTitle(board.Outbox, op, col.OrderedItems[0].Content)
-					} else {
-						quoteTitle = ParseLinkTitle(board.Outbox, op, parsedLink)
-					}
+		if quoteTitle == "" {
+			obj := activitypub.ObjectBase{Id: parsedLink}
+			col, err := obj.GetCollectionFromPath()
+			if err == nil {
+				if len(col.OrderedItems) > 0 {
+					quoteTitle = ParseLinkTitle(board.Outbox, op, col.OrderedItems[0].Content)
+				} else {
+					quoteTitle = ParseLinkTitle(board.Outbox, op, parsedLink)
 				}
 			}
 		}
-		*/
-
-		if replyID, isReply, err := IsReplyToOP(op, parsedLink); err == nil || !isReply {
-			id := shortURL(board.Outbox, replyID)
+	}
+	*/
 
-			return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="/%s/%s#%s">&gt;&gt;%s%s</a>` /*, quoteTitle*/, board.Name, shortURL(board.Outbox, op), id, id, isOP)
-		}
+	if replyID, isReply, err := IsReplyToOP(op, parsedLink); err == nil && isReply {
+		id := shortURL(board.Outbox, replyID)
 
-		//this is a cross post
-		parsedOP, err := GetReplyOP(parsedLink)
-		if err == nil {
-			link = parsedOP + "#" + shortURL(parsedOP, parsedLink)
-		}
+		return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="/%s/%s#%s" data-post="%s">&gt;&gt;%s%s</a>` /*, quoteTitle*/, board.Name, shortURL(board.Outbox, op), id, template.HTMLEscapeString(replyID), citeText(board, replyID), isOP)
+	}
 
-		actor, err := activitypub.FingerActor(parsedLink)
-		if err == nil && actor.Id != "" {
-			return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="%s">&gt;&gt;%s%s →</a>` /*, quoteTitle*/, link, shortURL(board.Outbox, parsedLink), isOP)
-		}
+	//this is a cross post
+	parsedOP, err := GetReplyOP(parsedLink)
+	if err == nil && parsedOP != "" {
+		link = parsedOP + "#" + shortURL(parsedOP, parsedLink)
+	}
 
-		return fmt.Sprintf(`<a class="reply dead">&gt;&gt;%s</a>`, link)
-	})
-}
+	if actor := citedBoard(boardOf(parsedLink)); actor.Id != "" {
+		return fmt.Sprintf(`<a class="reply" title="%s" href="%s" data-post="%s">&gt;&gt;%s%s →</a>`, citeTitle(parsedLink), link, template.HTMLEscapeString(parsedLink), crossCiteText(board, actor, parsedLink), isOP)
+	}
 
-func ParseCommentQuotes(content string) string {
-	return rx.Quote.ReplaceAllString(content, `<span class="quote">&gt;$1</span>`)
+	return fmt.Sprintf(`<a class="reply dead">&gt;&gt;%s</a>`, template.HTMLEscapeString(link))
 }
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// Posters are identified by a keyed hash of their IP address, so that we
+// never store the address itself.
+// The key is replaced every config.PosterHashRotation, after which the hashes
+// of the same address no longer match.
+// Who made a post is only kept for as long as any cooldown lasts, after
+// which it's forgotten, so old keys stop being needed and a copy of the
+// database can't be used to work out who posted what.
+// Old keys are only kept while bans still refer to them.
+
+var posterKey struct {
+	sync.Mutex
+	id      int
+	key     []byte
+	created time.Time
+}
+
+// keys caches every key by its ID, as they never change once made.
+var keys struct {
+	sync.RWMutex
+	m map[int][]byte
+}
+
+// posterKeyByID returns the key with id, or nil if it's gone.
+func posterKeyByID(id int) ([]byte, error) {
+	keys.RLock()
+	key, ok := keys.m[id]
+	keys.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if err := config.DB.QueryRow(`select key from posterkey where id=$1`, id).Scan(&key); errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	keys.Lock()
+	defer keys.Unlock()
+
+	if keys.m == nil {
+		keys.m = make(map[int][]byte)
+	}
+	keys.m[id] = key
+
+	return key, nil
+}
+
+// currentPosterKey returns the key posters are hashed with, making a new one
+// if the current one is too old.
+func currentPosterKey() (int, []byte, error) {
+	posterKey.Lock()
+	defer posterKey.Unlock()
+
+	if posterKey.key == nil {
+		err := config.DB.QueryRow(`select id, key, created from posterkey order by created desc limit 1`).Scan(&posterKey.id, &posterKey.key, &posterKey.created)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, wrapErr(err)
+		}
+	}
+
+	if posterKey.key == nil || time.Since(posterKey.created) > config.PosterHashRotation {
+		var id int
+		key, created := makeSalt(), time.Now().UTC()
+
+		if err := config.DB.QueryRow(`insert into posterkey (key, created) values ($1, $2) returning id`, key, created).Scan(&id); err != nil {
+			return 0, nil, wrapErr(err)
+		}
+
+		posterKey.id, posterKey.key, posterKey.created = id, key, created
+	}
+
+	return posterKey.id, posterKey.key, nil
+}
+
+// How often posters are forgotten.
+const forgetInterval = 5 * time.Minute
+
+// longestCooldown returns the longest any board makes posters wait.
+func longestCooldown() (time.Duration, error) {
+	d := activitypub.DefaultSettings()
+	longest := d.ReplyCooldown
+	for _, e := range []time.Duration{d.ThreadCooldown, d.IdenticalCooldown} {
+		if e > longest {
+			longest = e
+		}
+	}
+
+	var seconds int
+	query := `select coalesce(max(greatest(replycooldown, threadcooldown, identicalcooldown)), 0) from boardsettings`
+	if err := config.DB.QueryRow(query).Scan(&seconds); err != nil {
+		return 0, wrapErr(err)
+	}
+
+	if board := time.Duration(seconds) * time.Second; board > longest {
+		longest = board
+	}
+
+	return longest, nil
+}
+
+// forgetPosters forgets who made the posts no cooldown needs anymore, and
+// removes the keys nothing refers to since.
+func forgetPosters() error {
+	cooldown, err := longestCooldown()
+	if err != nil {
+		return wrapErr(err)
+	}
+
+	if _, err := config.DB.Exec(`update poster set hash=null, key=null where published < $1 and hash is not null`, time.Now().UTC().Add(-cooldown)); err != nil {
+		return wrapErr(err)
+	}
+
+	// Held so the current key can't be replaced while it's being spared.
+	posterKey.Lock()
+	defer posterKey.Unlock()
+
+	_, err = config.DB.Exec(`delete from posterkey where id != $1 and id not in (select key from poster where key is not null) and id not in (select key from bans where key is not null)`, posterKey.id)
+	return wrapErr(err)
+}
+
+// ForgetPosters forgets who made posts once no cooldown needs to know, every
+// few minutes.
+func ForgetPosters() {
+	for {
+		if err := forgetPosters(); err != nil {
+			log.Printf("failed to forget posters: %v", err)
+		}
+
+		time.Sleep(forgetInterval)
+	}
+}
+
+func hashPoster(key []byte, ip string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PosterHash returns the hash identifying the poster at ip, and the key it was
+// made with.
+func PosterHash(ip string) (string, int, error) {
+	id, key, err := currentPosterKey()
+	if err != nil {
+		return "", 0, wrapErr(err)
+	}
+
+	return hashPoster(key, ip), id, nil
+}
+
+// Poster IDs are made with a key of their own that is never replaced, as
+// they have to stay the same for as long as a thread lasts.
+var posterIDKey struct {
+	sync.Mutex
+	key []byte
+}
+
+func currentPosterIDKey() ([]byte, error) {
+	posterIDKey.Lock()
+	defer posterIDKey.Unlock()
+
+	if posterIDKey.key != nil {
+		return posterIDKey.key, nil
+	}
+
+	err := config.DB.QueryRow(`select key from posteridkey limit 1`).Scan(&posterIDKey.key)
+	if errors.Is(err, sql.ErrNoRows) {
+		key := makeSalt()
+		if _, err := config.DB.Exec(`insert into posteridkey (key) values ($1)`, key); err != nil {
+			return nil, wrapErr(err)
+		}
+
+		posterIDKey.key = key
+	} else if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	return posterIDKey.key, nil
+}
+
+// PosterID returns the ID shown next to the posts the poster at ip makes in
+// thread.
+func PosterID(ip, thread string) (string, error) {
+	key, err := currentPosterIDKey()
+	if err != nil {
+		return "", wrapErr(err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip + "\x00" + thread))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:8], nil
+}
+
+// PosterOf returns the hash of the poster who made the local post id, and the
+// key it was made with.
+// The hash is empty once the poster has been forgotten.
+func PosterOf(id string) (string, int, error) {
+	var hash string
+	var key int
+
+	err := config.DB.QueryRow(`select coalesce(hash, ''), coalesce(key, 0) from poster where id=$1`, id).Scan(&hash, &key)
+	return hash, key, wrapErr(err)
+}
+
+// SetPosterHash records who made the local post id on board, and whether it
+// started a thread.
+func SetPosterHash(id, board, hash string, key int, thread bool) error {
+	_, err := config.DB.Exec(`insert into poster (id, board, hash, key, thread, published) values ($1, $2, $3, $4, $5, $6) on conflict (id) do nothing`, id, board, hash, key, thread, time.Now().UTC())
+	return wrapErr(err)
+}
+
+// LastPost returns when the poster last made a thread on board, or a reply if
+// thread is false.
+// The zero time is returned if they haven't.
+func LastPost(board, hash string, thread bool) (time.Time, error) {
+	var last sql.NullTime
+
+	query := `select max(published) from poster where board=$1 and hash=$2 and thread=$3`
+	if err := config.DB.QueryRow(query, board, hash, thread).Scan(&last); err != nil {
+		return time.Time{}, wrapErr(err)
+	}
+
+	return last.Time, nil
+}
+
+// LastIdenticalPost returns when the poster last posted content on board.
+// The zero time is returned if they haven't.
+func LastIdenticalPost(board, hash, content string) (time.Time, error) {
+	var last sql.NullTime
+
+	query := `select max(poster.published) from poster join activitystream on activitystream.id = poster.id where poster.board=$1 and poster.hash=$2 and activitystream.content=$3`
+	if err := config.DB.QueryRow(query, board, hash, content).Scan(&last); err != nil {
+		return time.Time{}, wrapErr(err)
+	}
+
+	return last.Time, nil
+}
@@ -21,8 +21,21 @@ const SaltTable = "" +
 	"................................" +
 	"................................"
 
-func CreateNameTripCode(input string, a *Acct) (string, string, error) {
-	// TODO: Capcode support has been removed. Add it back in.
+var capcode = regexp.MustCompile(`(?i)\s*## +(janitor|mod|admin)\s*$`)
+
+// CreateNameTripCode splits the name field of a post into the name, tripcode
+// and capcode.
+// Capcodes are only kept when a is at least the role they claim.
+func CreateNameTripCode(input string, a *Acct) (string, string, string, error) {
+	var capc string
+
+	if m := capcode.FindStringSubmatch(input); m != nil {
+		input = capcode.ReplaceAllString(input, "")
+
+		if role := ParseAcctType(m[1]); a != nil && a.Type >= role {
+			capc = role.String()
+		}
+	}
 
 	tripSecure := regexp.MustCompile("##(.+)?")
 
@@ -32,7 +45,7 @@ func CreateNameTripCode(input string, a *Acct) (string, string, error) {
 
 		hash, err := TripCodeSecure(chunck)
 
-		return tripSecure.ReplaceAllString(input, ""), "!!" + hash, wrapErr(err)
+		return tripSecure.ReplaceAllString(input, ""), "!!" + hash, capc, wrapErr(err)
 	}
 
 	trip := regexp.MustCompile("#(.+)?")
@@ -42,10 +55,10 @@ func CreateNameTripCode(input string, a *Acct) (string, string, error) {
 		chunck = strings.Replace(chunck, "#", "", 1)
 
 		hash, err := TripCode(chunck)
-		return trip.ReplaceAllString(input, ""), "!" + hash, wrapErr(err)
+		return trip.ReplaceAllString(input, ""), "!" + hash, capc, wrapErr(err)
 	}
 
-	return input, "", nil
+	return input, "", capc, nil
 }
 
 func TripCode(pass string) (string, error) {
@@ -0,0 +1,258 @@
+// markup is a package that turns the markup in posts into HTML.
+//
+// Posts are split into tokens rather than run through a chain of regexps, so
+// rules can't interact with each other.
+// Everything that isn't markup is escaped and every element that is opened is
+// closed again, so nothing a post contains can break the page around it.
+// Only plain elements are used, so posts are still readable where our
+// stylesheets aren't loaded.
+package markup
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/KushBlazingJudah/fedichan/internal/rx"
+)
+
+// Cite renders a citation, such as >>https://example.com/board/ABCDEFGH or
+// >>>/board/ABCDEFGH.
+type Cite func(cite string) string
+
+type element struct {
+	open, close string
+}
+
+var (
+	spoiler = &element{`<span class="spoiler">`, `</span>`}
+	bold    = &element{`<b>`, `</b>`}
+	italic  = &element{`<i>`, `</i>`}
+	red     = &element{`<span class="redtext">`, `</span>`}
+	quote   = &element{`<span class="quote">`, `</span>`}
+)
+
+// toggles open their element if it isn't already, and close it otherwise.
+// Longer markers come first, so bold isn't read as italic.
+var toggles = []struct {
+	marker string
+	elem   *element
+}{
+	{"'''", bold},
+	{"''", italic},
+	{"**", spoiler},
+	{"==", red},
+}
+
+// tags are opened with [name] and closed with [/name].
+var tags = map[string]*element{
+	"spoiler": spoiler,
+}
+
+// blocks are copied as they are until their closing tag.
+var blocks = map[string]element{
+	"code": {`<code class="codeblock">`, `</code>`},
+	"aa":   {`<span class="aa">`, `</span>`},
+}
+
+var (
+	cite = regexp.MustCompile(`^(?:` + rx.BoardCite.String() + `|` + rx.Cite.String() + `)`)
+	tag  = regexp.MustCompile(`^\[(/?)([a-z]+)\]`)
+)
+
+type renderer struct {
+	out   strings.Builder
+	text  strings.Builder
+	stack []*element
+	cite  Cite
+}
+
+// flush writes out the text seen since the last piece of markup.
+func (r *renderer) flush() {
+	r.out.WriteString(template.HTMLEscapeString(r.text.String()))
+	r.text.Reset()
+}
+
+func (r *renderer) push(e *element) {
+	r.flush()
+	r.out.WriteString(e.open)
+	r.stack = append(r.stack, e)
+}
+
+// pop closes e along with everything opened inside of it.
+func (r *renderer) pop(e *element) {
+	r.flush()
+
+	for len(r.stack) > 0 {
+		top := r.stack[len(r.stack)-1]
+		r.stack = r.stack[:len(r.stack)-1]
+		r.out.WriteString(top.close)
+
+		if top == e {
+			return
+		}
+	}
+}
+
+func (r *renderer) isOpen(e *element) bool {
+	for _, v := range r.stack {
+		if v == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Render turns the markup in text into HTML, rendering citations with cite.
+func Render(text string, cite Cite) string {
+	r := &renderer{cite: cite}
+	text = strings.ReplaceAll(text, "\r", "")
+
+	for i, lineStart := 0, true; i < len(text); {
+		rest := text[i:]
+
+		if lineStart {
+			if line := strings.TrimLeft(rest, " \t"); strings.HasPrefix(line, ">") && !isCite(line) {
+				r.push(quote)
+			}
+
+			lineStart = false
+		}
+
+		if n := r.markup(rest); n > 0 {
+			i += n
+			continue
+		}
+
+		if rest[0] == '\n' {
+			if r.isOpen(quote) {
+				r.pop(quote)
+			}
+
+			r.flush()
+			r.out.WriteString("<br/>")
+			i++
+			lineStart = true
+			continue
+		}
+
+		r.text.WriteByte(rest[0])
+		i++
+	}
+
+	r.flush()
+	for len(r.stack) > 0 {
+		r.pop(r.stack[len(r.stack)-1])
+	}
+
+	return r.out.String()
+}
+
+// markup renders the markup at the start of rest, if there is any, and
+// returns how much of rest it took up.
+func (r *renderer) markup(rest string) int {
+	if isCite(rest) {
+		c := cite.FindString(rest)
+		r.flush()
+		r.out.WriteString(r.cite(c))
+		return len(c)
+	}
+
+	if m := tag.FindStringSubmatch(rest); m != nil {
+		closing, name := m[1] == "/", m[2]
+
+		if e, ok := tags[name]; ok {
+			if closing && r.isOpen(e) {
+				r.pop(e)
+				return len(m[0])
+			} else if !closing && strings.Contains(rest, "[/"+name+"]") {
+				r.push(e)
+				return len(m[0])
+			}
+		}
+
+		if b, ok := blocks[name]; ok && !closing {
+			end := strings.Index(rest, "[/"+name+"]")
+			if end < 0 {
+				return 0
+			}
+
+			body := rest[len(m[0]):end]
+			body = strings.TrimPrefix(body, "\n")
+			body = strings.TrimSuffix(body, "\n")
+
+			r.flush()
+			r.out.WriteString(b.open)
+			r.out.WriteString(template.HTMLEscapeString(body))
+			r.out.WriteString(b.close)
+
+			return end + len("[/"+name+"]")
+		}
+
+		return 0
+	}
+
+	for _, t := range toggles {
+		if !strings.HasPrefix(rest, t.marker) {
+			continue
+		}
+
+		if r.isOpen(t.elem) {
+			r.pop(t.elem)
+			return len(t.marker)
+		}
+
+		// Only open what is closed again on the same line, so a stray
+		// marker doesn't take the rest of the post with it.
+		line := rest[len(t.marker):]
+		if n := strings.IndexByte(line, '\n'); n >= 0 {
+			line = line[:n]
+		}
+
+		if strings.Contains(line, t.marker) {
+			r.push(t.elem)
+			return len(t.marker)
+		}
+
+		return 0
+	}
+
+	return 0
+}
+
+// OutsideBlocks replaces each part of text that isn't in a block with what f
+// returns for it, leaving blocks as they were written.
+func OutsideBlocks(text string, f func(string) string) string {
+	var out strings.Builder
+
+	start := 0
+	for i := 0; i < len(text); i++ {
+		m := tag.FindStringSubmatch(text[i:])
+		if m == nil || m[1] != "" {
+			continue
+		}
+
+		if _, ok := blocks[m[2]]; !ok {
+			continue
+		}
+
+		end := strings.Index(text[i:], "[/"+m[2]+"]")
+		if end < 0 {
+			continue
+		}
+
+		out.WriteString(f(text[start:i]))
+
+		start = i + end + len("[/"+m[2]+"]")
+		out.WriteString(text[i:start])
+		i = start - 1
+	}
+
+	out.WriteString(f(text[start:]))
+	return out.String()
+}
+
+func isCite(s string) bool {
+	return strings.HasPrefix(s, ">>") && cite.MatchString(s)
+}
@@ -0,0 +1,68 @@
+package markup
+
+import "testing"
+
+func testCite(cite string) string {
+	return `<a href="` + cite[2:] + `">cite</a>`
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain text", "hello", "hello"},
+		{"escaped", "<script>&", "&lt;script&gt;&amp;"},
+		{"newlines", "a\r\nb", "a<br/>b"},
+		{"greentext", ">implying\nno", `<span class="quote">&gt;implying</span><br/>no`},
+		{"indented greentext", "  >quote", `<span class="quote">  &gt;quote</span>`},
+		{"bold", "'''bold'''", "<b>bold</b>"},
+		{"italic", "''italic''", "<i>italic</i>"},
+		{"spoiler", "**secret**", `<span class="spoiler">secret</span>`},
+		{"redtext", "==red==", `<span class="redtext">red</span>`},
+		{"spoiler tag", "[spoiler]a\nb[/spoiler]", `<span class="spoiler">a<br/>b</span>`},
+		{"unclosed tag", "[spoiler]a", "[spoiler]a"},
+		{"stray marker", "a '' b\n''", "a &#39;&#39; b<br/>&#39;&#39;"},
+		{"nested", "'''a ''b'' c'''", "<b>a <i>b</i> c</b>"},
+		{"crossed", "'''a**b'''c**", `<b>a<span class="spoiler">b</span></b>c**`},
+		{"crossed tag", "[spoiler]a''b[/spoiler]c''", `<span class="spoiler">a<i>b</i></span>c&#39;&#39;`},
+		{"code block", "[code]\n'''x''' <b>\n[/code]", `<code class="codeblock">&#39;&#39;&#39;x&#39;&#39;&#39; &lt;b&gt;</code>`},
+		{"unclosed code block", "[code]x", "[code]x"},
+		{"ascii art", "[aa]**[/aa]", `<span class="aa">**</span>`},
+		{"cite", ">>https://example.com/b/ABCD", `<a href="https://example.com/b/ABCD">cite</a>`},
+		{"cite isn't greentext", ">>https://example.com/b/ABCD text", `<a href="https://example.com/b/ABCD">cite</a> text`},
+		{"board cite", ">>>/b/ABCD", `<a href=">/b/ABCD">cite</a>`},
+		{"number isn't a cite", ">>1234", `<span class="quote">&gt;&gt;1234</span>`},
+		{"markup in cite", ">>https://example.com/b/**A**", `<a href="https://example.com/b/">cite</a><span class="spoiler">A</span>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.in, testCite); got != tt.want {
+				t.Errorf("Render(%q) =\n%s\nwant\n%s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutsideBlocks(t *testing.T) {
+	wrap := func(s string) string { return "<" + s + ">" }
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"no blocks", "a b", "<a b>"},
+		{"code block", "a [code]b[/code] c", "<a >[code]b[/code]< c>"},
+		{"ascii art", "[aa]b[/aa]", "<>[aa]b[/aa]<>"},
+		{"unclosed block", "a [code]b", "<a [code]b>"},
+		{"tag isn't a block", "[spoiler]a[/spoiler]", "<[spoiler]a[/spoiler]>"},
+		{"two blocks", "[code]a[/code]b[aa]c[/aa]", "<>[code]a[/code]<b>[aa]c[/aa]<>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OutsideBlocks(tt.in, wrap); got != tt.want {
+				t.Errorf("OutsideBlocks(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
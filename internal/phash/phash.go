@@ -0,0 +1,56 @@
+// phash is a package that computes perceptual hashes of images.
+//
+// Unlike a cryptographic hash, a perceptual hash barely changes when an image
+// is resized, recompressed or slightly edited, so how many bits two hashes
+// differ by says how alike the images look.
+package phash
+
+import (
+	"image"
+	"math/bits"
+)
+
+// DHash returns the difference hash of img.
+//
+// The image is shrunk to 9x8 pixels of brightness, and each bit says whether a
+// pixel is brighter than the one to its right.
+func DHash(img image.Image) uint64 {
+	const w, h = 9, 8
+
+	var grey [h][w]uint64
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+
+	// Average every pixel that falls into each cell, so that detail lost
+	// when shrinking doesn't depend on where it happened to be sampled.
+	var count [h][w]uint64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * w / b.Dx()
+
+			r, g, bl, _ := img.At(x, y).RGBA()
+			grey[cy][cx] += (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+			count[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grey[y][x]*count[y][x+1] > grey[y][x+1]*count[y][x] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// Distance returns how many bits a and b differ by.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,71 @@
+package phash
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0xffffffffffffffff, 0xffffffffffffffff, 0},
+		{0, 0xffffffffffffffff, 64},
+		{0b1010, 0b0101, 4},
+		{1 << 63, 0, 1},
+		{0xf0f0f0f0f0f0f0f0, 0x0f0f0f0f0f0f0f0f, 64},
+	}
+
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%#x, %#x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// gradient returns an image that gets brighter from left to right, or the
+// other way if reverse is set.
+func gradient(w, h int, reverse bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 255 / (w - 1))
+			if reverse {
+				v = 255 - v
+			}
+
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    image.Image
+		maxDist int
+		minDist int
+	}{
+		{"same image", gradient(90, 80, false), gradient(90, 80, false), 0, 0},
+		{"resized", gradient(90, 80, false), gradient(270, 240, false), 4, 0},
+		{"mirrored", gradient(90, 80, false), gradient(90, 80, true), 64, 48},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Distance(DHash(tt.a), DHash(tt.b))
+			if d > tt.maxDist || d < tt.minDist {
+				t.Errorf("distance %d, want %d to %d", d, tt.minDist, tt.maxDist)
+			}
+		})
+	}
+
+	if h := DHash(image.NewGray(image.Rect(0, 0, 0, 0))); h != 0 {
+		t.Errorf("DHash of an empty image = %#x, want 0", h)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"math/rand"
 	"strings"
@@ -17,7 +18,13 @@ import (
 	"github.com/gofiber/template/html"
 )
 
+// moveFrom is where the instance was before it was moved to where the config
+// says it is now.
+var moveFrom = flag.String("move-from", "", "`ID` of the instance actor to move every board from to the configured domain, for good")
+
 func main() {
+	flag.Parse()
+
 	Init()
 
 	defer db.Close()
@@ -72,6 +79,9 @@ func main() {
 		return ctx.Next()
 	})
 
+	// Send requests for moved boards to where they live now
+	app.Use(routes.Moved)
+
 	// Main actor
 	app.Get("/", routes.Index)
 	app.Post("/inbox", routes.Inbox)
@@ -92,6 +102,19 @@ func main() {
 	app.Post("/"+config.Key+"/chpasswd", routes.AdminChangePasswd)
 	app.Post("/"+config.Key+"/blotter", routes.AdminSetBlotter)
 	app.Post("/"+config.Key+"/lock", routes.AdminSetLocked)
+	app.Post("/"+config.Key+"/settings", routes.AdminSetSettings)
+	app.Post("/"+config.Key+"/move", routes.AdminMoveBoard)
+	app.Post("/"+config.Key+"/deleteboard", routes.BoardRemove)
+	app.Post("/"+config.Key+"/bans/edit", routes.AdminEditBan)
+	app.Post("/"+config.Key+"/bans/lift", routes.AdminLiftBan)
+	app.Post("/"+config.Key+"/bans/deny", routes.AdminDenyAppeal)
+	app.Get("/"+config.Key+"/media/export", routes.AdminExportMediaBans)
+	app.Post("/"+config.Key+"/media/import", routes.AdminImportMediaBans)
+	app.Post("/"+config.Key+"/media/unban", routes.AdminUnbanMedia)
+	app.Get("/"+config.Key+"/media/:id", routes.AdminMediaBanThumbnail)
+	app.Post("/"+config.Key+"/filters/add", routes.AdminAddFilter)
+	app.Post("/"+config.Key+"/filters/delete", routes.AdminDeleteFilter)
+	app.Post("/"+config.Key+"/held", routes.AdminReviewHeld)
 	app.Post("/"+config.Key+"/:actor/editsummary", routes.AdminEditSummary)
 	app.All("/"+config.Key+"/:actor/follow", routes.AdminFollow)
 	app.Get("/"+config.Key+"/:actor", routes.AdminActorIndex)
@@ -108,17 +131,22 @@ func main() {
 	app.Get("/addtoindex", routes.BoardAddToIndex)
 	app.Get("/poparchive", routes.BoardPopArchive)
 	app.Get("/autosubscribe", routes.BoardAutoSubscribe)
-	app.All("/blacklist", routes.BoardBlacklist)
 	app.All("/report", routes.ReportPost)
 	app.Get("/make-report", routes.ReportGet)
+	app.Post("/userdelete", routes.UserDelete)
+	app.Get("/make-delete", routes.UserDeleteGet)
 	app.Get("/sticky", routes.Sticky)
 	app.Get("/lock", routes.Lock)
+	app.Get("/ban", routes.BanGet)
+	app.Post("/ban", routes.BanPost)
+	app.Post("/appeal", routes.BanAppeal)
 
 	// Webfinger routes
 	app.Get("/.well-known/webfinger", routes.Webfinger)
 
 	// API routes
 	app.Get("/api/media", routes.Media)
+	app.Get("/api/post", routes.PostPreview)
 
 	// Board actor routes
 	app.Post("/post", routes.MakeActorPost)
@@ -135,6 +163,12 @@ func main() {
 		panic(err)
 	}
 
+	// Moves can only be checked once the actors they're to are served.
+	app.Hooks().OnListen(func() error {
+		go activitypub.SendMoves()
+		return nil
+	})
+
 	app.Listen(config.Port)
 }
 
@@ -144,6 +178,14 @@ func Init() {
 
 	rand.Seed(time.Now().UnixNano())
 
+	if err = config.CheckValues(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = activitypub.DefaultSettings().Validate(); err != nil {
+		log.Fatalf("invalid config: %v", err)
+	}
+
 	if err = util.CreatedNeededDirectories(); err != nil {
 		log.Fatal(err)
 	}
@@ -152,7 +194,21 @@ func Init() {
 		log.Fatal(err)
 	}
 
-	if err = db.InitInstance(); err != nil {
+	if err = db.InitInstance(*moveFrom); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = activitypub.LoadMoves(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = activitypub.LoadFilters(); err != nil {
+		log.Fatal(err)
+	}
+
+	activitypub.IsMediaBanned = db.IsMediaHashBanned
+
+	if err = activitypub.RemoveRetiredKeys(); err != nil {
 		log.Fatal(err)
 	}
 
@@ -180,5 +236,19 @@ func Init() {
 
 	go activitypub.StartupArchive()
 
+	go activitypub.CacheFollowers()
+
+	go activitypub.PruneArchives()
+
+	go activitypub.BackfillMediaInfo()
+
+	go activitypub.CheckRemoteMedia()
+
+	go activitypub.CountFilterHits()
+
+	go db.ForgiveOffenses()
+
+	go db.ForgetPosters()
+
 	go db.MakeCaptchas()
 }
@@ -2,12 +2,14 @@ package routes
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
@@ -18,6 +20,13 @@ import (
 )
 
 func ActorInbox(ctx *fiber.Ctx) error {
+	// Limit before doing anything expensive, like fetching the actor or
+	// checking the signature. Nothing in the activity can be trusted yet, so
+	// only where it came from counts.
+	if wait, ok := activitypub.AllowAddress(clientIP(ctx)); !ok {
+		return sendTooMany(ctx, wait)
+	}
+
 	actor, _ := activitypub.GetActorFromDB(config.Domain + "/" + ctx.Params("actor"))
 	activity, err := activitypub.GetActivityFromJson(ctx)
 
@@ -38,6 +47,10 @@ func ActorInbox(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(400)
 	}
 
+	if wait, ok := activitypub.AllowInbox(*activity.Actor); !ok {
+		return sendTooMany(ctx, wait)
+	}
+
 	switch activity.Type {
 	case "Accept":
 		if activity.Object.Object.Type == "Follow" {
@@ -48,6 +61,10 @@ func ActorInbox(ctx *fiber.Ctx) error {
 			return ctx.SendStatus(400)
 		}
 	case "Create":
+		if wait, ok := activitypub.AllowCache(*activity.Actor); !ok {
+			return sendTooMany(ctx, wait)
+		}
+
 		if err := actor.ProcessInboxCreate(activity); err != nil {
 			return util.WrapError(err)
 		}
@@ -56,7 +73,35 @@ func ActorInbox(ctx *fiber.Ctx) error {
 			return util.WrapError(err)
 		}
 	case "Delete":
+		if activity.Object.Id != "" && activity.Object.Id == activity.Actor.Id {
+			// The board itself is gone
+			if local, _ := activity.Actor.IsLocal(); local {
+				return ctx.SendStatus(400)
+			}
+
+			if gone, err := activity.Actor.IsGone(); err != nil {
+				return util.WrapError(err)
+			} else if !gone {
+				return ctx.SendStatus(400)
+			}
+
+			if err := activity.Actor.Forget(false); err != nil {
+				return util.WrapError(err)
+			}
+			break
+		}
+
 		if actor.Id != "" && actor.Id != config.Domain {
+			// Only a file was deleted, not the post it was on.
+			if post, err := activity.Object.AttachmentOf(); err != nil {
+				return util.WrapError(err)
+			} else if post != "" {
+				if err := activity.Object.TombstoneFile(); err != nil {
+					return util.WrapError(err)
+				}
+				break
+			}
+
 			if activity.Object.Replies != nil {
 				for _, k := range activity.Object.Replies.OrderedItems {
 					if err := k.Tombstone(); err != nil {
@@ -148,6 +193,10 @@ func ActorInbox(ctx *fiber.Ctx) error {
 				return util.WrapError(err)
 			}
 		}
+	case "Move":
+		if err := activity.ProcessMove(); err != nil {
+			return util.WrapError(err)
+		}
 	}
 	return nil
 }
@@ -173,6 +222,12 @@ func MakeActorPost(ctx *fiber.Ctx) error {
 	// Waive captcha for authenticated users, otherwise complain
 	// Do this as early as possible to prevent wasting time
 	if !reg {
+		if ban, err := db.FindBan(actor.Id, clientIP(ctx)); err != nil {
+			return send500(ctx, err)
+		} else if ban != nil {
+			return sendBanned(ctx, *ban)
+		}
+
 		if actor.Locked() {
 			return send403(ctx, "Board locked. No new posts may be made at this time.")
 		}
@@ -188,61 +243,182 @@ func MakeActorPost(ctx *fiber.Ctx) error {
 		}
 	}
 
-	header, err := ctx.FormFile("file")
+	settings, err := actor.Settings()
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	thread := ctx.FormValue("inReplyTo") == ""
+
+	hash, key, err := db.PosterHash(clientIP(ctx))
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	// Staff are trusted not to flood, like they are with the captcha.
+	if !reg {
+		if wait, msg, err := cooldown(actor, settings, hash, thread, ctx.FormValue("comment")); err != nil {
+			return send500(ctx, err)
+		} else if wait > 0 {
+			return sendCooldown(ctx, wait, msg)
+		}
+
+		if settings.Originality {
+			if until, err := db.OriginalityMute(actor.Id, hash); err != nil {
+				return send500(ctx, err)
+			} else if left := time.Until(until); left > 0 {
+				return sendCooldown(ctx, left, fmt.Sprintf("You are muted for posting something unoriginal. You must wait %d more seconds before posting again.", int(left.Seconds())+1))
+			}
+		}
+	}
+
+	headers := formFiles(ctx)
+	original := db.NewOriginality(ctx.FormValue("comment"))
 
-	if ctx.FormValue("inReplyTo") == "" && header == nil {
-		return send400(ctx, "Media is required for new threads.")
+	if len(headers) > 0 && !settings.AllowsFiles() {
+		return send400(ctx, "This board is text only. Files can't be posted.")
+	} else if len(headers) == 0 && settings.NeedsFile(thread) {
+		if thread {
+			return send400(ctx, "Media is required for new threads.")
+		}
+
+		return send400(ctx, "Media is required for replies on this board.")
+	} else if len(headers) > settings.MaxFiles {
+		return send400(ctx, fmt.Sprintf("Only %d files may be attached to a post.", settings.MaxFiles))
+	}
+
+	if !thread && len(headers) > 0 {
+		op := activitypub.ObjectBase{Id: ctx.FormValue("inReplyTo")}
+		if _, imageLimit, err := op.ThreadLimits(); err != nil {
+			return send500(ctx, err)
+		} else if imageLimit {
+			return send400(ctx, "This thread has reached its image limit. Replies can no longer have files.")
+		}
 	}
 
-	var file multipart.File
-	if header != nil && err == nil {
-		file, err = header.Open()
+	for _, header := range headers {
+		file, err := header.Open()
 		if err != nil {
 			return err
 		}
 		defer file.Close()
 
-		// TODO: Do this according to the set limit
-		if header.Size > (7 << 20) {
-			return send400(ctx, "Max file size is 7 MB.")
-		} else if isBanned, err := db.IsMediaBanned(file); err == nil && isBanned {
+		if header.Size > int64(settings.MaxFileSize) {
+			return send400(ctx, fmt.Sprintf("Max file size is %s.", util.ConvertSize(int64(settings.MaxFileSize))))
+		}
+
+		// Only hashed here; what it looks like is checked once it's
+		// been saved, see attachmentFromForm.
+		hash, err := db.HashMedia(file)
+		if err != nil {
+			return send500(ctx, err)
+		}
+
+		if isBanned, err := db.IsMediaHashBanned(hash, nil); err != nil {
+			return send500(ctx, err)
+		} else if isBanned {
 			return send400(ctx, "Media is banned.")
 		}
 
+		original.AddMedia(hash)
+
+		file.Seek(0, io.SeekStart)
 		contentType, _ := util.GetFileContentType(file)
-		if !util.SupportedMIMEType(contentType) {
-			return send400(ctx, "Unsupported file type.")
+		if !settings.Accepts(contentType) {
+			return send400(ctx, fmt.Sprintf("%s files can't be posted on this board.", contentType))
 		}
 
 		file.Seek(0, io.SeekStart)
-	} else {
-		// No file attached or couldn't load it
-		// Disallow blank posting
-		if strings.TrimSpace(ctx.FormValue("comment")) == "" {
-			return send400(ctx, "Comment required.")
-		}
+	}
+
+	// Disallow blank posting
+	if len(headers) == 0 && strings.TrimSpace(ctx.FormValue("comment")) == "" {
+		return send400(ctx, "Comment required.")
 	}
 
 	// Sanity check values
-	if len(ctx.FormValue("comment")) > 4500 {
-		return send400(ctx, "Comment limit is 4500 characters.")
-	} else if len(ctx.FormValue("subject")) > 100 || len(ctx.FormValue("name")) > 100 || len(ctx.FormValue("options")) > 100 {
-		return send400(ctx, "Name, subject, or options limit is 100 characters.")
-	} else if strings.Count(ctx.FormValue("comment"), "\n") > 50 {
+	if len(ctx.FormValue("comment")) > settings.MaxComment {
+		return send400(ctx, fmt.Sprintf("Comment limit is %d characters.", settings.MaxComment))
+	} else if len(ctx.FormValue("subject")) > settings.MaxName || len(ctx.FormValue("name")) > settings.MaxName {
+		return send400(ctx, fmt.Sprintf("Name and subject limit is %d characters.", settings.MaxName))
+	} else if len(ctx.FormValue("options")) > 100 || len(ctx.FormValue("password")) > 100 {
+		return send400(ctx, "Options and password limit is 100 characters.")
+	} else if strings.Count(ctx.FormValue("comment"), "\n") >= settings.MaxLines {
 		return send400(ctx, "Your post has too many lines.")
-	} else if is, _ := util.IsPostBlacklist(ctx.FormValue("comment")); is {
-		return send400(ctx, "Your post was blocked.")
 	}
 
-	nObj, err := objectFromForm(ctx, activitypub.CreateObject("Note"))
-	if err != nil {
+	// Staff may repost, as they may skip the cooldowns.
+	if settings.Originality && !reg {
+		if is, err := original.IsOriginal(actor.Id, settings.OriginalMedia); err != nil {
+			return send500(ctx, err)
+		} else if !is {
+			mute, err := db.MuteUnoriginal(actor.Id, hash)
+			if err != nil {
+				return send500(ctx, err)
+			}
+
+			return sendCooldown(ctx, mute, fmt.Sprintf("That has already been posted here, and this board only takes original posts. You are muted for %d seconds.", int(mute.Seconds())))
+		}
+	}
+
+	nObj, err := objectFromForm(ctx, actor, activitypub.CreateObject("Note"))
+	if errors.Is(err, activitypub.ErrBadMedia) {
+		return send400(ctx, "Your file could not be read.")
+	} else if errors.Is(err, errBannedMedia) {
+		return send400(ctx, "Media is banned.")
+	} else if errors.Is(err, errFiltered) {
+		return send400(ctx, "Your post was blocked.")
+	} else if errors.Is(err, errFilteredTooLong) {
+		return send400(ctx, "Your post is too long once filtered.")
+	} else if err != nil {
 		return util.WrapError(err)
 	}
 
+	if settings.PosterIDs {
+		op := nObj.InReplyTo[0].Id
+		if thread {
+			// Threads are their own thread, so they need their ID
+			// before they are written.
+			if nObj.Id, err = actor.NewPostID(); err != nil {
+				return send500(ctx, err)
+			}
+
+			op = nObj.Id
+		}
+
+		if nObj.PosterID, err = db.PosterID(clientIP(ctx), op); err != nil {
+			return send500(ctx, err)
+		}
+	}
+
 	if err := newPost(actor, &nObj); err != nil {
 		return err
 	}
 
+	if password := ctx.FormValue("password"); password != "" {
+		if err := db.SetPostPassword(nObj.Id, password); err != nil {
+			return send500(ctx, err)
+		}
+	}
+
+	if err := db.SetPosterHash(nObj.Id, actor.Id, hash, key, thread); err != nil {
+		return send500(ctx, err)
+	}
+
+	// Files are stored differently to how they were uploaded, and either
+	// way is a repost.
+	for _, e := range nObj.Attachment {
+		original.AddHref(e.Href)
+	}
+
+	if err := original.Record(actor.Id); err != nil {
+		return send500(ctx, err)
+	}
+
+	if nObj.IsHeld() {
+		return send202(ctx, "Your post will be shown once a moderator has looked at it.")
+	}
+
 	var id string
 	op := len(nObj.InReplyTo) - 1
 	if op >= 0 {
@@ -287,6 +463,15 @@ func ActorPost(ctx *fiber.Ctx) error {
 
 	postId := rx.WordCharsToEnd.FindString(ctx.Path())
 
+	// Posts can be linked to by their number too, but they only live at
+	// their ID.
+	if n, err := strconv.Atoi(postId); err == nil {
+		if id, err := actor.GetPostByNumber(n); err == nil {
+			OP, _ := activitypub.ObjectBase{Id: id}.GetOP()
+			return ctx.Redirect(config.Domain+"/"+actor.Name+"/"+util.ShortURL(actor.Outbox, OP)+"#"+util.ShortURL(actor.Outbox, id), http.StatusSeeOther)
+		}
+	}
+
 	inReplyTo, _ := db.GetPostIDFromNum(postId)
 
 	// check if actually OP if not redirect to op to get full thread
@@ -328,7 +513,7 @@ func ActorPost(ctx *fiber.Ctx) error {
 		data.PostId = util.ShortURL(data.Board.To, data.Posts[0].Id)
 	}
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+	if err := populatePostForm(hasAuth, &data.Board); err != nil {
 		return util.WrapError(err)
 	}
 
@@ -394,7 +579,7 @@ func ActorCatalog(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+	if err := populatePostForm(hasAuth, &data.Board); err != nil {
 		return util.WrapError(err)
 	}
 
@@ -438,12 +623,16 @@ func ActorPosts(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
-	var offset = 15
+	settings, err := actor.Settings()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
 	var pages []int
-	pageLimit := (float64(collection.TotalItems) / float64(offset))
+	pageLimit := (float64(collection.TotalItems) / float64(settings.ThreadsPerPage))
 
-	if pageLimit > 11 {
-		pageLimit = 11
+	if pageLimit > float64(settings.MaxPages) {
+		pageLimit = float64(settings.MaxPages)
 	}
 
 	for i := 0.0; i < pageLimit; i++ {
@@ -467,7 +656,7 @@ func ActorPosts(ctx *fiber.Ctx) error {
 
 	data.Board.Post.Actor = actor.Id
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+	if err := populatePostForm(hasAuth, &data.Board); err != nil {
 		return util.WrapError(err)
 	}
 
@@ -521,11 +710,12 @@ func ActorArchive(ctx *fiber.Ctx) error {
 	data.ReturnTo = "archive"
 
 	data.Board.Post.Actor = actor.Id
+	data.Board.Settings, _ = actor.Settings()
 
 	data.Instance, err = activitypub.GetActorFromDB(config.Domain)
 
 	/*
-		if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+		if err := populatePostForm(hasAuth, &data.Board); err != nil {
 			return util.WrapError(err)
 		}
 	*/
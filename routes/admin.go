@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
 	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/rx"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -87,8 +89,21 @@ func AdminIndex(ctx *fiber.Ctx) error {
 
 	adminData.Instance, _ = activitypub.GetActorFromDB(config.Domain)
 
-	adminData.PostBlacklist, _ = util.GetRegexBlacklist()
+	adminData.Filters, _ = activitypub.Filters()
+	adminData.Held, _ = activitypub.HeldPosts()
+
+	// Trying out the filters on a post doesn't change anything, so it's
+	// done here instead of in its own handler.
+	if ctx.Query("test") != "" {
+		res := activitypub.TestFilters(ctx.Query("name"), ctx.Query("subject"), ctx.Query("comment"), ctx.Query("board"))
+		adminData.FilterTest = &res
+	}
+
 	adminData.Reports = reported
+	adminData.Peers = activitypub.PeersUsage()
+	adminData.PruneRuns, _ = activitypub.PruneRuns(10)
+	adminData.Bans, _ = db.Bans()
+	adminData.MediaBans, _ = db.MediaBans()
 
 	adminData.Meta.Description = adminData.Title
 	adminData.Meta.Url = adminData.Board.Actor.Id
@@ -230,6 +245,127 @@ func AdminSetLocked(ctx *fiber.Ctx) error {
 	return ctx.Redirect("/"+config.Key+"/"+ctx.FormValue("board", ""), http.StatusSeeOther)
 }
 
+func AdminSetSettings(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can change board settings.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board", "main"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	var s activitypub.Settings
+	fields := []struct {
+		name string
+		val  *int
+	}{
+		{"maxfiles", &s.MaxFiles},
+		{"maxfilesize", &s.MaxFileSize},
+		{"maxcomment", &s.MaxComment},
+		{"maxname", &s.MaxName},
+		{"maxlines", &s.MaxLines},
+		{"truncatelines", &s.TruncateLines},
+		{"maxthreads", &s.MaxThreads},
+		{"threadsperpage", &s.ThreadsPerPage},
+		{"maxpages", &s.MaxPages},
+		{"bumplimit", &s.BumpLimit},
+		{"imagelimit", &s.ImageLimit},
+	}
+
+	for _, f := range fields {
+		if *f.val, err = strconv.Atoi(ctx.FormValue(f.name)); err != nil {
+			return send400(ctx, "Settings must be whole numbers.")
+		}
+	}
+
+	// The form uses units people think in.
+	durations := []struct {
+		name string
+		val  *time.Duration
+		unit time.Duration
+	}{
+		{"deletewindow", &s.DeleteWindow, time.Minute},
+		{"archiveretention", &s.ArchiveRetention, 24 * time.Hour},
+		{"replycooldown", &s.ReplyCooldown, time.Second},
+		{"threadcooldown", &s.ThreadCooldown, time.Second},
+		{"identicalcooldown", &s.IdenticalCooldown, time.Second},
+	}
+
+	for _, d := range durations {
+		n, err := strconv.Atoi(ctx.FormValue(d.name))
+		if err != nil {
+			return send400(ctx, "Settings must be whole numbers.")
+		}
+
+		*d.val = time.Duration(n) * d.unit
+	}
+
+	s.MaxFileSize *= 1024 * 1024
+	s.PurgeArchive = ctx.FormValue("purgearchive") == "1"
+	s.PosterIDs = ctx.FormValue("posterids") == "1"
+	s.Originality = ctx.FormValue("originality") == "1"
+	s.OriginalMedia = ctx.FormValue("originalmedia") == "1"
+	s.PostMode = ctx.FormValue("postmode")
+
+	// Kept in the order they're supported in, so the defaults are
+	// recognised.
+	for _, e := range config.SupportedFiles {
+		for _, t := range ctx.Request().PostArgs().PeekMulti("filetypes") {
+			if string(t) == e {
+				s.FileTypes = append(s.FileTypes, e)
+				break
+			}
+		}
+	}
+
+	if err := s.Validate(); err != nil {
+		return send400(ctx, "Invalid settings: "+err.Error()+".")
+	}
+
+	if err := actor.SetSettings(s); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+ctx.FormValue("board", ""), http.StatusSeeOther)
+}
+
+func AdminMoveBoard(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can move boards.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil || actor.Name == "main" {
+		return send404(ctx, "Board not found")
+	}
+
+	name := ctx.FormValue("name")
+	if !rx.BoardName.MatchString(name) || name == "main" {
+		return send400(ctx, "Invalid board name.")
+	}
+
+	if _, err := activitypub.GetActorByNameFromDB(name); err == nil {
+		return send400(ctx, "A board with that name already exists.")
+	}
+
+	if err := activitypub.MoveBoard(actor, name); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+name, http.StatusSeeOther)
+}
+
 func AdminActorIndex(ctx *fiber.Ctx) error {
 	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
 	if !hasAuth {
@@ -288,10 +424,13 @@ func AdminActorIndex(ctx *fiber.Ctx) error {
 	data.Board.TP = config.TP
 
 	data.Board.Post.Actor = actor.Id
+	data.FileTypes = config.SupportedFiles
 
 	data.Instance, _ = activitypub.GetActorFromDB(config.Domain)
 
 	data.AutoSubscribe, _ = actor.GetAutoSubscribe()
+	data.Settings, _ = actor.Settings()
+	data.Defaults = activitypub.DefaultSettings()
 
 	data.Meta.Description = data.Title
 	data.Meta.Url = data.Board.Actor.Id
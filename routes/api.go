@@ -1,11 +1,19 @@
 package routes
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -24,11 +32,15 @@ func RouteImages(ctx *fiber.Ctx, media string) error {
 		return util.WrapError(err)
 	}
 
-	client := http.Client{
-		Timeout: 5 * time.Second,
+	// Routes carry their own timeouts; everything else shouldn't keep the
+	// page waiting.
+	if util.ProxyFor(req.URL.Host, util.Proxies) == nil {
+		c, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		req = req.WithContext(c)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := util.RouteProxy(req)
 	if err != nil {
 		return ctx.SendFile("./views/notfound.png")
 	}
@@ -38,12 +50,114 @@ func RouteImages(ctx *fiber.Ctx, media string) error {
 		return ctx.SendFile("./views/notfound.png")
 	}
 
-	for name, values := range resp.Header {
-		for _, value := range values {
-			ctx.Append(name, value)
+	// Remote media can be banned too. Files larger than we would accept
+	// from our own posters aren't decoded to compare what they look like,
+	// so they're only checked by their hash, taken as they're spooled to
+	// disk.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(config.MaxFileSize)+1))
+	if err != nil {
+		return ctx.SendFile("./views/notfound.png")
+	}
+
+	copyHeaders := func() {
+		for name, values := range resp.Header {
+			if name == "Content-Length" {
+				continue
+			}
+
+			for _, value := range values {
+				ctx.Append(name, value)
+			}
+		}
+	}
+
+	if len(data) <= config.MaxFileSize {
+		if banned, err := db.IsMediaBanned(data); err != nil {
+			return util.WrapError(err)
+		} else if banned {
+			return ctx.SendFile("./views/notfound.png")
 		}
+
+		copyHeaders()
+		return ctx.Send(data)
+	}
+
+	f, err := os.CreateTemp("./tmp", "proxy-*")
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	// It's still read from once it's gone, and closed once it has been.
+	os.Remove(f.Name())
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	if _, err := w.Write(data); err != nil {
+		f.Close()
+		return util.WrapError(err)
+	}
+
+	// Nobody gets to fill our disk by never finishing a file.
+	size, err := io.Copy(w, io.LimitReader(resp.Body, config.MaxRemoteMedia-int64(len(data))+1))
+	if err != nil || int64(len(data))+size > config.MaxRemoteMedia {
+		f.Close()
+		return ctx.SendFile("./views/notfound.png")
+	}
+
+	if banned, err := db.IsMediaHashBanned(hex.EncodeToString(h.Sum(nil)), nil); err != nil {
+		f.Close()
+		return util.WrapError(err)
+	} else if banned {
+		f.Close()
+		return ctx.SendFile("./views/notfound.png")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return util.WrapError(err)
+	}
+
+	copyHeaders()
+	return ctx.SendStream(f, len(data)+int(size))
+}
+
+// PostPreview returns a single post for showing when hovering over a link to
+// it: as it's shown on board, or as JSON if format=json.
+// Only posts we already have are returned; nobody else is asked.
+func PostPreview(ctx *fiber.Ctx) error {
+	post, err := activitypub.ObjectBase{Id: ctx.Query("id")}.GetPost()
+	if errors.Is(err, sql.ErrNoRows) {
+		return ctx.SendStatus(http.StatusNotFound)
+	} else if err != nil {
+		return util.WrapError(err)
+	}
+
+	if ctx.Query("format") == "json" {
+		return ctx.JSON(post)
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.Query("board"))
+	if err != nil {
+		return ctx.SendStatus(http.StatusNotFound)
+	}
+
+	op, err := post.GetOP()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	board := activitypub.Board{
+		Name:       actor.Name,
+		Actor:      actor,
+		Domain:     config.Domain,
+		Restricted: actor.Restricted,
+	}
+
+	out, err := renderPost(post, board, activitypub.ObjectBase{Id: op}, nil, true)
+	if err != nil {
+		return util.WrapError(err)
 	}
 
-	_, err = io.Copy(ctx, resp.Body)
-	return err
+	ctx.Type("html")
+	return ctx.SendString(string(out))
 }
@@ -0,0 +1,260 @@
+package routes
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// banExpiry turns a number of days into when a ban expires.
+// Zero days is a ban that doesn't expire.
+func banExpiry(days string) (time.Time, bool) {
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	} else if n == 0 {
+		return time.Time{}, true
+	}
+
+	return time.Now().UTC().AddDate(0, 0, n), true
+}
+
+// parseRange reads an address range, or a single address.
+func parseRange(s string) (string, bool) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", false
+		} else if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", false
+	}
+
+	return ipnet.String(), true
+}
+
+// sendBanned shows a poster why they can't post.
+func sendBanned(ctx *fiber.Ctx, ban db.Ban) error {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+
+	var data banPage
+	data.Title = "Banned"
+	data.Acct = acct
+	data.Boards = activitypub.Boards
+	data.Key = config.Key
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+	data.Ban = ban
+
+	if ban.Board != "" {
+		data.Board.Actor, _ = activitypub.GetActorFromDB(ban.Board)
+	}
+
+	return ctx.Status(http.StatusForbidden).Render("banned", data, "layouts/main")
+}
+
+func BanGet(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can ban posters.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.Query("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	var data banPage
+	data.Title = "Ban"
+	data.Acct = acct
+	data.Boards = activitypub.Boards
+	data.Key = config.Key
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+	data.Board.Actor = actor
+	data.Board.Name = actor.Name
+	data.Board.PrefName = actor.PreferredUsername
+	data.Board.Summary = actor.Summary
+	data.Post = ctx.Query("id")
+
+	return ctx.Render("ban", data, "layouts/main")
+}
+
+func BanPost(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can ban posters.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	ban := db.Ban{
+		Post:   ctx.FormValue("id"),
+		Reason: strings.TrimSpace(ctx.FormValue("reason")),
+		Staff:  acct.Username,
+	}
+
+	if ctx.FormValue("scope") != "global" {
+		ban.Board = actor.Id
+	}
+
+	var ok bool
+	if ban.Expires, ok = banExpiry(ctx.FormValue("days")); !ok {
+		return send400(ctx, "The length of a ban must be a number of days.")
+	}
+
+	if r := strings.TrimSpace(ctx.FormValue("range")); r != "" {
+		if ban.Range, ok = parseRange(r); !ok {
+			return send400(ctx, "Invalid address range.")
+		}
+	} else if ban.Hash, ban.Key, err = db.PosterOf(ban.Post); err != nil || ban.Hash == "" {
+		return send400(ctx, "The poster of this post isn't known. Ban an address range instead.")
+	}
+
+	if err := ban.Save(); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+actor.Name, http.StatusSeeOther)
+}
+
+// BanAppeal lets banned posters appeal their ban.
+func BanAppeal(ctx *fiber.Ctx) error {
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	ban, err := db.GetBan(id)
+	if err != nil {
+		return send404(ctx)
+	}
+
+	// Only the banned poster can appeal.
+	if ok, err := ban.Matches(clientIP(ctx)); err != nil {
+		return send500(ctx, err)
+	} else if !ok {
+		return send403(ctx)
+	}
+
+	appeal := strings.TrimSpace(ctx.FormValue("appeal"))
+	if appeal == "" || len(appeal) > 2000 {
+		return send400(ctx, "Appeals must be between 1 and 2000 characters.")
+	}
+
+	if err := db.AppealBan(id, appeal); err != nil {
+		return send500(ctx, err)
+	}
+
+	if ban, err = db.GetBan(id); err != nil {
+		return send500(ctx, err)
+	}
+
+	return sendBanned(ctx, ban)
+}
+
+func AdminEditBan(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can edit bans.")
+	}
+
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	ban, err := db.GetBan(id)
+	if err != nil {
+		return send404(ctx)
+	}
+
+	// Leaving the length empty keeps the ban's expiry.
+	expires, ok := ban.Expires, true
+	if days := ctx.FormValue("days"); days != "" {
+		expires, ok = banExpiry(days)
+	}
+
+	if !ok {
+		return send400(ctx, "The length of a ban must be a number of days.")
+	}
+
+	if err := db.EditBan(id, strings.TrimSpace(ctx.FormValue("reason")), expires); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"#bans", http.StatusSeeOther)
+}
+
+func AdminLiftBan(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can lift bans.")
+	}
+
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	if err := db.LiftBan(id); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"#bans", http.StatusSeeOther)
+}
+
+func AdminDenyAppeal(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can deny appeals.")
+	}
+
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	if err := db.DenyAppeal(id); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"#bans", http.StatusSeeOther)
+}
@@ -1,15 +1,17 @@
 package routes
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/smtp"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
@@ -57,26 +59,8 @@ func BoardBanMedia(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
-	re := regexp.MustCompile(config.Domain)
-	file := re.ReplaceAllString(col.OrderedItems[0].Attachment[0].Href, "")
-
-	f, err := os.Open("." + file)
-
-	if err != nil {
-		return util.WrapError(err)
-	}
-
-	defer f.Close()
-
-	bytes := make([]byte, 2048)
-
-	if _, err = f.Read(bytes); err != nil {
-		return util.WrapError(err)
-	}
-
-	if banned, err := db.IsMediaBanned(f); err == nil && !banned {
-		query := `insert into bannedmedia (hash) values ($1)`
-		if _, err := config.DB.Exec(query, util.HashBytes(bytes)); err != nil {
+	for _, e := range col.OrderedItems[0].Attachment {
+		if err := banMedia(e.Href); err != nil {
 			return util.WrapError(err)
 		}
 	}
@@ -207,6 +191,115 @@ func BoardDelete(ctx *fiber.Ctx) error {
 	return ctx.Redirect("/"+board, http.StatusSeeOther)
 }
 
+// banMedia bans the contents of an attachment.
+func banMedia(href string) error {
+	data, err := mediaBytes(href)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	return db.BanMedia(data)
+}
+
+// mediaBytes reads an attachment, fetching it if it's remote.
+func mediaBytes(href string) ([]byte, error) {
+	if strings.HasPrefix(href, config.Domain) {
+		data, err := os.ReadFile("." + strings.TrimPrefix(href, config.Domain))
+		return data, util.WrapError(err)
+	}
+
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	resp, err := util.RouteProxy(req)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching %s: %s", href, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	return data, util.WrapError(err)
+}
+
+func AdminMediaBanThumbnail(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
+	}
+
+	id, err := strconv.Atoi(ctx.Params("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	thumb, err := db.MediaBanThumbnail(id)
+	if err != nil || thumb == nil {
+		return ctx.SendFile("./views/notfound.png")
+	}
+
+	ctx.Set("Content-Type", "image/png")
+	return ctx.Send(thumb)
+}
+
+func AdminUnbanMedia(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
+	}
+
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	if err := db.UnbanMedia(id); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"#media", http.StatusSeeOther)
+}
+
+func AdminExportMediaBans(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
+	}
+
+	ctx.Set("Content-Type", "text/plain; charset=utf-8")
+	ctx.Set("Content-Disposition", `attachment; filename="bannedmedia.txt"`)
+	return db.ExportMediaBans(ctx)
+}
+
+func AdminImportMediaBans(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
+	}
+
+	header, err := ctx.FormFile("list")
+	if err != nil {
+		return send400(ctx, "A list of hashes is required.")
+	}
+
+	f, err := header.Open()
+	if err != nil {
+		return send500(ctx, err)
+	}
+	defer f.Close()
+
+	if _, err := db.ImportMediaBans(f); err != nil {
+		return send400(ctx, err.Error())
+	}
+
+	return ctx.Redirect("/"+config.Key+"#media", http.StatusSeeOther)
+}
+
 func BoardDeleteAttach(ctx *fiber.Ctx) error {
 	_, hasAuth := ctx.Locals("acct").(*db.Acct)
 
@@ -248,6 +341,12 @@ func BoardDeleteAttach(ctx *fiber.Ctx) error {
 
 	obj := activitypub.ObjectBase{Id: postID}
 
+	if local, _ := obj.IsLocal(); local {
+		if err := obj.DeleteAttachmentsRequest(); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
 	if err := obj.DeleteAttachmentFromFile(); err != nil {
 		return util.WrapError(err)
 	}
@@ -331,9 +430,41 @@ func BoardMarkSensitive(ctx *fiber.Ctx) error {
 	return ctx.Redirect("/"+board, http.StatusSeeOther)
 }
 
-// TODO routes/BoardRemove
 func BoardRemove(ctx *fiber.Ctx) error {
-	return ctx.SendString("board remove")
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can delete boards.")
+	}
+
+	board := ctx.FormValue("board")
+
+	// Local boards are given by name, remote ones by ID.
+	if actor, err := activitypub.GetActorByNameFromDB(board); err == nil {
+		if actor.Name == "main" {
+			return send400(ctx, "The instance actor cannot be deleted.")
+		}
+
+		if err := actor.DeleteBoard(); err != nil {
+			return send500(ctx, err)
+		}
+
+		return ctx.Redirect("/"+config.Key+"/", http.StatusSeeOther)
+	}
+
+	actor := activitypub.Actor{Id: board}
+	if local, _ := actor.IsLocal(); local || board == "" {
+		return send404(ctx, "Board not found")
+	}
+
+	if err := actor.Forget(true); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+ctx.FormValue("manage"), http.StatusSeeOther)
 }
 
 // TODO routes/BoardAddToIndex
@@ -389,41 +520,78 @@ func BoardAutoSubscribe(ctx *fiber.Ctx) error {
 	return ctx.Redirect("/"+config.Key+"/"+board, http.StatusSeeOther)
 }
 
-func BoardBlacklist(ctx *fiber.Ctx) error {
-	_, hasAuth := ctx.Locals("acct").(*db.Acct)
-	if !hasAuth {
-		return send404(ctx)
+func AdminAddFilter(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
 	}
 
-	if ctx.Method() == "GET" {
-		if id := ctx.Query("remove"); id != "" {
-			i, _ := strconv.Atoi(id)
-			if err := util.DeleteRegexBlacklist(i); err != nil {
-				return util.WrapError(err)
-			}
-		}
-	} else {
-		regex := ctx.FormValue("regex")
-		testCase := ctx.FormValue("testCase")
+	f := activitypub.Filter{
+		Board:       ctx.FormValue("board"),
+		Pattern:     ctx.FormValue("pattern"),
+		Action:      ctx.FormValue("action"),
+		Replacement: ctx.FormValue("replacement"),
+		Name:        ctx.FormValue("name") != "",
+		Subject:     ctx.FormValue("subject") != "",
+		Comment:     ctx.FormValue("comment") != "",
+	}
 
-		if regex == "" {
-			return ctx.Redirect("/", http.StatusSeeOther)
-		}
+	if err := activitypub.AddFilter(f); errors.Is(err, activitypub.ErrBadFilter) {
+		return send400(ctx, err.Error())
+	} else if err != nil {
+		return send500(ctx, err)
+	}
 
-		re := regexp.MustCompile(regex)
+	return ctx.Redirect("/"+config.Key+"#filters", http.StatusSeeOther)
+}
 
-		if testCase == "" {
-			if err := util.WriteRegexBlacklist(regex); err != nil {
-				return util.WrapError(err)
-			}
-		} else if re.MatchString(testCase) {
-			if err := util.WriteRegexBlacklist(regex); err != nil {
-				return util.WrapError(err)
-			}
+func AdminDeleteFilter(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
+	}
+
+	id, err := strconv.Atoi(ctx.FormValue("id"))
+	if err != nil {
+		return send400(ctx)
+	}
+
+	if err := activitypub.DeleteFilter(id); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"#filters", http.StatusSeeOther)
+}
+
+// AdminReviewHeld shows or removes a post held by a filter.
+func AdminReviewHeld(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth || acct.Type < db.Mod {
+		return send403(ctx)
+	}
+
+	obj, err := activitypub.GetHeldPost(ctx.FormValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return send404(ctx)
+	} else if err != nil {
+		return send500(ctx, err)
+	}
+
+	if ctx.FormValue("release") != "" {
+		post, err := obj.Release()
+		if err != nil {
+			return send500(ctx, err)
+		}
+
+		// Nobody else has seen it yet.
+		if local, _ := obj.IsLocal(); local {
+			publish(post)
 		}
+	} else if err := obj.Reject(); err != nil {
+		return send500(ctx, err)
 	}
 
-	return ctx.Redirect("/"+config.Key+"#regex", http.StatusSeeOther)
+	return ctx.Redirect("/"+config.Key+"#held", http.StatusSeeOther)
 }
 
 func ReportPost(ctx *fiber.Ctx) error {
@@ -535,7 +703,7 @@ func ReportGet(ctx *fiber.Ctx) error {
 	data.Board.Restricted = actor.Restricted
 	data.Acct = acct
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+	if err := populatePostForm(hasAuth, &data.Board); err != nil {
 		return util.WrapError(err)
 	}
 
@@ -558,6 +726,139 @@ func ReportGet(ctx *fiber.Ctx) error {
 	return ctx.Render("report", data, "layouts/main")
 }
 
+// UserDelete lets posters delete their own posts, or just the files on them,
+// with the password they posted with.
+func UserDelete(ctx *fiber.Ctx) error {
+	id := ctx.FormValue("id")
+	password := ctx.FormValue("password")
+
+	if id == "" || password == "" {
+		return send400(ctx, "Post and password required.")
+	}
+
+	// Only local posts have passwords.
+	obj := activitypub.ObjectBase{Id: id}
+	post, err := obj.GetFromPath()
+	if err != nil || post.Type == "Tombstone" {
+		return send404(ctx)
+	}
+
+	actor, err := activitypub.GetActorFromDB(post.Actor)
+	if err != nil {
+		return send404(ctx)
+	}
+
+	settings, err := actor.Settings()
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	window := settings.DeleteWindow
+	if window <= 0 {
+		return send403(ctx, "Posts on this board can't be deleted by their posters.")
+	} else if time.Since(post.Published) > window {
+		return send403(ctx, "This post is too old to be deleted.")
+	}
+
+	if ok, err := db.CheckPostPassword(id, password); errors.Is(err, db.ErrTooManyGuesses) {
+		return send403(ctx, "Too many wrong passwords. Try again later.")
+	} else if err != nil {
+		return send500(ctx, err)
+	} else if !ok {
+		return send403(ctx, "Incorrect password.")
+	}
+
+	OP, _ := obj.GetOP()
+	isOP, _ := obj.CheckIfOP()
+
+	if ctx.FormValue("file") == "1" {
+		if len(post.Attachment) == 0 {
+			return send400(ctx, "This post has no files.")
+		}
+
+		if err := obj.DeleteAttachmentsRequest(); err != nil {
+			return send500(ctx, err)
+		}
+
+		if err := obj.DeleteAttachmentFromFile(); err != nil {
+			return send500(ctx, err)
+		}
+
+		if err := obj.TombstoneAttachment(); err != nil {
+			return send500(ctx, err)
+		}
+
+		if err := obj.DeletePreviewFromFile(); err != nil {
+			return send500(ctx, err)
+		}
+
+		if err := obj.TombstonePreview(); err != nil {
+			return send500(ctx, err)
+		}
+
+		return ctx.Redirect("/"+actor.Name+"/"+util.ShortURL(actor.Outbox, OP), http.StatusSeeOther)
+	}
+
+	if isOP {
+		if err := obj.TombstoneReplies(); err != nil {
+			return send500(ctx, err)
+		}
+	} else if err := obj.Tombstone(); err != nil {
+		return send500(ctx, err)
+	}
+
+	if err := obj.DeleteRequest(); err != nil {
+		return send500(ctx, err)
+	}
+
+	if err := actor.UnArchiveLast(); err != nil {
+		return send500(ctx, err)
+	}
+
+	if !isOP {
+		return ctx.Redirect("/"+actor.Name+"/"+util.ShortURL(actor.Outbox, OP), http.StatusSeeOther)
+	}
+
+	return ctx.Redirect("/"+actor.Name, http.StatusSeeOther)
+}
+
+func UserDeleteGet(ctx *fiber.Ctx) error {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+	actor, err := activitypub.GetActorFromDB(ctx.Query("actor"))
+	if err != nil {
+		return send404(ctx)
+	}
+
+	var data pageData
+
+	data.Board.Actor = actor
+	data.Board.Name = actor.Name
+	data.Board.PrefName = actor.PreferredUsername
+	data.Board.Summary = actor.Summary
+	data.Board.InReplyTo = ctx.Query("post")
+	data.Board.To = actor.Outbox
+	data.Board.Restricted = actor.Restricted
+	data.Acct = acct
+
+	data.Meta.Description = data.Board.Summary
+	data.Meta.Url = data.Board.Actor.Id
+	data.Meta.Title = data.Title
+
+	data.Instance, err = activitypub.GetActorFromDB(config.Domain)
+	if err != nil {
+		return err
+	}
+
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+
+	data.Key = config.Key
+	data.Board.Domain = config.Domain
+	data.Boards = activitypub.Boards
+
+	return ctx.Render("delete", data, "layouts/main")
+}
+
 func Sticky(ctx *fiber.Ctx) error {
 	_, hasAuth := ctx.Locals("acct").(*db.Acct)
 
@@ -1,6 +1,8 @@
 package routes
 
 import (
+	"net/http"
+
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
 	"github.com/KushBlazingJudah/fedichan/db"
@@ -81,3 +83,18 @@ func Followers(ctx *fiber.Ctx) error {
 	actor, _ := activitypub.GetActorFromDB(config.Domain)
 	return actor.GetFollowersResp(ctx)
 }
+
+// Moved redirects requests for boards that moved, and everything on them, to
+// their new location.
+func Moved(ctx *fiber.Ctx) error {
+	loc, ok := activitypub.MovedLocation(ctx.Hostname() + ctx.Path())
+	if !ok {
+		return ctx.Next()
+	}
+
+	if q := ctx.Request().URI().QueryString(); len(q) > 0 {
+		loc += "?" + string(q)
+	}
+
+	return ctx.Redirect(loc, http.StatusMovedPermanently)
+}
@@ -3,7 +3,6 @@ package routes
 import (
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/db"
-	"github.com/KushBlazingJudah/fedichan/util"
 )
 
 type common struct {
@@ -36,6 +35,13 @@ type pageData struct {
 	Blotters          []string
 }
 
+type banPage struct {
+	common
+
+	Ban  db.Ban
+	Post string
+}
+
 type errorData struct {
 	common
 	Message string
@@ -50,12 +56,21 @@ type adminPage struct {
 	Followers     []string
 	Domain        string
 	IsLocal       bool
-	PostBlacklist []util.PostBlacklist
+	Filters       []activitypub.Filter
+	FilterTest    *activitypub.FilterResult
+	Held          []activitypub.ObjectBase
 	AutoSubscribe bool
 	RecentPosts   []activitypub.ObjectBase
 	Reports       map[string][]db.Reports
 	Users         []db.Acct
 	User          *db.Acct
+	Peers         []activitypub.PeerUsage
+	PruneRuns     []activitypub.PruneRun
+	Bans          []db.Ban
+	MediaBans     []db.MediaBan
+	Settings      activitypub.Settings
+	Defaults      activitypub.Settings
+	FileTypes     []string
 }
 
 type meta struct {
@@ -4,13 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html"
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"mime/multipart"
+	"net"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"time"
@@ -23,11 +25,132 @@ import (
 	fhtml "github.com/gofiber/template/html"
 )
 
+// trustedProxies are the proxies whose ProxyHeader is believed.
+var trustedProxies = parseProxies(config.TrustedProxies)
+
+// parseProxies reads a list of addresses and CIDR ranges.
+func parseProxies(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+
+	for _, e := range list {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+
+		if !strings.Contains(e, "/") {
+			if ip := net.ParseIP(e); ip == nil {
+				log.Printf("ignoring trusted proxy %q: not an address", e)
+				continue
+			} else if ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			log.Printf("ignoring trusted proxy %q: %v", e, err)
+			continue
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the address of the client, as told by our reverse proxy if
+// we have one.
+func clientIP(ctx *fiber.Ctx) string {
+	if config.ProxyHeader == "" {
+		return ctx.IP()
+	}
+
+	return forwardedIP(ctx.Context().RemoteIP(), ctx.Get(config.ProxyHeader), trustedProxies)
+}
+
+// forwardedIP returns the client that connected through remote, given the
+// addresses remote says a request was forwarded for.
+// Each proxy appends the address it got the request from, and anything before
+// that is whatever the client sent, so the list is read from the right and
+// the first address that isn't one of our proxies is the client.
+func forwardedIP(remote net.IP, header string, trusted []*net.IPNet) string {
+	if !isTrusted(remote, trusted) {
+		return remote.String()
+	}
+
+	client := remote
+	hops := strings.Split(header, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		client = ip
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// cooldown returns how long a poster has to wait before they can make a post,
+// and why.
+func cooldown(board activitypub.Actor, s activitypub.Settings, hash string, thread bool, comment string) (time.Duration, string, error) {
+	wait, kind := s.ReplyCooldown, "reply"
+	if thread {
+		wait, kind = s.ThreadCooldown, "thread"
+	}
+
+	if wait > 0 {
+		last, err := db.LastPost(board.Id, hash, thread)
+		if err != nil {
+			return 0, "", util.WrapError(err)
+		}
+
+		if left := time.Until(last.Add(wait)); left > 0 {
+			return left, fmt.Sprintf("You must wait %d more seconds before making another %s.", int(left.Seconds())+1, kind), nil
+		}
+	}
+
+	if s.IdenticalCooldown > 0 && strings.TrimSpace(comment) != "" {
+		last, err := db.LastIdenticalPost(board.Id, hash, comment)
+		if err != nil {
+			return 0, "", util.WrapError(err)
+		}
+
+		if left := time.Until(last.Add(s.IdenticalCooldown)); left > 0 {
+			return left, fmt.Sprintf("You have already posted that. You must wait %d more seconds before posting it again.", int(left.Seconds())+1), nil
+		}
+	}
+
+	return 0, "", nil
+}
+
 func themeCookie(c *fiber.Ctx) string {
 	return c.Cookies("theme")
 }
 
-func populateCaptcha(hasAuth bool, b *activitypub.Board) error {
+// populatePostForm fills in what the posting form on b needs.
+func populatePostForm(hasAuth bool, b *activitypub.Board) error {
+	var err error
+	if b.Settings, err = b.Actor.Settings(); err != nil {
+		return util.WrapError(err)
+	}
+
 	if hasAuth {
 		// No-op because laziness
 		return nil
@@ -86,31 +209,35 @@ func newPost(actor activitypub.Actor, nObj *activitypub.ObjectBase) error {
 		}
 	}
 
+	// Held posts are published once they're released.
+	if nObj.IsHeld() {
+		return util.WrapError(nObj.KeepHeld())
+	}
+
+	publish(*nObj)
+
+	return nil
+}
+
+// publish sends a new local post to everyone that should have it.
+func publish(nObj activitypub.ObjectBase) {
 	go func(nObj activitypub.ObjectBase) {
 		activity, err := nObj.CreateActivity("Create")
 		if err != nil {
 			log.Printf("ParseOutboxRequest Create Activity: %s", err)
 		}
 
-		activity, err = activity.AddFollowersTo()
+		activity, err = activity.AddAudience()
 		if err != nil {
-			log.Printf("ParseOutboxRequest Add FollowersTo: %s", err)
+			log.Printf("ParseOutboxRequest Add Audience: %s", err)
 		}
 
 		if err := activity.Send(); err != nil {
 			log.Printf("ParseOutboxRequest MakeRequestInbox: %s", err)
 		}
-	}(*nObj)
+	}(nObj)
 
 	go nObj.SendEmailNotify()
-
-	return nil
-}
-
-func parseReplyLink(actorId string, op string, id string, content string) template.HTML {
-	actor, _ := activitypub.FingerActor(actorId)
-	title := html.EscapeString(db.ParseLinkTitle(actor.Id+"/", op, content))
-	return template.HTML(fmt.Sprintf(`<a href="/%s/%s#%s" title="%s" class="replyLink">&gt;&gt;%s</a>`, actor.Name, util.ShortURL(actor.Outbox, op), util.ShortURL(actor.Outbox, id), title, util.ShortURL(actor.Outbox, id)))
 }
 
 func timeToReadableLong(t time.Time) string {
@@ -118,20 +245,50 @@ func timeToReadableLong(t time.Time) string {
 	return t.Format("01/02/06(Mon)15:04:05")
 }
 
+// mediaDuration formats how long media plays for, such as 3:07 or 1:02:45.
+func mediaDuration(seconds activitypub.Duration) string {
+	d := int(math.Round(float64(seconds)))
+	if d >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", d/3600, d/60%60, d%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", d/60, d%60)
+}
+
+// posterIDColor returns the colour a poster ID is shown in, so the same ID is
+// easy to pick out across a thread.
+func posterIDColor(id string) template.CSS {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return template.CSS(fmt.Sprintf("hsl(%d, 60%%, 35%%)", h.Sum32()%360))
+}
+
+// staffCapcode reports whether a post's capcode is one of our staff's, and
+// should be styled as one. Other instances can put anything there.
+func staffCapcode(post activitypub.ObjectBase) bool {
+	return strings.HasPrefix(post.Id, config.Domain+"/") && db.ParseAcctType(post.Capcode) != db.None
+}
+
 func timeToUnix(t time.Time) string {
 	// TODO: Not necessary.
 	return fmt.Sprint(t.Unix())
 }
 
+// postTmpl renders a single post, such as for hover previews.
+var postTmpl *template.Template
+
 func TemplateFunctions(engine *fhtml.Engine) {
-	postTmpl := template.Must(template.New("").Funcs(template.FuncMap{
+	postTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 		"convertSize":        util.ConvertSize,
-		"isOnion":            util.IsOnion,
+		"isOverlay":          util.IsOverlay,
+		"mediaDuration":      mediaDuration,
+		"networkName":        util.NetworkName,
 		"parseAttachment":    parseAttachment,
 		"parseContent":       db.ParseContent,
-		"parseReplyLink":     parseReplyLink,
+		"posterIDColor":      posterIDColor,
 		"proxy":              util.MediaProxy,
 		"shortImg":           util.ShortImg,
+		"staffCapcode":       staffCapcode,
 		"timeToReadableLong": timeToReadableLong,
 		"timeToUnix":         timeToUnix,
 		"shortURL":           util.ShortURL,
@@ -149,6 +306,14 @@ func TemplateFunctions(engine *fhtml.Engine) {
 		return i + j
 	})
 
+	engine.AddFunc("mbytes", func(b int) int {
+		return b / (1024 * 1024)
+	})
+
+	engine.AddFunc("days", func(d time.Duration) int {
+		return int(d.Hours() / 24)
+	})
+
 	engine.AddFunc("unixtoreadable", func(u int) string {
 		return time.Unix(int64(u), 0).Format("Jan 02, 2006")
 	})
@@ -171,9 +336,11 @@ func TemplateFunctions(engine *fhtml.Engine) {
 	engine.AddFunc("parseContent", db.ParseContent)
 	engine.AddFunc("shortImg", util.ShortImg)
 	engine.AddFunc("convertSize", util.ConvertSize)
-	engine.AddFunc("isOnion", util.IsOnion)
-
-	engine.AddFunc("parseReplyLink", parseReplyLink)
+	engine.AddFunc("isOverlay", util.IsOverlay)
+	engine.AddFunc("mediaDuration", mediaDuration)
+	engine.AddFunc("posterIDColor", posterIDColor)
+	engine.AddFunc("staffCapcode", staffCapcode)
+	engine.AddFunc("networkName", util.NetworkName)
 
 	engine.AddFunc("shortExcerpt", func(post activitypub.ObjectBase) template.HTML {
 		var returnString string
@@ -238,71 +405,150 @@ func TemplateFunctions(engine *fhtml.Engine) {
 	})
 
 	engine.AddFunc("renderPost", func(p activitypub.ObjectBase, b activitypub.Board, t activitypub.ObjectBase, a *db.Acct, trunc bool) template.HTML {
-		buf := &strings.Builder{}
-		if err := postTmpl.ExecuteTemplate(buf, "post", struct {
-			Board  activitypub.Board
-			Acct   *db.Acct
-			Thread activitypub.ObjectBase
-			Post   activitypub.ObjectBase
-			Trunc  bool
-		}{b, a, t, p, trunc}); err != nil {
+		out, err := renderPost(p, b, t, a, trunc)
+		if err != nil {
 			// A panic is fine in this context
 			panic(err)
 		}
 
-		return template.HTML(buf.String())
+		return out
 	})
 }
 
-func objectFromForm(ctx *fiber.Ctx, obj activitypub.ObjectBase) (activitypub.ObjectBase, error) {
-	acct, _ := ctx.Locals("acct").(*db.Acct)
+func renderPost(p activitypub.ObjectBase, b activitypub.Board, t activitypub.ObjectBase, a *db.Acct, trunc bool) (template.HTML, error) {
+	buf := &strings.Builder{}
+	err := postTmpl.ExecuteTemplate(buf, "post", struct {
+		Board  activitypub.Board
+		Acct   *db.Acct
+		Thread activitypub.ObjectBase
+		Post   activitypub.ObjectBase
+		Trunc  bool
+	}{b, a, t, p, trunc})
+
+	return template.HTML(buf.String()), util.WrapError(err)
+}
 
-	var err error
-	var file multipart.File
+// formFiles returns the files uploaded with a post, in the order they were
+// picked.
+func formFiles(ctx *fiber.Ctx) []*multipart.FileHeader {
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		return nil
+	}
+
+	return form.File["file"]
+}
+
+var errBannedMedia = errors.New("media is banned")
+
+var errFiltered = errors.New("post was filtered")
 
-	header, _ := ctx.FormFile("file")
+var errFilteredTooLong = errors.New("post is too long once filtered")
 
-	if header != nil {
-		file, _ = header.Open()
+// attachmentFromForm saves an uploaded file and returns it as an attachment
+// with a preview.
+func attachmentFromForm(header *multipart.FileHeader) (activitypub.ObjectBase, error) {
+	file, err := header.Open()
+	if err != nil {
+		return activitypub.ObjectBase{}, util.WrapError(err)
 	}
+	defer file.Close()
 
-	if file != nil {
-		defer file.Close()
-		var tempFile = new(os.File)
+	attachment, tempFile, err := activitypub.CreateAttachmentObject(file, header)
+	if err != nil {
+		return activitypub.ObjectBase{}, util.WrapError(err)
+	}
+	defer tempFile.Close()
 
-		obj.Attachment, tempFile, err = activitypub.CreateAttachmentObject(file, header)
-		if err != nil {
-			return obj, util.WrapError(err)
-		}
-		defer tempFile.Close()
+	if _, err := io.Copy(tempFile, file); err != nil {
+		return attachment[0], util.WrapError(err)
+	}
 
-		if _, err := io.Copy(tempFile, file); err != nil {
-			return obj, util.WrapError(err)
-		}
+	if attachment[0], err = attachment[0].SanitizeMedia(); err != nil {
+		os.Remove(tempFile.Name())
+		return attachment[0], util.WrapError(err)
+	}
+
+	// Media banned from a post was banned as we stored it, so check it
+	// again now that it's been stored the same way.
+	if banned, err := db.IsMediaFileBanned(tempFile.Name()); err != nil {
+		return attachment[0], util.WrapError(err)
+	} else if banned {
+		os.Remove(tempFile.Name())
+		return attachment[0], errBannedMedia
+	}
+
+	if attachment[0], err = attachment[0].StoreMedia(); err != nil {
+		os.Remove(tempFile.Name())
+		return attachment[0], util.WrapError(err)
+	}
+
+	attachment[0] = attachment[0].WithMediaInfo()
+
+	if preview := attachment[0].CreatePreview(); preview.Href != "" {
+		attachment[0].Preview = preview
+	}
+
+	return attachment[0], nil
+}
+
+func objectFromForm(ctx *fiber.Ctx, board activitypub.Actor, obj activitypub.ObjectBase) (_ activitypub.ObjectBase, err error) {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+
+	name, tripcode, capcode, _ := db.CreateNameTripCode(ctx.FormValue("name"), acct)
 
-		re := regexp.MustCompile(`image/(jpe?g|png|webp)`)
-		if re.MatchString(obj.Attachment[0].MediaType) {
-			fileLoc := strings.ReplaceAll(obj.Attachment[0].Href, config.Domain, "")
+	// Filtered before the media is saved, so blocked posts don't leave any
+	// behind.
+	filtered := activitypub.ApplyFilters(name, ctx.FormValue("subject"), ctx.FormValue("comment"), board.Id)
+	if filtered.Block {
+		return obj, errFiltered
+	} else if filtered.TooLong {
+		return obj, errFilteredTooLong
+	}
 
-			cmd := exec.Command("exiv2", "rm", "."+fileLoc)
+	// The post isn't going to be written if anything fails, so nothing it
+	// stored should be kept either.
+	defer func() {
+		if err == nil {
+			return
+		}
 
-			if err := cmd.Run(); err != nil {
-				return obj, util.WrapError(err)
+		for _, attachment := range obj.Attachment {
+			if err := attachment.DiscardMedia(); err != nil {
+				log.Printf("failed to discard media %s: %v", attachment.Href, err)
 			}
 		}
+	}()
 
-		obj.Preview = obj.Attachment[0].CreatePreview()
+	for _, header := range formFiles(ctx) {
+		attachment, err := attachmentFromForm(header)
+		if err != nil {
+			return obj, util.WrapError(err)
+		}
+
+		obj.Attachment = append(obj.Attachment, attachment)
 	}
 
-	name, tripcode, _ := db.CreateNameTripCode(ctx.FormValue("name"), acct)
+	if len(obj.Attachment) > 0 {
+		obj.Preview = obj.Attachment[0].Preview
+	}
 
-	obj.AttributedTo = name
+	obj.AttributedTo = filtered.Name
 	obj.TripCode = tripcode
-	obj.Name = ctx.FormValue("subject")
-	obj.Content = ctx.FormValue("comment")
-	obj.Sensitive = (ctx.FormValue("sensitive") != "")
+	obj.Capcode = capcode
+	obj.Name = filtered.Subject
+	obj.Content = db.ExpandCites(board, filtered.Comment)
+	obj.Sensitive = (ctx.FormValue("sensitive") != "") || filtered.Sensitive
 	obj.Option = parseOptions(ctx)
 
+	if filtered.Sage {
+		obj.Option = append(obj.Option, "sage")
+	}
+
+	if filtered.Hold {
+		obj.Hold()
+	}
+
 	var originalPost activitypub.ObjectBase
 
 	originalPost.Id = html.EscapeString(ctx.FormValue("inReplyTo"))
@@ -333,6 +579,8 @@ func objectFromForm(ctx *fiber.Ctx, obj activitypub.ObjectBase) (activitypub.Obj
 		return obj, util.WrapError(err)
 	}
 
+	obj.Cites = replyingTo
+
 	for _, e := range replyingTo {
 		has := false
 
@@ -371,18 +619,59 @@ func parseAttachment(obj activitypub.ObjectBase, catalog bool) template.HTML {
 		return ""
 	}
 
-	if strings.HasPrefix(obj.Attachment[0].MediaType, "image/") {
-		src := obj.Preview.Href
+	attachments := obj.Attachment
+	if catalog {
+		attachments = attachments[:1]
+	}
+
+	var media strings.Builder
+	for i, e := range attachments {
+		preview := e.Preview
+		if preview == nil && i == 0 {
+			preview = obj.Preview
+		}
+
+		media.WriteString(string(parseMedia(e, preview)))
+	}
+
+	if len(attachments) > 1 {
+		return template.HTML(`<div class="gallery">` + media.String() + `</div>`)
+	}
+
+	return template.HTML(media.String())
+}
+
+func parseMedia(attachment activitypub.ObjectBase, preview *activitypub.ObjectBase) template.HTML {
+	var src string
+	if preview != nil && preview.Href != "" {
+		src = util.MediaProxy(preview.Href)
+	}
+
+	href := util.MediaProxy(attachment.Href)
+
+	// All of these can come from other instances.
+	esc := template.HTMLEscapeString
+	mediaType := esc(attachment.MediaType)
+
+	if strings.HasPrefix(attachment.MediaType, "image/") {
+		if src == "" {
+			src = href
+		}
+
+		return template.HTML(fmt.Sprintf(`<img class="media" enlarge="0" attachment="%s" src="%s" preview="%s">`, esc(attachment.Href), esc(src), esc(src)))
+	} else if strings.HasPrefix(attachment.MediaType, "audio/") {
+		if src == "" {
+			src = "/static/audio.svg"
+		}
+
+		return template.HTML(fmt.Sprintf(`<img class="media" enlarge="0" attachment="%s" src="%s" preview="%s" data-type="audio" data-mediatype="%s">`, esc(href), esc(src), esc(src), mediaType))
+	} else if strings.HasPrefix(attachment.MediaType, "video/") {
+		// Without a preview, the video itself is all we can show.
 		if src == "" {
-			src = obj.Attachment[0].Href
+			return template.HTML(fmt.Sprintf(`<video class="media" controls muted preload="metadata"><source src="%s" type="%s">Video is not supported.</video>`, esc(href), mediaType))
 		}
-		src = util.MediaProxy(src)
 
-		return template.HTML(fmt.Sprintf(`<img class="media" enlarge="0" attachment="%s" src="%s" preview="%s">`, obj.Attachment[0].Href, src, src))
-	} else if strings.HasPrefix(obj.Attachment[0].MediaType, "audio/") {
-		return template.HTML(fmt.Sprintf(`<audio class="media" controls preload="metadata"><source src="%s" type="%s">Audio is not supported.</audio>`, util.MediaProxy(obj.Attachment[0].Href), obj.Attachment[0].MediaType))
-	} else if strings.HasPrefix(obj.Attachment[0].MediaType, "video/") {
-		return template.HTML(fmt.Sprintf(`<video class="media" controls muted preload="metadata"><source src="%s" type="%s">Audio is not supported.</video>`, util.MediaProxy(obj.Attachment[0].Href), obj.Attachment[0].MediaType))
+		return template.HTML(fmt.Sprintf(`<img class="media" enlarge="0" attachment="%s" src="%s" preview="%s" data-type="video" data-mediatype="%s">`, esc(href), esc(src), esc(src), mediaType))
 	}
 
 	return ""
@@ -433,6 +722,18 @@ func statusTemplate(num int) func(ctx *fiber.Ctx, msg ...string) error {
 	}
 }
 
+// sendCooldown tells a poster to wait before posting again.
+func sendCooldown(ctx *fiber.Ctx, wait time.Duration, msg string) error {
+	ctx.Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+	return send429(ctx, msg)
+}
+
+// sendTooMany tells a peer to back off for wait.
+func sendTooMany(ctx *fiber.Ctx, wait time.Duration) error {
+	ctx.Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+	return ctx.SendStatus(fiber.StatusTooManyRequests)
+}
+
 func send500(ctx *fiber.Ctx, err error, msg ...string) error {
 	acct, _ := ctx.Locals("acct").(*db.Acct)
 
@@ -459,3 +760,5 @@ func send500(ctx *fiber.Ctx, err error, msg ...string) error {
 var send400 = statusTemplate(400)
 var send403 = statusTemplate(403)
 var send404 = statusTemplate(404)
+var send202 = statusTemplate(202)
+var send429 = statusTemplate(429)
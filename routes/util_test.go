@@ -0,0 +1,138 @@
+package routes
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestForwardedIP(t *testing.T) {
+	trusted := parseProxies([]string{"127.0.0.1", "::1", "10.0.0.0/8"})
+
+	tests := []struct {
+		name   string
+		remote string
+		header string
+		want   string
+	}{
+		{"untrusted remote", "203.0.113.5", "198.51.100.1", "203.0.113.5"},
+		{"no header", "127.0.0.1", "", "127.0.0.1"},
+		{"one proxy", "127.0.0.1", "198.51.100.1", "198.51.100.1"},
+		{"spoofed first entry", "127.0.0.1", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"chain of proxies", "127.0.0.1", "1.2.3.4, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"only proxies", "127.0.0.1", "10.0.0.2, 10.0.0.3", "10.0.0.2"},
+		{"garbage after client", "127.0.0.1", "198.51.100.1, nonsense", "127.0.0.1"},
+		{"ipv6", "::1", "2001:db8::1", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedIP(net.ParseIP(tt.remote), tt.header, trusted); got != tt.want {
+				t.Errorf("forwardedIP(%s, %q) = %s, want %s", tt.remote, tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	tests := []struct {
+		list []string
+		want int
+	}{
+		{[]string{"127.0.0.1", "::1"}, 2},
+		{[]string{" 10.0.0.0/8 ", ""}, 1},
+		{[]string{"localhost", "10.0.0.0/33"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseProxies(tt.list); len(got) != tt.want {
+			t.Errorf("parseProxies(%q) has %d ranges, want %d", tt.list, len(got), tt.want)
+		}
+	}
+}
+
+func TestParseMediaEscapes(t *testing.T) {
+	tests := []struct {
+		name       string
+		attachment activitypub.ObjectBase
+	}{
+		{"image", activitypub.ObjectBase{Href: `https://example.com/a.png"><script>`, MediaType: "image/png"}},
+		{"audio", activitypub.ObjectBase{Href: "https://example.com/a.mp3", MediaType: `audio/mpeg"><script>`}},
+		{"video", activitypub.ObjectBase{Href: "https://example.com/a.mp4", MediaType: `video/mp4"><script>`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(parseMedia(tt.attachment, nil))
+			if got == "" {
+				t.Fatal("parseMedia() is empty")
+			} else if strings.Contains(got, "<script>") {
+				t.Errorf("parseMedia() = %q, which isn't escaped", got)
+			}
+		})
+	}
+}
+
+func TestFormFiles(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("comment", "hello")
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		part, _ := w.CreateFormFile("file", name)
+		part.Write([]byte(name))
+	}
+	w.Close()
+
+	var names []string
+	app := fiber.New()
+	app.Post("/", func(ctx *fiber.Ctx) error {
+		for _, e := range formFiles(ctx) {
+			names = append(names, e.Filename)
+		}
+
+		return nil
+	})
+
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(names, ","); got != "a.png,b.png,c.png" {
+		t.Errorf("formFiles() = %q, want every file in order", got)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("comment=hello"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	names = nil
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Errorf("formFiles() = %q without a multipart form", names)
+	}
+}
+
+func TestParseMediaPreview(t *testing.T) {
+	attachment := activitypub.ObjectBase{Href: "https://example.com/public/a.png", MediaType: "image/png"}
+	preview := &activitypub.ObjectBase{Href: "https://example.com/public/a_thumb.jpg"}
+
+	if got := string(parseMedia(attachment, preview)); !strings.Contains(got, `src="https://example.com/public/a_thumb.jpg"`) {
+		t.Errorf("parseMedia() = %q, want the preview shown", got)
+	}
+
+	if got := string(parseMedia(attachment, nil)); !strings.Contains(got, `src="https://example.com/public/a.png"`) {
+		t.Errorf("parseMedia() = %q, want the image itself shown without a preview", got)
+	}
+
+	attachment.MediaType = "application/pdf"
+	if got := parseMedia(attachment, preview); got != "" {
+		t.Errorf("parseMedia() = %q for a file that can't be shown", got)
+	}
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"encoding/json"
+	"net/url"
 	"strings"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
@@ -34,6 +35,11 @@ func Webfinger(c *fiber.Ctx) error {
 
 	actor := activitypub.Actor{Id: config.TP + "" + actorDomain[1] + "" + actorDomain[0]}
 	if res, _ := actor.IsLocal(); !res {
+		if loc, ok := activitypub.MovedLocation(actor.Id); ok {
+			// Point the old account at wherever it lives now.
+			return c.Redirect("/.well-known/webfinger?resource="+url.QueryEscape("acct:"+webfingerName(loc)), fiber.StatusMovedPermanently)
+		}
+
 		c.Status(fiber.StatusBadRequest)
 		return c.Send([]byte("actor not local"))
 	}
@@ -53,3 +59,9 @@ func Webfinger(c *fiber.Ctx) error {
 	c.Set("Content-Type", config.ActivityStreams)
 	return c.Send(enc)
 }
+
+// webfingerName returns the board@instance form of an actor ID.
+func webfingerName(id string) string {
+	name, instance := activitypub.GetActorAndInstance(id)
+	return name + "@" + instance
+}
@@ -1,22 +1,204 @@
 package util
 
 import (
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
 )
 
-func GetPathProxyType(path string) string {
+// Proxy is a route for requests to every host ending in Suffix.
+type Proxy struct {
+	// Suffix is the hostname suffix this route applies to, such as ".onion".
+	// "*" is the fallback for hosts no other route matches.
+	Suffix string
+
+	// URL is the socks5:// or http:// proxy to go through, or nil to connect
+	// directly.
+	URL *url.URL
+
+	// Scheme, if set, replaces the scheme of every request, as hidden
+	// services are rarely served over HTTPS.
+	Scheme string
+
+	Timeout time.Duration
+
+	client *http.Client
+}
+
+// Networks that can't be reached without going through something; posts from
+// them are treated as such even if we have no route to them.
+var overlaySuffixes = []string{".onion", ".i2p", ".loki"}
+
+var networkNames = map[string]string{
+	".onion": "Tor",
+	".i2p":   "I2P",
+	".loki":  "Lokinet",
+}
+
+// Proxies is the routing table for outbound requests, read from the config.
+// Each route looks like:
+//
+//	proxy.<suffix>:<proxy URL or "direct"> [scheme] [timeout]
+var Proxies = loadProxies()
+
+func loadProxies() []*Proxy {
+	var proxies []*Proxy
+
+	for suffix, value := range config.GetConfigValues("proxy.") {
+		if suffix != "*" && !strings.HasPrefix(suffix, ".") {
+			suffix = "." + suffix
+		}
+
+		p, err := parseProxy(suffix, value)
+		if err != nil {
+			log.Printf("ignoring proxy route for %s: %v", suffix, err)
+			continue
+		}
+
+		proxies = append(proxies, p)
+	}
+
+	// Before routes were configurable, there was only Tor.
 	if config.TorProxy != "" {
-		re := regexp.MustCompile(`(http://|http://)?(www.)?\w+\.onion`)
-		onion := re.MatchString(path)
+		if ProxyFor("x.onion", proxies) == nil {
+			p, _ := parseProxy(".onion", "socks5://"+config.TorProxy+" http 15s")
+			proxies = append(proxies, p)
+		}
+
+		if hasOverlaySuffix(hostOf(config.Domain)) && ProxyFor("x", proxies) == nil {
+			p, _ := parseProxy("*", "socks5://"+config.TorProxy+" - 15s")
+			proxies = append(proxies, p)
+		}
+	}
+
+	return proxies
+}
+
+func parseProxy(suffix, value string) (*Proxy, error) {
+	p := &Proxy{Suffix: suffix, Timeout: 15 * time.Second}
+	fields := strings.Fields(value)
+
+	if len(fields) > 0 && fields[0] != "direct" {
+		u, err := url.Parse(fields[0])
+		if err != nil {
+			return nil, WrapError(err)
+		}
+
+		p.URL = u
+	}
+
+	if len(fields) > 1 && fields[1] != "-" {
+		p.Scheme = fields[1]
+	}
 
-		if onion {
-			return "tor"
+	if len(fields) > 2 {
+		timeout, err := time.ParseDuration(fields[2])
+		if err != nil {
+			return nil, WrapError(err)
 		}
+
+		p.Timeout = timeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if p.URL != nil {
+		transport.Proxy = http.ProxyURL(p.URL)
+	}
+
+	p.client = &http.Client{Transport: transport, Timeout: p.Timeout}
+
+	return p, nil
+}
+
+// ProxyFor returns the route in proxies that host should take, or nil if it
+// should be reached directly.
+// The longest matching suffix wins.
+func ProxyFor(host string, proxies []*Proxy) *Proxy {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var route, fallback *Proxy
+
+	for _, p := range proxies {
+		if p.Suffix == "*" {
+			fallback = p
+		} else if strings.HasSuffix(host, p.Suffix) && (route == nil || len(p.Suffix) > len(route.Suffix)) {
+			route = p
+		}
+	}
+
+	if route == nil {
+		return fallback
+	}
+
+	return route
+}
+
+func hostOf(path string) string {
+	if u, err := url.Parse(path); err == nil && u.Host != "" {
+		return u.Host
+	}
+
+	// No scheme, so it all parses as a path.
+	return strings.SplitN(StripTransferProtocol(path), "/", 2)[0]
+}
+
+// IsOverlay reports whether path is on a network that isn't the clearnet,
+// such as Tor or I2P.
+func IsOverlay(path string) bool {
+	host := hostOf(path)
+	if hasOverlaySuffix(host) {
+		return true
+	}
+
+	p := ProxyFor(host, Proxies)
+	return p != nil && p.Suffix != "*"
+}
+
+// NetworkName returns a readable name for the network path is on.
+func NetworkName(path string) string {
+	host := hostOf(path)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for suffix, name := range networkNames {
+		if strings.HasSuffix(host, suffix) {
+			return name
+		}
+	}
+
+	if p := ProxyFor(host, Proxies); p != nil && p.Suffix != "*" {
+		return strings.TrimPrefix(p.Suffix, ".")
+	}
+
+	return "Clearnet"
+}
+
+func hasOverlaySuffix(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, suffix := range overlaySuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func GetPathProxyType(path string) string {
+	if p := ProxyFor(hostOf(path), Proxies); p != nil && p.URL != nil {
+		return strings.TrimPrefix(p.Suffix, ".")
 	}
 
 	return "clearnet"
@@ -28,8 +210,8 @@ func MediaProxy(url string) string {
 		return url
 	}
 
-	re = regexp.MustCompile(`(.+)?\.onion(.+)?`)
-	if re.MatchString(url) {
+	// Without a route, the best we can do is let the browser try.
+	if IsOverlay(url) && ProxyFor(hostOf(url), Proxies) == nil {
 		return url
 	}
 
@@ -39,22 +221,16 @@ func MediaProxy(url string) string {
 }
 
 func RouteProxy(req *http.Request) (*http.Response, error) {
-	var proxyType = GetPathProxyType(req.URL.Host)
-
 	req.Header.Set("User-Agent", "FChannel/"+config.InstanceName)
 
-	if proxyType == "tor" || IsOnion(config.Domain) {
-		proxyUrl, err := url.Parse("socks5://" + config.TorProxy)
-
-		if err != nil {
-			return nil, WrapError(err)
-		}
-
-		proxyTransport := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
-		client := &http.Client{Transport: proxyTransport, Timeout: time.Second * 15}
+	p := ProxyFor(req.URL.Host, Proxies)
+	if p == nil {
+		return http.DefaultClient.Do(req)
+	}
 
-		return client.Do(req)
+	if p.Scheme != "" {
+		req.URL.Scheme = p.Scheme
 	}
 
-	return http.DefaultClient.Do(req)
+	return p.client.Do(req)
 }
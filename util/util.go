@@ -17,11 +17,6 @@ import (
 )
 
 var xferRegexp = regexp.MustCompile("(http://|https://)?(www.)?")
-var onionRegexp = regexp.MustCompile(`\.onion`)
-
-func IsOnion(url string) bool {
-	return onionRegexp.MatchString(url)
-}
 
 func StripTransferProtocol(value string) string {
 	return xferRegexp.ReplaceAllString(value, "")
@@ -202,6 +197,14 @@ func CreatedNeededDirectories() error {
 		}
 	}
 
+	// Uploads are kept here until they're checked, where they can't be
+	// fetched.
+	if _, err := os.Stat("./tmp"); os.IsNotExist(err) {
+		if err = os.Mkdir("./tmp", 0700); err != nil {
+			return WrapError(err)
+		}
+	}
+
 	if _, err := os.Stat("./pem/board"); os.IsNotExist(err) {
 		if err = os.MkdirAll("./pem/board", 0700); err != nil {
 			return WrapError(err)
@@ -234,18 +237,8 @@ func WrapError(err error) error {
 		name := fn.Name()
 		name = name[strings.LastIndex(name, ".")+1:]
 
-		return fmt.Errorf("%s:%d:%s() %v", file, line, name, err)
+		return fmt.Errorf("%s:%d:%s() %w", file, line, name, err)
 	}
 
 	return nil
 }
-
-func SupportedMIMEType(mime string) bool {
-	for _, e := range config.SupportedFiles {
-		if e == mime {
-			return true
-		}
-	}
-
-	return false
-}
@@ -6,6 +6,12 @@ for (let img of document.getElementsByClassName('media')) {
         var media = document.getElementById("media-" + id);
         var sensitive = document.getElementById("sensitive-" + id);     
         
+        // Videos and audio show a preview until they're played.
+        if (img.dataset.type) {
+            playMedia(img);
+            return;
+        }
+
         if (img.getAttribute("enlarge") == "0") {
             var attachment = img.getAttribute("attachment");
             img.setAttribute("enlarge", "1");
@@ -18,6 +24,33 @@ for (let img of document.getElementsByClassName('media')) {
     });
 }
 
+function playMedia(img) {
+    var player = document.createElement(img.dataset.type);
+    player.className = "media";
+    player.setAttribute("enlarge", "1");
+    player.controls = true;
+    player.autoplay = true;
+
+    var source = document.createElement("source");
+    source.src = img.getAttribute("attachment");
+    source.type = img.dataset.mediatype;
+    player.appendChild(source);
+
+    var close = document.createElement("a");
+    close.className = "close-media";
+    close.href = "javascript:void(0)";
+    close.textContent = "[Close]";
+    close.onclick = () => {
+        player.pause();
+        player.remove();
+        close.remove();
+        img.style.display = "";
+    };
+
+    img.style.display = "none";
+    img.after(close, player);
+}
+
 function viewLink(board, actor) {
     var posts = document.querySelectorAll('#view');
     var postsArray = [].slice.call(posts);
@@ -342,3 +342,101 @@ function stripTransferProtocol(value){
     var re = /(https:\/\/|http:\/\/)?(www.)?/;
     return value.replace(re, "");
 }
+
+function setupPostPassword(){
+    // Posters rarely pick a password, so give them one to delete with later.
+    var password = localStorage.getItem("postPassword");
+    if(!password){
+        var bytes = new Uint8Array(12);
+        crypto.getRandomValues(bytes);
+        password = Array.from(bytes, function(b){ return b.toString(16).padStart(2, "0"); }).join("");
+        localStorage.setItem("postPassword", password);
+    }
+
+    for(let input of document.querySelectorAll("#password, #reply-password")){
+        if(input.value == "")
+            input.value = password;
+
+        input.addEventListener("change", function(){
+            localStorage.setItem("postPassword", input.value);
+        });
+    }
+}
+
+document.addEventListener("DOMContentLoaded", setupPostPassword, false);
+
+function highlightPoster(id){
+    // Clicking the same ID again turns the highlight off.
+    var on = !id.closest(".post").classList.contains("highlight");
+
+    for(let post of document.querySelectorAll(".post")){
+        var poster = post.querySelector(".posterid");
+        post.classList.toggle("highlight", !!(on && poster && poster.dataset.posterid == id.dataset.posterid));
+    }
+}
+
+function setupPreviews(){
+    // Links to posts show the post when hovered over.
+    var previews = {};
+    var current = null;
+    var preview = null;
+
+    function hide(){
+        current = null;
+        if(preview){
+            preview.remove();
+            preview = null;
+        }
+    }
+
+    function show(link, html){
+        if(current != link)
+            return;
+
+        hide();
+        current = link;
+
+        preview = document.createElement("div");
+        preview.className = "post reply preview";
+        preview.innerHTML = html;
+
+        var rect = link.getBoundingClientRect();
+        preview.style.left = (rect.right + window.scrollX + 5) + "px";
+        preview.style.top = (rect.top + window.scrollY) + "px";
+        document.body.appendChild(preview);
+    }
+
+    document.addEventListener("mouseover", function(e){
+        var link = e.target.closest("a[data-post]");
+        if(!link || link == current || (preview && preview.contains(link)))
+            return;
+
+        current = link;
+
+        var id = link.dataset.post;
+        if(previews[id] !== undefined){
+            show(link, previews[id]);
+            return;
+        }
+
+        var board = location.pathname.split("/")[1];
+        fetch("/api/post?id=" + encodeURIComponent(id) + "&board=" + encodeURIComponent(board))
+            .then(function(resp){
+                if(!resp.ok)
+                    throw resp.status;
+                return resp.text();
+            })
+            .then(function(html){
+                previews[id] = html;
+                show(link, html);
+            })
+            .catch(function(){});
+    });
+
+    document.addEventListener("mouseout", function(e){
+        if(e.target.closest("a[data-post]") == current)
+            hide();
+    });
+}
+
+document.addEventListener("DOMContentLoaded", setupPreviews, false);